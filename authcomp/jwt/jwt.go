@@ -8,6 +8,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/melsonic/skyvault/auth/db"
 	"github.com/melsonic/skyvault/auth/models"
+	"github.com/melsonic/skyvault/auth/verify"
 )
 
 const (
@@ -70,23 +71,14 @@ func GenerateRefreshToken(email string, name string, refreshTokenVersion int) (s
 }
 
 func GetUserIdentityFromAccessToken(tokenString string) *models.User {
-	signingKey := []byte(os.Getenv("SECRET_SIGNATURE"))
+	user, err := verify.AccessToken(tokenString)
 
-	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (any, error) {
-		return signingKey, nil
-	})
-
-	if err != nil || !token.Valid {
+	if err != nil {
 		slog.Info("error parsing access token", "error", err.Error())
 		return nil
 	}
 
-	claims := token.Claims.(jwt.MapClaims)
-
-	return &models.User{
-		Email: claims["Email"].(string),
-		Name:  claims["Name"].(string),
-	}
+	return user
 }
 
 func GetUserIdentityFromRefreshToken(tokenString string) *models.User {
@@ -11,9 +11,9 @@ import (
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		authorizationHeader := r.Header.Get("Authorization")
-		tokenString := strings.Split(authorizationHeader, " ")[1]
+		tokenString, ok := strings.CutPrefix(authorizationHeader, "Bearer ")
 
-		if authorizationHeader == "" || !strings.HasPrefix(authorizationHeader, "Bearer ") || strings.Count(tokenString, ".") != 2 {
+		if !ok || strings.Count(tokenString, ".") != 2 {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("invalid authorization header"))
 			return
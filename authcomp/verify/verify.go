@@ -0,0 +1,162 @@
+// Package verify checks access tokens issued by the auth service, it is
+// shared with the other services and doesn't need the auth database
+package verify
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/melsonic/skyvault/auth/models"
+)
+
+// AccessTokenType is the TokenType of the tokens Middleware accepts
+const AccessTokenType = "access-token"
+
+var ErrInvalidToken = errors.New("invalid access token")
+
+type userKey struct{}
+
+type internalKey struct{}
+
+// AccessToken validates an access token signed with SECRET_SIGNATURE,
+// and by TOKEN_ISSUER when set, and returns the user it was issued to
+func AccessToken(tokenString string) (*models.User, error) {
+	signingKey := []byte(os.Getenv("SECRET_SIGNATURE"))
+	if len(signingKey) == 0 {
+		return nil, errors.New("SECRET_SIGNATURE is not set")
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+	}
+	if issuer := os.Getenv("TOKEN_ISSUER"); issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+
+	claims := &models.JWTTokenClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
+		return signingKey, nil
+	}, options...)
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	// refresh tokens are signed with the same key
+	if claims.TokenType != AccessTokenType || claims.Email == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return &models.User{Email: claims.Email, Name: claims.Name}, nil
+}
+
+// UserFromContext returns the caller Middleware verified, nil for
+// internal calls without a token
+func UserFromContext(ctx context.Context) *models.User {
+	user, _ := ctx.Value(userKey{}).(*models.User)
+	return user
+}
+
+// IsInternal reports calls Middleware let through for coming from AUTH_ALLOWLIST
+func IsInternal(ctx context.Context) bool {
+	internal, _ := ctx.Value(internalKey{}).(bool)
+	return internal
+}
+
+// InternalOnly keeps a route working across every user's data, like
+// deleting or listing all chunks, to the services of AUTH_ALLOWLIST
+func InternalOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !IsInternal(r.Context()) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("internal route"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// WithUser returns ctx carrying user as the caller
+func WithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// parseAllowList reads the comma separated addresses and CIDR ranges of AUTH_ALLOWLIST
+func parseAllowList() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(os.Getenv("AUTH_ALLOWLIST"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			slog.Error("ignoring invalid AUTH_ALLOWLIST entry", "entry", entry)
+			continue
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes
+}
+
+func allowed(prefixes []netip.Prefix, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejects requests without a valid bearer access token and puts
+// the caller in the request context. Requests without a token coming from
+// an address of AUTH_ALLOWLIST are service to service calls and get through.
+func Middleware(next http.Handler) http.Handler {
+	allowList := parseAllowList()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizationHeader := r.Header.Get("Authorization")
+		if authorizationHeader == "" {
+			if allowed(allowList, r.RemoteAddr) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), internalKey{}, true)))
+				return
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("missing authorization header"))
+			return
+		}
+
+		tokenString, ok := strings.CutPrefix(authorizationHeader, "Bearer ")
+		if !ok || tokenString == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid authorization header"))
+			return
+		}
+		user, err := AccessToken(tokenString)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("invalid jwt token"))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), user)))
+	})
+}
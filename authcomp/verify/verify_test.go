@@ -0,0 +1,64 @@
+package verify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/melsonic/skyvault/auth/models"
+)
+
+func signedToken(t *testing.T, key string, tokenType string) string {
+	t.Helper()
+	claims := models.JWTTokenClaims{
+		Email:     "a@example.com",
+		TokenType: tokenType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestMiddlewareAndInternalOnly(t *testing.T) {
+	t.Setenv("SECRET_SIGNATURE", "secret")
+	t.Setenv("TOKEN_ISSUER", "")
+	t.Setenv("AUTH_ALLOWLIST", "10.0.0.0/8")
+
+	route := Middleware(InternalOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		authorization string
+		want          int
+	}{
+		{"allow-listed service", "10.1.2.3:4000", "", http.StatusOK},
+		{"unknown address", "192.168.1.1:4000", "", http.StatusUnauthorized},
+		{"user token", "10.1.2.3:4000", "Bearer " + signedToken(t, "secret", AccessTokenType), http.StatusForbidden},
+		{"refresh token", "10.1.2.3:4000", "Bearer " + signedToken(t, "secret", "refresh-token"), http.StatusUnauthorized},
+		{"wrong key", "10.1.2.3:4000", "Bearer " + signedToken(t, "other", AccessTokenType), http.StatusUnauthorized},
+		{"not bearer", "10.1.2.3:4000", "Basic abc", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/chunks", nil)
+			request.RemoteAddr = test.remoteAddr
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			route.ServeHTTP(recorder, request)
+			if recorder.Code != test.want {
+				t.Errorf("status = %d, want %d", recorder.Code, test.want)
+			}
+		})
+	}
+}
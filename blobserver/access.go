@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/melsonic/skyvault/auth/verify"
+	"github.com/melsonic/skyvault/blobserver/digest"
+	"github.com/melsonic/skyvault/blobserver/types"
+)
+
+const (
+	defaultChunkAccessTTL = time.Minute
+	// maxChunkAccessEntries triggers dropping the expired entries
+	maxChunkAccessEntries = 100000
+)
+
+// chunkAccess remembers which users metadata let read which chunks, so a
+// download doesn't ask for every chunk again. Revoked access ends within
+// CHUNK_ACCESS_TTL.
+var chunkAccess = struct {
+	sync.Mutex
+	granted map[string]time.Time
+}{granted: map[string]time.Time{}}
+
+// canReadChunk asks the metadata service at METADATA_URL, on behalf of the
+// caller whose token is forwarded, whether one of the files built from
+// hash is readable to them
+func canReadChunk(ctx context.Context, email string, authorization string, hash string) (bool, error) {
+	cacheKey := email + "\x00" + hash
+	now := time.Now()
+	chunkAccess.Lock()
+	expires, ok := chunkAccess.granted[cacheKey]
+	if ok && now.After(expires) {
+		delete(chunkAccess.granted, cacheKey)
+		ok = false
+	}
+	chunkAccess.Unlock()
+	if ok {
+		return true, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv("METADATA_URL")+"/chunks/"+url.PathEscape(hash)+"/access", nil)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Authorization", authorization)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("metadata service answered %s", response.Status)
+	}
+
+	grantChunkAccess(email, hash)
+	return true, nil
+}
+
+// grantChunkAccess caches that email can read hash
+func grantChunkAccess(email string, hash string) {
+	now := time.Now()
+	chunkAccess.Lock()
+	defer chunkAccess.Unlock()
+	if len(chunkAccess.granted) >= maxChunkAccessEntries {
+		for key, expires := range chunkAccess.granted {
+			if now.After(expires) {
+				delete(chunkAccess.granted, key)
+			}
+		}
+	}
+	chunkAccess.granted[email+"\x00"+hash] = now.Add(durationFromEnv("CHUNK_ACCESS_TTL", defaultChunkAccessTTL))
+}
+
+// recordUpload tells the metadata service that email sent the content of
+// hash, which lets them put the chunk in their files
+func recordUpload(ctx context.Context, email string, hash string) error {
+	body, err := json.Marshal(types.ChunkUploadsRequest{Email: email, Hashes: []string{hash}})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, os.Getenv("METADATA_URL")+"/chunks/uploads", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata service answered %s", response.Status)
+	}
+	grantChunkAccess(email, hash)
+	return nil
+}
+
+// readableChunks asks the metadata service which of hashes the caller
+// whose token is forwarded can read
+func readableChunks(ctx context.Context, authorization string, hashes []string) (map[string]bool, error) {
+	body, err := json.Marshal(types.MissingChunksRequest{Hashes: hashes})
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, os.Getenv("METADATA_URL")+"/chunks/readable", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", authorization)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service answered %s", response.Status)
+	}
+	var result types.ReadableChunksResponse
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	readable := make(map[string]bool, len(result.Readable))
+	for _, hash := range result.Readable {
+		readable[hash] = true
+	}
+	return readable, nil
+}
+
+// readableChunk lets users read the chunk {hash} only when metadata says
+// one of the files built from it is theirs or shared with them. Internal
+// calls read any chunk. Without METADATA_URL users read none.
+func readableChunk(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := verify.UserFromContext(r.Context())
+		if user == nil {
+			next(w, r)
+			return
+		}
+		if os.Getenv("METADATA_URL") == "" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("chunk access can't be checked"))
+			return
+		}
+		key, ok := chunkKey(w, r)
+		if !ok {
+			return
+		}
+		readable, err := canReadChunk(r.Context(), user.Email, r.Header.Get("Authorization"), key.String())
+		if err != nil {
+			slog.Error("error checking chunk access", "hash", key.String(), "error", err.Error())
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte("error checking chunk access"))
+			return
+		}
+		if !readable {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("no access to this chunk"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// uploadRecorded records a chunk uploaded by a user with the metadata
+// service, answering 502 when that fails so the client retries
+func uploadRecorded(w http.ResponseWriter, r *http.Request, key digest.Key) bool {
+	user := verify.UserFromContext(r.Context())
+	if user == nil {
+		return true
+	}
+	if os.Getenv("METADATA_URL") == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("chunk upload can't be recorded"))
+		return false
+	}
+	if err := recordUpload(r.Context(), user.Email, key.String()); err != nil {
+		slog.Error("error recording chunk upload", "hash", key.String(), "error", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("error recording chunk upload"))
+		return false
+	}
+	return true
+}
+
+// userReadableChunks returns the keys the caller may read. The others are
+// missing to them whether they are stored or not, and must not be reserved.
+func userReadableChunks(w http.ResponseWriter, r *http.Request, keys []digest.Key) ([]digest.Key, bool) {
+	if os.Getenv("METADATA_URL") == "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("chunk access can't be checked"))
+		return nil, false
+	}
+	if len(keys) == 0 {
+		return nil, true
+	}
+	hashes := make([]string, len(keys))
+	for i := range keys {
+		hashes[i] = keys[i].String()
+	}
+	readable, err := readableChunks(r.Context(), r.Header.Get("Authorization"), hashes)
+	if err != nil {
+		slog.Error("error checking chunk access", "error", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("error checking chunk access"))
+		return nil, false
+	}
+	var result []digest.Key
+	for _, key := range keys {
+		if readable[key.String()] {
+			result = append(result, key)
+		}
+	}
+	return result, true
+}
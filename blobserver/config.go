@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/melsonic/skyvault/blobserver/minio"
+	"github.com/melsonic/skyvault/blobserver/store"
+	"github.com/melsonic/skyvault/blobserver/types"
+)
+
+const (
+	// defaultCompressionMinRatio only compresses chunks that shrink by at least 10%
+	defaultCompressionMinRatio = 0.9
+
+	defaultCacheMaxObjectBytes = 16 << 20
+	defaultCacheDiskBytes      = 10 << 30
+
+	defaultReconcileInterval = 6 * time.Hour
+	defaultProbeInterval     = time.Minute
+
+	defaultPackSize         = 4 << 20
+	defaultPackMinLiveRatio = 0.5
+	defaultPackInterval     = 10 * time.Minute
+
+	defaultColdAfter    = 30 * 24 * time.Hour
+	defaultTierInterval = time.Hour
+
+	// defaultChunkReservation matches the default GC_GRACE_PERIOD of metadata
+	defaultChunkReservation = 24 * time.Hour
+)
+
+// backend is one storage driver, name identifies it in logs
+type backend struct {
+	name  string
+	store store.ChunkStore
+}
+
+// newBackend builds a storage driver from a 'minio:<bucket>',
+// 'local:<dir>' or 'memory' spec
+func newBackend(spec string) (backend, error) {
+	driver, arg, _ := strings.Cut(spec, ":")
+	var s store.ChunkStore
+	var err error
+	switch driver {
+	case "minio":
+		// buckets written before keys named their algorithm hold bare digests
+		var bucket *minio.Store
+		bucket, err = minio.NewStore(arg)
+		if err == nil {
+			s = store.NewLegacyKeyStore(bucket)
+		}
+	case "local":
+		s, err = store.NewLocalStore(arg)
+	case "memory":
+		s = store.NewMemoryStore()
+	default:
+		return backend{}, fmt.Errorf("unknown storage driver %q", driver)
+	}
+	if err != nil {
+		return backend{}, err
+	}
+	return backend{name: spec, store: s}, nil
+}
+
+// newBackends builds the drivers listed in STORAGE_BACKENDS, or the
+// single one selected by STORAGE_DRIVER when the list is empty
+func newBackends() ([]backend, error) {
+	var specs []string
+	for _, spec := range strings.Split(os.Getenv("STORAGE_BACKENDS"), ",") {
+		if spec = strings.TrimSpace(spec); spec != "" {
+			specs = append(specs, spec)
+		}
+	}
+	if len(specs) == 0 {
+		switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+		case "", "minio":
+			specs = []string{"minio:" + os.Getenv("BUCKETNAME")}
+		case "local":
+			specs = []string{"local:" + os.Getenv("STORAGE_DIR")}
+		default:
+			specs = []string{driver}
+		}
+	}
+
+	backends := make([]backend, 0, len(specs))
+	for _, spec := range specs {
+		b, err := newBackend(spec)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, b)
+	}
+	return backends, nil
+}
+
+// newChunkStore combines the backends as selected by STORAGE_MODE.
+// Every backend is sealed on its own, so
+// the replicated and erasure coded stores see the plain content.
+func newChunkStore(ctx context.Context, backends []backend) (store.ChunkStore, error) {
+	sealed := make([]store.ChunkStore, len(backends))
+	names := make([]string, len(backends))
+	for i, b := range backends {
+		s, err := sealChunkStore(b.store)
+		if err != nil {
+			return nil, err
+		}
+		sealed[i] = s
+		names[i] = b.name
+	}
+
+	switch mode := os.Getenv("STORAGE_MODE"); mode {
+	case "":
+		if len(sealed) != 1 {
+			return nil, fmt.Errorf("%d storage backends need a STORAGE_MODE", len(sealed))
+		}
+		return sealed[0], nil
+	case "replicated":
+		// a majority by default, so two failed replicas out of five are fine
+		quorum := int(int64FromEnv("WRITE_QUORUM", int64(len(sealed)/2+1)))
+		replicated, err := store.NewReplicatedStore(sealed, names, quorum)
+		if err != nil {
+			return nil, err
+		}
+		replicated.StartReconciler(ctx,
+			durationFromEnv("RECONCILE_INTERVAL", defaultReconcileInterval),
+			durationFromEnv("REPLICA_PROBE_INTERVAL", defaultProbeInterval),
+		)
+		return replicated, nil
+	case "erasure":
+		dataShards := int(int64FromEnv("ERASURE_DATA_SHARDS", int64(len(sealed)-1)))
+		// by default half of the parity shards may fail to be written
+		parityShards := len(sealed) - dataShards
+		quorum := int(int64FromEnv("WRITE_QUORUM", int64(dataShards+(parityShards+1)/2)))
+		erasure, err := store.NewErasureStore(sealed, names, dataShards, quorum)
+		if err != nil {
+			return nil, err
+		}
+		erasure.StartRepairer(ctx, durationFromEnv("RECONCILE_INTERVAL", defaultReconcileInterval))
+		return erasure, nil
+	default:
+		return nil, fmt.Errorf("unknown storage mode %q", mode)
+	}
+}
+
+// newPackedStore packs objects smaller than PACK_THRESHOLD
+// together when it is set, and returns chunkStore otherwise
+func newPackedStore(ctx context.Context, chunkStore store.ChunkStore) (store.ChunkStore, error) {
+	threshold := int64FromEnv("PACK_THRESHOLD", 0)
+	if threshold <= 0 {
+		return chunkStore, nil
+	}
+	minLiveRatio, err := strconv.ParseFloat(os.Getenv("PACK_MIN_LIVE_RATIO"), 64)
+	if err != nil {
+		minLiveRatio = defaultPackMinLiveRatio
+	}
+	packed, err := store.NewPackedStore(chunkStore, threshold, int64FromEnv("PACK_SIZE", defaultPackSize), minLiveRatio)
+	if err != nil {
+		return nil, err
+	}
+	// packs are stored raw and read by range, their objects are compressed one by one
+	if os.Getenv("COMPRESSION") == store.EncodingZstd {
+		if err := packed.CompressPacked(compressionMinRatio()); err != nil {
+			return nil, err
+		}
+	}
+	packed.StartPacker(ctx, durationFromEnv("PACK_INTERVAL", defaultPackInterval))
+	return packed, nil
+}
+
+// newTieredStore moves chunks nobody read for COLD_AFTER to the backend
+// in COLD_BACKEND when it is set, and returns hot otherwise
+func newTieredStore(ctx context.Context, hot store.ChunkStore) (store.ChunkStore, error) {
+	spec := os.Getenv("COLD_BACKEND")
+	if spec == "" {
+		return hot, nil
+	}
+	cold, err := newBackend(spec)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sealChunkStore(cold.store)
+	if err != nil {
+		return nil, err
+	}
+	tiered, err := store.NewTieredStore(hot, sealed,
+		durationFromEnv("COLD_AFTER", defaultColdAfter),
+		os.Getenv("TIER_PROMOTE") != "false",
+	)
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv("METADATA_URL") != "" {
+		tiered.Overrides = fetchTierOverrides
+	}
+	tiered.StartMigrator(ctx, durationFromEnv("TIER_INTERVAL", defaultTierInterval))
+	return tiered, nil
+}
+
+// fetchTierOverrides asks the metadata service for the chunks
+// of the files whose tier was set by hand
+func fetchTierOverrides(ctx context.Context) (map[string]string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv("METADATA_URL")+"/chunks/tiers", nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service answered %s", response.Status)
+	}
+	var overrides types.ChunkTiersResponse
+	if err := json.NewDecoder(response.Body).Decode(&overrides); err != nil {
+		return nil, err
+	}
+	return overrides.Tiers, nil
+}
+
+// sealChunkStore layers the optional encryption and compression
+// configured in the environment on top of a storage driver
+func sealChunkStore(base store.ChunkStore) (store.ChunkStore, error) {
+	var chunkStore store.ChunkStore = base
+	// encryption sits below compression, sealed bytes don't compress
+	encrypted, err := newEncryptedStore(base)
+	if err != nil {
+		return nil, err
+	}
+	if encrypted != nil {
+		chunkStore = encrypted
+	}
+	switch compression := os.Getenv("COMPRESSION"); compression {
+	case "":
+	case store.EncodingZstd:
+		chunkStore, err = store.NewCompressedStore(chunkStore, compressionMinRatio())
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+	return chunkStore, nil
+}
+
+// compressionMinRatio returns COMPRESSION_MIN_RATIO
+func compressionMinRatio() float64 {
+	minRatio, err := strconv.ParseFloat(os.Getenv("COMPRESSION_MIN_RATIO"), 64)
+	if err != nil {
+		return defaultCompressionMinRatio
+	}
+	return minRatio
+}
+
+func int64FromEnv(name string, fallback int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// newCachedStore puts the read cache in front of chunkStore when
+// CACHE_MEMORY_BYTES is set, CACHE_DIR adds a disk level to it
+func newCachedStore(chunkStore store.ChunkStore) (store.ChunkStore, error) {
+	memoryBytes := int64FromEnv("CACHE_MEMORY_BYTES", 0)
+	if memoryBytes <= 0 {
+		return chunkStore, nil
+	}
+	var disk store.ChunkStore
+	if cacheDir := os.Getenv("CACHE_DIR"); cacheDir != "" {
+		local, err := store.NewLocalStore(cacheDir)
+		if err != nil {
+			return nil, err
+		}
+		disk = local
+		encrypted, err := newEncryptedStore(local)
+		if err != nil {
+			return nil, err
+		}
+		if encrypted != nil {
+			disk = encrypted
+		}
+	}
+	return store.NewCachedStore(
+		chunkStore,
+		memoryBytes,
+		int64FromEnv("CACHE_MAX_OBJECT_BYTES", defaultCacheMaxObjectBytes),
+		disk,
+		int64FromEnv("CACHE_DISK_BYTES", defaultCacheDiskBytes),
+	)
+}
+
+// newEncryptedStore wraps base when a master key is configured, either in
+// MASTER_KEYS or in the file named by MASTER_KEY_FILE, and returns nil otherwise
+func newEncryptedStore(base store.ChunkStore) (*store.EncryptedStore, error) {
+	spec := os.Getenv("MASTER_KEYS")
+	if keyFile := os.Getenv("MASTER_KEY_FILE"); keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		spec = string(content)
+	}
+	if spec == "" {
+		return nil, nil
+	}
+	keys, err := store.ParseMasterKeys(spec)
+	if err != nil {
+		return nil, err
+	}
+	return store.NewEncryptedStore(base, keys, os.Getenv("MASTER_KEY_ID"))
+}
+
+// rotateKeys re-wraps every data key on every backend, and on the
+// COLD_BACKEND chunks move to, under the active master key. It runs as
+// 'blobserver rotate-keys' once MASTER_KEY_ID points at a new key.
+func rotateKeys(backends []backend) {
+	if spec := os.Getenv("COLD_BACKEND"); spec != "" {
+		cold, err := newBackend(spec)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		backends = append(backends, cold)
+	}
+	failed := false
+	for _, b := range backends {
+		encrypted, err := newEncryptedStore(b.store)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if encrypted == nil {
+			log.Fatal("no master keys configured")
+		}
+		report, err := encrypted.Rotate(context.Background())
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		slog.Info("master key rotation done", "backend", b.name, "rewrapped", report.Rewrapped, "skipped", report.Skipped, "errors", report.Errors)
+		if report.Errors > 0 {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,121 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+const DefaultAlgorithm = "sha256"
+
+var (
+	ErrInvalidKey = errors.New("invalid chunk hash")
+	ErrMismatch   = errors.New("chunk content doesn't match its hash")
+)
+
+var algorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Key is the content address of a chunk, written as '<algorithm>:<hex>'
+type Key struct {
+	Algorithm string
+	Hex       string
+}
+
+// ParseKey accepts '<algorithm>:<hex>' or a bare hex digest,
+// which is taken to be DefaultAlgorithm
+func ParseKey(s string) (Key, error) {
+	algorithm, hexDigest, found := strings.Cut(s, ":")
+	if !found {
+		algorithm, hexDigest = DefaultAlgorithm, s
+	}
+	newHash, ok := algorithms[algorithm]
+	if !ok {
+		return Key{}, ErrInvalidKey
+	}
+	hexDigest = strings.ToLower(hexDigest)
+	if len(hexDigest) != 2*newHash().Size() {
+		return Key{}, ErrInvalidKey
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return Key{}, ErrInvalidKey
+	}
+	return Key{Algorithm: algorithm, Hex: hexDigest}, nil
+}
+
+func (k Key) String() string {
+	return k.Algorithm + ":" + k.Hex
+}
+
+func (k Key) newHash() hash.Hash {
+	return algorithms[k.Algorithm]()
+}
+
+func (k Key) matches(h hash.Hash) bool {
+	want, _ := hex.DecodeString(k.Hex)
+	return bytes.Equal(h.Sum(nil), want)
+}
+
+// Reader hashes everything read through it and fails with ErrMismatch
+// if the content doesn't match the key. The bytes of the final read are
+// withheld on a mismatch, so whoever consumes the reader never sees a
+// complete body for a bad chunk.
+type Reader struct {
+	r         io.Reader
+	key       Key
+	h         hash.Hash
+	remaining int64
+	err       error
+}
+
+// NewReader wraps r, size is the expected length of r or -1 if unknown
+func NewReader(r io.Reader, key Key, size int64) *Reader {
+	return &Reader{
+		r:         r,
+		key:       key,
+		h:         key.newHash(),
+		remaining: size,
+	}
+}
+
+func (v *Reader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	if v.remaining >= 0 && int64(len(p)) > v.remaining {
+		p = p[:v.remaining]
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if v.remaining >= 0 {
+		v.remaining -= int64(n)
+		if v.remaining == 0 {
+			err = io.EOF
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err == io.EOF && !v.key.matches(v.h) {
+		v.err = ErrMismatch
+		return 0, v.err
+	}
+	if err != nil {
+		v.err = err
+	}
+	return n, err
+}
+
+// Err returns ErrMismatch once a bad chunk has been detected
+func (v *Reader) Err() error {
+	if v.err == io.EOF {
+		return nil
+	}
+	return v.err
+}
@@ -2,7 +2,13 @@ module github.com/melsonic/skyvault/blobserver
 
 go 1.23.9
 
-require github.com/minio/minio-go/v7 v7.0.92
+require (
+	github.com/klauspost/reedsolomon v1.12.4
+	github.com/minio/minio-go/v7 v7.0.92
+	golang.org/x/sync v0.16.0
+)
+
+require github.com/golang-jwt/jwt/v5 v5.2.3 // indirect
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -11,17 +17,20 @@ require (
 	github.com/goccy/go-json v0.10.5 // indirect
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/joho/godotenv v1.5.1
-	github.com/klauspost/compress v1.18.0 // indirect
+	github.com/klauspost/compress v1.18.0
 	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
+	github.com/melsonic/skyvault/auth v0.0.0
 	github.com/minio/crc64nvme v1.0.1 // indirect
 	github.com/minio/md5-simd v1.1.2 // indirect
 	github.com/philhofer/fwd v1.1.3-0.20240916144458-20a13a1f6b7c // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rs/xid v1.6.0 // indirect
 	github.com/tinylib/msgp v1.3.0 // indirect
-	golang.org/x/crypto v0.36.0 // indirect
-	golang.org/x/net v0.38.0 // indirect
-	golang.org/x/sys v0.31.0 // indirect
-	golang.org/x/text v0.23.0 // indirect
+	golang.org/x/crypto v0.40.0 // indirect
+	golang.org/x/net v0.41.0 // indirect
+	golang.org/x/sys v0.34.0 // indirect
+	golang.org/x/text v0.27.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/melsonic/skyvault/auth => ../authcomp
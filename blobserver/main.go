@@ -1,18 +1,107 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/melsonic/skyvault/blobserver/minio"
+	"github.com/joho/godotenv"
+	"github.com/melsonic/skyvault/auth/verify"
+	"github.com/melsonic/skyvault/blobserver/digest"
+	"github.com/melsonic/skyvault/blobserver/scrub"
+	"github.com/melsonic/skyvault/blobserver/store"
 	"github.com/melsonic/skyvault/blobserver/types"
 )
 
+var chunkStore store.ChunkStore
+
+// backingStore is chunkStore without its cache, for the reads
+// that must see the latest metadata of a chunk
+var backingStore store.ChunkStore
+
+const (
+	contentTypeJSON   = "application/json"
+	contentTypeBinary = "application/octet-stream"
+)
+
+// wantsJSON reports whether the client asked for the legacy json encoding
+// where chunk data travels base64 encoded inside types.BlobData
+func wantsJSON(header string) bool {
+	for _, mediaType := range strings.Split(header, ",") {
+		mediaType, _, _ = strings.Cut(mediaType, ";")
+		if strings.TrimSpace(mediaType) == contentTypeJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// chunkKey parses the {hash} path value, answering 400 when it is malformed
+func chunkKey(w http.ResponseWriter, r *http.Request) (digest.Key, bool) {
+	key, err := digest.ParseKey(r.PathValue("hash"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return digest.Key{}, false
+	}
+	return key, true
+}
+
+// writeUploadError answers 422 for chunks whose content doesn't match the hash
+func writeUploadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, digest.ErrMismatch) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	} else {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write([]byte(err.Error()))
+}
+
 func chunkSaveHandler(w http.ResponseWriter, r *http.Request) {
-	hash := r.PathValue("hash")
+	key, ok := chunkKey(w, r)
+	if !ok {
+		return
+	}
+	if wantsJSON(r.Header.Get("Content-Type")) {
+		chunkSaveJSONHandler(w, r)
+		return
+	}
+	if r.ContentLength == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("missing input data!"))
+		return
+	}
+	err := store.UploadChunk(r.Context(), chunkStore, key, r.Body, r.ContentLength)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if !uploadRecorded(w, r, key) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Blob chunk uploaded succesfully!"))
+}
+
+func chunkSaveJSONHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := chunkKey(w, r)
+	if !ok {
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -26,16 +115,18 @@ func chunkSaveHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Invalid request body format"))
 		return
 	}
-	data.Hash = hash
-	if data.Hash == "" || len(data.Data) == 0 {
+	data.Hash = key.String()
+	if len(data.Data) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte("missing input data!"))
 		return
 	}
-	err = minio.UploadChunk(data.Hash, data.Data)
+	err = store.UploadChunk(r.Context(), chunkStore, key, bytes.NewReader(data.Data), int64(len(data.Data)))
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		writeUploadError(w, err)
+		return
+	}
+	if !uploadRecorded(w, r, key) {
 		return
 	}
 
@@ -44,13 +135,64 @@ func chunkSaveHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func chunkGetHandler(w http.ResponseWriter, r *http.Request) {
-	hash := r.PathValue("hash")
-	content, err := minio.GetChunk(hash)
+	key, ok := chunkKey(w, r)
+	if !ok {
+		return
+	}
+	jsonMode := wantsJSON(r.Header.Get("Accept"))
+	if !jsonMode && r.Header.Get("Range") != "" && ifRangeMatches(r, chunkETag(key)) {
+		if chunkGetRangeHandler(w, r, key) {
+			return
+		}
+	}
+	object, info, err := store.GetChunk(r.Context(), chunkStore, key)
+	if errors.Is(err, store.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, store.ErrQuarantined) {
+		w.WriteHeader(http.StatusGone)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
+		slog.Error(err.Error())
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error fetching object"))
+		return
+	}
+	defer object.Close()
+
+	if jsonMode {
+		chunkGetJSONHandler(w, object)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeBinary)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("ETag", chunkETag(key))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+	_, err = io.Copy(w, object)
+	if err != nil {
+		// headers are already sent, the client sees a short body
+		slog.Error("error streaming chunk", "hash", info.Key, "error", err.Error())
+	}
+}
+
+func chunkGetJSONHandler(w http.ResponseWriter, object io.Reader) {
+	content, err := io.ReadAll(object)
+	if errors.Is(err, digest.ErrMismatch) {
+		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error reading object data"))
+		return
+	}
 	blob := types.BlobDataResponse{
 		Data:    content,
 		Message: "Blob chunk fetched succesfully!",
@@ -64,17 +206,29 @@ func chunkGetHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// write json data to writer
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentTypeJSON)
 	w.WriteHeader(http.StatusOK)
 	w.Write(response)
 }
 
 func chunkDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	hash := r.PathValue("hash")
-	err := minio.DeleteChunk(hash)
+	key, ok := chunkKey(w, r)
+	if !ok {
+		return
+	}
+	// a client skipped uploading it and is about to reference it,
+	// the cache may not have seen the reservation yet
+	info, err := backingStore.Stat(r.Context(), key.String())
+	if err == nil && store.IsReserved(info, durationFromEnv("CHUNK_RESERVATION", defaultChunkReservation)) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("chunk is reserved by a pending upload"))
+		return
+	}
+	err = chunkStore.Delete(r.Context(), key.String())
 	if err != nil {
+		slog.Error(err.Error())
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write([]byte("failed to delete object"))
 		return
 	}
 
@@ -82,18 +236,188 @@ func chunkDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Blob chunk deleted succesfully!"))
 }
 
+// maxMissingChunksBatch bounds the number of hashes accepted by POST /chunks/missing
+const maxMissingChunksBatch = 10000
+
+// chunksMissingHandler tells a client which of the chunks it is about to
+// upload the store doesn't have, so only new data has to be sent
+func chunksMissingHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+	var request types.MissingChunksRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body format"))
+		return
+	}
+	if len(request.Hashes) > maxMissingChunksBatch {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte(fmt.Sprintf("at most %d hashes per request", maxMissingChunksBatch)))
+		return
+	}
+	keys := make([]digest.Key, len(request.Hashes))
+	for i := range request.Hashes {
+		keys[i], err = digest.ParseKey(request.Hashes[i])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("%s: %s", err.Error(), request.Hashes[i])))
+			return
+		}
+	}
+
+	// a chunk a user can't read is missing to them, otherwise anyone could
+	// probe which content is stored and then reference it without uploading.
+	// Only the chunks they can read are looked up, so only those get reserved.
+	checked := keys
+	if user := verify.UserFromContext(r.Context()); user != nil {
+		var ok bool
+		checked, ok = userReadableChunks(w, r, keys)
+		if !ok {
+			return
+		}
+	}
+	absent := make(map[digest.Key]bool, len(keys))
+	for _, key := range keys {
+		absent[key] = true
+	}
+	for _, key := range checked {
+		absent[key] = false
+	}
+	for _, key := range store.MissingChunks(r.Context(), chunkStore, checked) {
+		absent[key] = true
+	}
+	result := types.MissingChunksResponse{Missing: []string{}}
+	for _, key := range keys {
+		if absent[key] {
+			result.Missing = append(result.Missing, key.String())
+		}
+	}
+	response, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("marshal error"))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// chunksListHandler streams every stored chunk as newline delimited json,
+// the metadata service walks it to garbage collect unreferenced chunks
+func chunksListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	err := chunkStore.List(r.Context(), func(object store.ObjectInfo) error {
+		return encoder.Encode(types.ChunkInfo{
+			Hash:         object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+		})
+	})
+	if err != nil {
+		// headers are already sent, abort so the client doesn't take a
+		// truncated listing for a complete one
+		slog.Error("error listing chunks", "error", err.Error())
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// scrubReportHandler returns the report of the last scrub pass, it names
+// the files of every user and is internal only
+func scrubReportHandler(w http.ResponseWriter, r *http.Request) {
+	report := scrub.LastReport()
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no scrub pass finished yet"))
+		return
+	}
+	response, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
 func main() {
-	minio.InitMinio()
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file")
+	}
+
+	// user reads are checked against metadata, there would be nobody to ask
+	if os.Getenv("SECRET_SIGNATURE") != "" && os.Getenv("METADATA_URL") == "" {
+		log.Fatal("METADATA_URL is needed to check the chunk reads of users")
+	}
+
+	backends, err := newBackends()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		rotateKeys(backends)
+		return
+	}
+
+	ctx, _ := signal.NotifyContext(context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	backing, err := newChunkStore(ctx, backends)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	backing, err = newPackedStore(ctx, backing)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	backing, err = newTieredStore(ctx, backing)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	backingStore = backing
+	chunkStore, err = newCachedStore(backing)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	// the scrubber has to see what is stored, not what is cached,
+	// but the cache has to learn about what it quarantines
+	scrub.Start(ctx, backing, chunkStore)
+	slog.Info("chunk store ready", "backends", len(backends), "mode", os.Getenv("STORAGE_MODE"))
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("GET /chunk/{hash}", chunkGetHandler)
+	mux.HandleFunc("GET /chunk/{hash}", readableChunk(chunkGetHandler))
+	mux.HandleFunc("HEAD /chunk/{hash}", readableChunk(chunkHeadHandler))
 	mux.HandleFunc("POST /chunk/{hash}", chunkSaveHandler)
-	mux.HandleFunc("DELETE /chunk/{hash}", chunkDeleteHandler)
+	mux.HandleFunc("DELETE /chunk/{hash}", verify.InternalOnly(chunkDeleteHandler))
+	mux.HandleFunc("GET /chunks", verify.InternalOnly(chunksListHandler))
+	mux.HandleFunc("POST /chunks/missing", chunksMissingHandler)
+	mux.HandleFunc("GET /scrub", verify.InternalOnly(scrubReportHandler))
+	mux.HandleFunc("GET /debug/vars", verify.InternalOnly(expvar.Handler().ServeHTTP))
 	server := &http.Server{
 		Addr:           ":8002",
-		Handler:        mux,
+		Handler:        verify.Middleware(mux),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
-	log.Fatal(server.ListenAndServe())
+	// the signals stop the background jobs, the server has to follow
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
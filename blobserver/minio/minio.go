@@ -1,128 +1,192 @@
 package minio
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"io"
-	"log"
 	"log/slog"
 	"os"
+	"strings"
 
-	"github.com/joho/godotenv"
+	"github.com/melsonic/skyvault/blobserver/store"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
-var (
-	MinioClient *minio.Client
-	endpoint    string
-	accessKey   string
-	secretKey   string
-	bucketName  string
-	location    string
-)
-
-func InitMinio() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
+// Store is the store.ChunkStore driver backed by a MinIO bucket
+type Store struct {
+	client     *minio.Client
+	bucketName string
+}
 
-	endpoint = os.Getenv("MINIO_ENDPOINT")
-	accessKey = os.Getenv("ACCESSKEY")
-	secretKey = os.Getenv("SECRETKEY")
-	bucketName = os.Getenv("BUCKETNAME")
-	location = os.Getenv("LOCATION")
+// NewStore connects to the MinIO instance configured in the environment
+// and creates bucketName if it doesn't exist yet
+func NewStore(bucketName string) (*Store, error) {
+	endpoint := os.Getenv("MINIO_ENDPOINT")
+	accessKey := os.Getenv("ACCESSKEY")
+	secretKey := os.Getenv("SECRETKEY")
+	location := os.Getenv("LOCATION")
 
 	if bucketName == "" {
 		slog.Error("bucket name is not specified")
-		log.Fatal("Please specify a bucket name in .env file")
+		return nil, errors.New("please specify a bucket name in .env file")
 	}
 
 	client, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
-		Secure: false,
+		Secure: os.Getenv("MINIO_SECURE") == "true",
 	})
 	if err != nil {
 		slog.Error(err.Error())
-		log.Fatal(err.Error())
+		return nil, err
 	}
 
 	slog.Info("Minio connected!")
-	MinioClient = client
+	s := &Store{client: client, bucketName: bucketName}
 
-	exists, errBucketExists := MinioClient.BucketExists(context.Background(), bucketName)
+	exists, errBucketExists := client.BucketExists(context.Background(), bucketName)
 
 	if exists {
 		slog.Info("bucket already exists", "name", bucketName)
-		return
+		return s, nil
 	} else if errBucketExists != nil {
 		slog.Error("error checking bucket exists", "error", errBucketExists)
 	}
 
-	err = MinioClient.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{
+	err = client.MakeBucket(context.Background(), bucketName, minio.MakeBucketOptions{
 		Region: location,
 	})
 
 	if err != nil {
 		slog.Error("error creating bucket", "error", err)
-		return
+		return s, nil
 	}
 
 	slog.Info("bucket created successfully", "bucket", bucketName)
+	return s, nil
 }
 
-func isObjectExists(hash string) bool {
-	_, err := MinioClient.StatObject(context.Background(), bucketName, hash, minio.StatObjectOptions{})
-	if err != nil {
-		slog.Debug("Object doesn't exist", "ObjectName", hash)
-		return false
-	}
-	slog.Debug("Object already exist", "ObjectName", hash)
-	return true
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchObject"
 }
 
-func UploadChunk(hash string, data []byte) error {
-	if isObjectExists(hash) {
-		return nil
-	}
+func (s *Store) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
 	contentType := "application/octet-stream"
 	// saving the chunk with name as 'hash'
-	_, err := MinioClient.PutObject(context.Background(), bucketName, hash, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
-		ContentType: contentType,
+	_, err := s.client.PutObject(ctx, s.bucketName, key, data, size, minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: metadata,
 	})
+	return err
+}
+
+func (s *Store) Get(ctx context.Context, key string) (io.ReadCloser, *store.ObjectInfo, error) {
+	return s.get(ctx, key, minio.GetObjectOptions{})
+}
+
+// GetRange stats the object on its own, a Stat on a ranged minio.Object
+// would drop the range from the request
+func (s *Store) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *store.ObjectInfo, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length == 0 {
+		// an empty range can't be expressed as a Range header
+		return io.NopCloser(strings.NewReader("")), info, nil
+	}
+	opts := minio.GetObjectOptions{}
+	if length < 0 && offset > 0 {
+		err = opts.SetRange(offset, 0)
+	} else if length > 0 {
+		err = opts.SetRange(offset, offset+length-1)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	object, err := s.client.GetObject(ctx, s.bucketName, key, opts)
 	if err != nil {
 		slog.Error(err.Error())
-		return errors.New("error uploading object")
+		return nil, nil, errors.New("error fetching object")
 	}
-	return nil
+	return object, info, nil
 }
 
-func GetChunk(hash string) ([]byte, error) {
-	if isObjectExists(hash) {
-		return nil, errors.New("object doesn't exist")
-	}
-	object, err := MinioClient.GetObject(context.Background(), bucketName, hash, minio.GetObjectOptions{})
+func (s *Store) get(ctx context.Context, key string, opts minio.GetObjectOptions) (io.ReadCloser, *store.ObjectInfo, error) {
+	object, err := s.client.GetObject(ctx, s.bucketName, key, opts)
 	if err != nil {
 		slog.Error(err.Error())
-		return nil, errors.New("error fetching object")
+		return nil, nil, errors.New("error fetching object")
 	}
-	stat, _ := object.Stat()
-	result := make([]byte, stat.Size)
-	_, err = object.Read(result)
-	if err != nil && err != io.EOF {
-		slog.Error(err.Error())
-		return nil, errors.New("error reading object data")
+	stat, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if isNotFound(err) {
+			return nil, nil, store.ErrNotFound
+		}
+		return nil, nil, err
 	}
-	return result, nil
+	return object, objectInfo(stat), nil
 }
 
-func DeleteChunk(hash string) error {
-	err := MinioClient.RemoveObject(context.Background(), bucketName, hash, minio.RemoveObjectOptions{})
+func (s *Store) Stat(ctx context.Context, key string) (*store.ObjectInfo, error) {
+	stat, err := s.client.StatObject(ctx, s.bucketName, key, minio.StatObjectOptions{})
 	if err != nil {
-		slog.Error(err.Error())
-		return errors.New("failed to delete object")
+		if isNotFound(err) {
+			return nil, store.ErrNotFound
+		}
+		return nil, err
+	}
+	return objectInfo(stat), nil
+}
+
+// UpdateMetadata copies the object onto itself, the copy happens
+// inside MinIO so the content never travels through blobserver
+func (s *Store) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	_, err := s.client.CopyObject(ctx, minio.CopyDestOptions{
+		Bucket:          s.bucketName,
+		Object:          key,
+		ReplaceMetadata: true,
+		UserMetadata:    metadata,
+	}, minio.CopySrcOptions{
+		Bucket: s.bucketName,
+		Object: key,
+	})
+	if isNotFound(err) {
+		return store.ErrNotFound
+	}
+	return err
+}
+
+func (s *Store) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucketName, key, minio.RemoveObjectOptions{})
+}
+
+func (s *Store) List(ctx context.Context, fn func(store.ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range s.client.ListObjects(ctx, s.bucketName, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if err := fn(*objectInfo(object)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+func objectInfo(stat minio.ObjectInfo) *store.ObjectInfo {
+	// user metadata comes back with canonical header casing
+	metadata := make(map[string]string, len(stat.UserMetadata))
+	for key, value := range stat.UserMetadata {
+		metadata[strings.ToLower(key)] = value
+	}
+	return &store.ObjectInfo{
+		Key:          stat.Key,
+		Size:         stat.Size,
+		LastModified: stat.LastModified,
+		Metadata:     metadata,
+	}
+}
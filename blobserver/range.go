@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+	"github.com/melsonic/skyvault/blobserver/store"
+)
+
+var errUnsatisfiableRange = errors.New("requested range not satisfiable")
+
+// byteRange is a single 'bytes=' range resolved against the object size
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// parseRange understands a single 'bytes=start-end', 'bytes=start-' or
+// 'bytes=-suffix' range. ok is false for headers that should be ignored,
+// like multiple ranges, in which case the whole object is served.
+func parseRange(header string, size int64) (byteRange, bool, error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+	startString, endString, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return byteRange{}, false, nil
+	}
+
+	if startString == "" {
+		suffix, err := strconv.ParseInt(endString, 10, 64)
+		if err != nil {
+			return byteRange{}, false, nil
+		}
+		if suffix <= 0 || size == 0 {
+			return byteRange{}, true, errUnsatisfiableRange
+		}
+		suffix = min(suffix, size)
+		return byteRange{offset: size - suffix, length: suffix}, true, nil
+	}
+
+	start, err := strconv.ParseInt(startString, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+	if start >= size {
+		return byteRange{}, true, errUnsatisfiableRange
+	}
+	end := size - 1
+	if endString != "" {
+		end, err = strconv.ParseInt(endString, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false, nil
+		}
+		end = min(end, size-1)
+	}
+	return byteRange{offset: start, length: end - start + 1}, true, nil
+}
+
+// ifRangeMatches reports whether a Range request may be answered partially,
+// chunks never change so only an ETag that doesn't match forces a full answer
+func ifRangeMatches(r *http.Request, etag string) bool {
+	ifRange := r.Header.Get("If-Range")
+	return ifRange == "" || ifRange == etag
+}
+
+func chunkETag(key digest.Key) string {
+	return strconv.Quote(key.String())
+}
+
+// chunkHeadHandler answers with the size and ETag of a chunk without its data
+func chunkHeadHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := chunkKey(w, r)
+	if !ok {
+		return
+	}
+	info, err := chunkStore.Stat(r.Context(), key.String())
+	if errors.Is(err, store.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if store.IsQuarantined(info) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeBinary)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("ETag", chunkETag(key))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+// chunkGetRangeHandler serves a 206 for the Range header of r. Partial
+// reads can't be checked against the chunk hash, only full reads are.
+// It returns false when the range should be ignored.
+func chunkGetRangeHandler(w http.ResponseWriter, r *http.Request, key digest.Key) bool {
+	info, err := chunkStore.Stat(r.Context(), key.String())
+	if err != nil || store.IsQuarantined(info) {
+		// let the full read report the error
+		return false
+	}
+	requested, ok, err := parseRange(r.Header.Get("Range"), info.Size)
+	if !ok {
+		return false
+	}
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		w.Write([]byte(err.Error()))
+		return true
+	}
+
+	object, _, err := chunkStore.GetRange(r.Context(), key.String(), requested.offset, requested.length)
+	if err != nil {
+		slog.Error(err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error fetching object"))
+		return true
+	}
+	defer object.Close()
+
+	w.Header().Set("Content-Type", contentTypeBinary)
+	w.Header().Set("Content-Length", strconv.FormatInt(requested.length, 10))
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", requested.offset, requested.offset+requested.length-1, info.Size))
+	w.Header().Set("ETag", chunkETag(key))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusPartialContent)
+	_, err = io.Copy(w, object)
+	if err != nil {
+		slog.Error("error streaming chunk range", "hash", key.String(), "error", err.Error())
+	}
+	return true
+}
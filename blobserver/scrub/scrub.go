@@ -0,0 +1,273 @@
+package scrub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+	"github.com/melsonic/skyvault/blobserver/store"
+)
+
+const (
+	defaultInterval = 24 * time.Hour
+	// defaultRate keeps a pass from starving the uploads and downloads
+	defaultRate = 8 << 20
+)
+
+// Report summarises one scrub pass
+type Report struct {
+	StartedAt    time.Time      `json:"started_at"`
+	DurationMs   int64          `json:"duration_ms"`
+	ChunksRead   int            `json:"chunks_read"`
+	BytesRead    int64          `json:"bytes_read"`
+	Corrupt      []CorruptChunk `json:"corrupt"`
+	Errors       int            `json:"errors"`
+	FinishedPass bool           `json:"finished_pass"`
+}
+
+// CorruptChunk is a chunk whose content doesn't match its hash anymore
+type CorruptChunk struct {
+	Hash          string          `json:"hash"`
+	Size          int64           `json:"size"`
+	Problem       string          `json:"problem"`
+	QuarantinedAt string          `json:"quarantined_at"`
+	Files         []FileReference `json:"files"`
+}
+
+// FileReference is a file of the metadata service using a corrupt chunk
+type FileReference struct {
+	Hash     string `json:"hash"`
+	NodeID   string `json:"nodeid"`
+	FileName string `json:"filename"`
+}
+
+var (
+	mu         sync.Mutex
+	lastReport *Report
+)
+
+// LastReport returns the report of the last scrub pass, nil before the first one ended
+func LastReport() *Report {
+	mu.Lock()
+	defer mu.Unlock()
+	return lastReport
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+func rateFromEnv() int64 {
+	value, err := strconv.ParseInt(os.Getenv("SCRUB_RATE"), 10, 64)
+	if err != nil {
+		return defaultRate
+	}
+	return value
+}
+
+// Run reads every chunk of s back at SCRUB_RATE bytes per second and
+// checks it against its hash. Mismatching, truncated and undecodable
+// chunks are quarantined through cached, the store clients read with,
+// so its caches forget them. The metadata service is asked which files
+// use them.
+func Run(ctx context.Context, s store.ChunkStore, cached store.ChunkStore) (*Report, error) {
+	report := &Report{StartedAt: time.Now()}
+	rate := rateFromEnv()
+	// reading everything back doesn't make it hot
+	ctx = store.Untracked(ctx)
+
+	err := s.List(ctx, func(object store.ObjectInfo) error {
+		key, err := digest.ParseKey(object.Key)
+		if err != nil {
+			// not a chunk, nothing to check it against
+			return nil
+		}
+		corrupt, err := check(ctx, s, cached, key, object.Size)
+		if err != nil {
+			slog.Error("error scrubbing chunk", "hash", object.Key, "error", err.Error())
+			report.Errors++
+		}
+		if corrupt != nil {
+			report.Corrupt = append(report.Corrupt, *corrupt)
+		}
+		report.ChunksRead++
+		report.BytesRead += object.Size
+		return throttle(ctx, report.StartedAt, report.BytesRead, rate)
+	})
+	report.FinishedPass = err == nil
+	if err != nil && !errors.Is(err, context.Canceled) {
+		slog.Error("error listing chunks", "error", err.Error())
+		report.Errors++
+	}
+
+	if len(report.Corrupt) > 0 {
+		if err := addFileReferences(ctx, report.Corrupt); err != nil {
+			slog.Error("error looking up files of corrupt chunks", "error", err.Error())
+			report.Errors++
+		}
+	}
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+
+	mu.Lock()
+	lastReport = report
+	mu.Unlock()
+	return report, err
+}
+
+// corrupted tells whether reading a chunk failed because of its content
+// rather than because the store couldn't be read
+func corrupted(err error) bool {
+	return errors.Is(err, digest.ErrMismatch) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, store.ErrDecrypt) ||
+		errors.Is(err, store.ErrDecompress)
+}
+
+// check re-hashes a single chunk of size bytes, quarantining it when it is
+// corrupted. Chunks quarantined by an earlier pass are reported again
+// without being read.
+func check(ctx context.Context, s store.ChunkStore, cached store.ChunkStore, key digest.Key, size int64) (*CorruptChunk, error) {
+	object, info, err := s.Get(ctx, key.String())
+	if errors.Is(err, store.ErrNotFound) {
+		// deleted since it was listed
+		return nil, nil
+	}
+	if corrupted(err) {
+		return quarantine(ctx, cached, key, size, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	if store.IsQuarantined(info) {
+		return &CorruptChunk{
+			Hash:          key.String(),
+			Size:          info.Size,
+			Problem:       "quarantined earlier",
+			QuarantinedAt: info.Metadata[store.MetaQuarantined],
+		}, nil
+	}
+
+	_, err = io.Copy(io.Discard, digest.NewReader(object, key, info.Size))
+	if err == nil || !corrupted(err) {
+		return nil, err
+	}
+	return quarantine(ctx, cached, key, info.Size, err)
+}
+
+// quarantine flags a chunk found corrupted by problem
+func quarantine(ctx context.Context, s store.ChunkStore, key digest.Key, size int64, problem error) (*CorruptChunk, error) {
+	slog.Error("corrupted chunk found", "hash", key.String(), "error", problem.Error())
+	corrupt := &CorruptChunk{Hash: key.String(), Size: size, Problem: problem.Error()}
+	if err := store.QuarantineChunk(ctx, s, key); err != nil {
+		return corrupt, fmt.Errorf("quarantining chunk: %w", err)
+	}
+	corrupt.QuarantinedAt = time.Now().UTC().Format(time.RFC3339)
+	return corrupt, nil
+}
+
+// throttle sleeps long enough for a pass that started at started and
+// read scanned bytes so far to average rate bytes per second
+func throttle(ctx context.Context, started time.Time, scanned int64, rate int64) error {
+	if rate <= 0 {
+		return ctx.Err()
+	}
+	wait := time.Duration(float64(scanned)/float64(rate)*float64(time.Second)) - time.Since(started)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// addFileReferences asks the metadata service at METADATA_URL
+// which files are built from the corrupt chunks
+func addFileReferences(ctx context.Context, corrupt []CorruptChunk) error {
+	metadataURL := os.Getenv("METADATA_URL")
+	if metadataURL == "" {
+		return nil
+	}
+	hashes := make([]string, len(corrupt))
+	for i := range corrupt {
+		hashes[i] = corrupt[i].Hash
+	}
+	body, err := json.Marshal(map[string][]string{"hashes": hashes})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, metadataURL+"/chunks/files", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata service answered %s", response.Status)
+	}
+	var files struct {
+		Files []FileReference `json:"files"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&files); err != nil {
+		return err
+	}
+	for _, file := range files.Files {
+		for i := range corrupt {
+			if corrupt[i].Hash == file.Hash {
+				corrupt[i].Files = append(corrupt[i].Files, file)
+			}
+		}
+	}
+	return nil
+}
+
+// Start scrubs s every SCRUB_INTERVAL, see Run
+func Start(ctx context.Context, s store.ChunkStore, cached store.ChunkStore) {
+	ticker := time.NewTicker(durationFromEnv("SCRUB_INTERVAL", defaultInterval))
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				report, err := Run(ctx, s, cached)
+				if err != nil {
+					slog.Error("error scrubbing chunks", "error", err.Error())
+					continue
+				}
+				slog.Info("chunk scrub done",
+					"read", report.ChunksRead,
+					"bytes", report.BytesRead,
+					"corrupt", len(report.Corrupt),
+					"errors", report.Errors,
+				)
+
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,109 @@
+package scrub
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+	"github.com/melsonic/skyvault/blobserver/store"
+)
+
+func testKey(t *testing.T, content string) digest.Key {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	key, err := digest.ParseKey(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// flipByte damages the stored object of key in place
+func flipByte(t *testing.T, s store.ChunkStore, key string, offset int) {
+	t.Helper()
+	ctx := context.Background()
+	object, info, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(object)
+	object.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content[offset] ^= 1
+	if err := s.Put(ctx, key, bytes.NewReader(content), int64(len(content)), info.Metadata); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunQuarantinesUndecodableChunks(t *testing.T) {
+	t.Setenv("SCRUB_RATE", "0")
+	t.Setenv("METADATA_URL", "")
+	keys, err := store.ParseMasterKeys("k:" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		wrap func(store.ChunkStore) (store.ChunkStore, error)
+	}{
+		{"encrypted", func(base store.ChunkStore) (store.ChunkStore, error) {
+			return store.NewEncryptedStore(base, keys, "k")
+		}},
+		{"compressed", func(base store.ChunkStore) (store.ChunkStore, error) {
+			return store.NewCompressedStore(base, 1)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			base := store.NewMemoryStore()
+			s, err := test.wrap(base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cached, err := store.NewCachedStore(s, 1<<20, 1<<20, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content := strings.Repeat("scrub me ", 1000)
+			damaged, healthy := testKey(t, content), testKey(t, "healthy")
+			if err := store.UploadChunk(ctx, cached, damaged, strings.NewReader(content), int64(len(content))); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.UploadChunk(ctx, cached, healthy, strings.NewReader("healthy"), 7); err != nil {
+				t.Fatal(err)
+			}
+			// read once so the cache holds it
+			object, _, err := cached.Get(ctx, damaged.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			object.Close()
+			flipByte(t, base, damaged.String(), 20)
+
+			report, err := Run(ctx, s, cached)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.ChunksRead != 2 || report.Errors != 0 || len(report.Corrupt) != 1 || report.Corrupt[0].Hash != damaged.String() {
+				t.Fatalf("report = %+v, want the damaged chunk corrupt", report)
+			}
+			info, err := cached.Stat(ctx, damaged.String())
+			if err != nil || !store.IsQuarantined(info) {
+				t.Errorf("Stat through the cache = %v, %v, want it quarantined", info, err)
+			}
+			missing := store.MissingChunks(ctx, cached, []digest.Key{damaged, healthy})
+			if len(missing) != 1 || missing[0] != damaged {
+				t.Errorf("MissingChunks = %v, want the quarantined chunk", missing)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package store
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheStats is published on /debug/vars for monitoring
+var cacheStats = expvar.NewMap("chunk_cache")
+
+// uncached is an object too large for the cache, read once for everyone
+// waiting on it. Its open reader goes to the first caller claiming it,
+// the others read the object again.
+type uncached struct {
+	object  io.ReadCloser
+	info    *ObjectInfo
+	claimed atomic.Bool
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+	data []byte
+	info ObjectInfo
+}
+
+// lru is a size bounded least recently used index,
+// onEvict is called without the lock held
+type lru struct {
+	mu       sync.Mutex
+	capacity int64
+	used     int64
+	order    *list.List
+	entries  map[string]*list.Element
+	onEvict  func(key string)
+}
+
+func newLRU(capacity int64, onEvict func(key string)) *lru {
+	return &lru{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		onEvict:  onEvict,
+	}
+}
+
+func (l *lru) get(key string) (*lruEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.entries[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruEntry), true
+}
+
+func (l *lru) add(entry *lruEntry) {
+	if entry.size > l.capacity {
+		return
+	}
+	l.mu.Lock()
+	if element, ok := l.entries[entry.key]; ok {
+		l.used -= element.Value.(*lruEntry).size
+		l.order.Remove(element)
+	}
+	l.entries[entry.key] = l.order.PushFront(entry)
+	l.used += entry.size
+	var evicted []string
+	for l.used > l.capacity {
+		oldest := l.order.Back()
+		victim := oldest.Value.(*lruEntry)
+		l.order.Remove(oldest)
+		delete(l.entries, victim.key)
+		l.used -= victim.size
+		evicted = append(evicted, victim.key)
+	}
+	l.mu.Unlock()
+
+	for _, key := range evicted {
+		cacheStats.Add("evictions", 1)
+		if l.onEvict != nil {
+			l.onEvict(key)
+		}
+	}
+}
+
+func (l *lru) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.entries[key]; ok {
+		l.used -= element.Value.(*lruEntry).size
+		l.order.Remove(element)
+		delete(l.entries, key)
+	}
+}
+
+func (l *lru) bytesUsed() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used
+}
+
+// CachedStore keeps recently read objects in memory, and optionally in a
+// local directory, in front of the wrapped store. Chunks never change
+// once written, so entries only have to be dropped on Delete, and on
+// UpdateMetadata for their metadata. Concurrent misses for the same key
+// share a single read of the wrapped store.
+type CachedStore struct {
+	ChunkStore
+	memory        *lru
+	disk          ChunkStore
+	diskIndex     *lru
+	maxObjectSize int64
+	group         singleflight.Group
+}
+
+// NewCachedStore wraps base with a memory cache of memoryBytes. disk adds
+// a second cache level of diskBytes and may be nil, it sees decrypted
+// content so it should be encrypted itself when base is.
+// Objects larger than maxObjectSize are never cached.
+func NewCachedStore(base ChunkStore, memoryBytes int64, maxObjectSize int64, disk ChunkStore, diskBytes int64) (*CachedStore, error) {
+	c := &CachedStore{
+		ChunkStore:    base,
+		memory:        newLRU(memoryBytes, nil),
+		maxObjectSize: maxObjectSize,
+	}
+	if disk == nil {
+		return c, nil
+	}
+	c.disk = disk
+	c.diskIndex = newLRU(diskBytes, func(key string) {
+		if err := disk.Delete(context.Background(), key); err != nil {
+			slog.Error("error evicting cached object", "key", key, "error", err.Error())
+		}
+	})
+	// pick up what a previous run left in the cache directory
+	err := disk.List(context.Background(), func(object ObjectInfo) error {
+		c.diskIndex.add(&lruEntry{key: object.Key, size: object.Size})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.publishSizes()
+	return c, nil
+}
+
+func (c *CachedStore) publishSizes() {
+	memoryBytes := new(expvar.Int)
+	memoryBytes.Set(c.memory.bytesUsed())
+	cacheStats.Set("memory_bytes", memoryBytes)
+	if c.diskIndex != nil {
+		diskBytes := new(expvar.Int)
+		diskBytes.Set(c.diskIndex.bytesUsed())
+		cacheStats.Set("disk_bytes", diskBytes)
+	}
+}
+
+// touch tells the wrapped store about a read it didn't see
+func (c *CachedStore) touch(ctx context.Context, key string) {
+	if tracker, ok := c.ChunkStore.(accessTracker); ok && !isUntracked(ctx) {
+		tracker.Touch(key)
+	}
+}
+
+func (c *CachedStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	if entry, ok := c.memory.get(key); ok {
+		cacheStats.Add("hits", 1)
+		c.touch(ctx, key)
+		info := entry.info
+		return io.NopCloser(bytes.NewReader(entry.data)), &info, nil
+	}
+	cacheStats.Add("misses", 1)
+
+	// the read is shared by everyone waiting, so it can't
+	// be cancelled when the first caller goes away
+	value, err, _ := c.group.Do(key, func() (any, error) {
+		return c.fill(context.WithoutCancel(ctx), key)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if large, ok := value.(*uncached); ok {
+		if large.claimed.CompareAndSwap(false, true) {
+			return large.object, large.info, nil
+		}
+		return c.ChunkStore.Get(ctx, key)
+	}
+	entry := value.(*lruEntry)
+	c.touch(ctx, key)
+	info := entry.info
+	return io.NopCloser(bytes.NewReader(entry.data)), &info, nil
+}
+
+// fill loads key from the disk cache or the wrapped store into memory,
+// it returns an *lruEntry or, for objects too large to cache, *uncached
+func (c *CachedStore) fill(ctx context.Context, key string) (any, error) {
+	if c.disk != nil {
+		if _, ok := c.diskIndex.get(key); ok {
+			entry, large, err := c.read(ctx, c.disk, key)
+			if large != nil {
+				large.object.Close()
+			}
+			if err == nil && entry != nil && matchesKey(entry) {
+				cacheStats.Add("disk_hits", 1)
+				c.memory.add(entry)
+				c.publishSizes()
+				return entry, nil
+			}
+			c.dropFromDisk(ctx, key)
+		}
+	}
+
+	entry, large, err := c.read(ctx, c.ChunkStore, key)
+	if err != nil {
+		return nil, err
+	}
+	if large != nil {
+		return large, nil
+	}
+	// only content matching its hash is worth keeping around
+	if !matchesKey(entry) {
+		return entry, nil
+	}
+	c.memory.add(entry)
+	if c.disk != nil {
+		// the metadata goes along, reservations are read from it
+		err = c.disk.Put(ctx, key, bytes.NewReader(entry.data), entry.size, portableMetadata(entry.info.Metadata))
+		if err != nil {
+			slog.Error("error writing cached object", "key", key, "error", err.Error())
+		} else {
+			c.diskIndex.add(&lruEntry{key: key, size: entry.size})
+		}
+	}
+	c.publishSizes()
+	return entry, nil
+}
+
+// matchesKey checks the content of entry against the hash its key names,
+// keys that aren't chunk hashes can't be checked
+func matchesKey(entry *lruEntry) bool {
+	parsed, err := digest.ParseKey(entry.key)
+	if err != nil {
+		return true
+	}
+	_, err = io.Copy(io.Discard, digest.NewReader(bytes.NewReader(entry.data), parsed, entry.size))
+	return err == nil
+}
+
+// dropFromDisk removes key from the disk cache
+func (c *CachedStore) dropFromDisk(ctx context.Context, key string) {
+	c.diskIndex.remove(key)
+	if err := c.disk.Delete(ctx, key); err != nil && !errors.Is(err, ErrNotFound) {
+		slog.Error("error deleting cached object", "key", key, "error", err.Error())
+	}
+}
+
+// read loads key from s, objects too large to cache are returned open
+// rather than read a second time
+func (c *CachedStore) read(ctx context.Context, s ChunkStore, key string) (*lruEntry, *uncached, error) {
+	object, info, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Size > c.maxObjectSize {
+		return nil, &uncached{object: object, info: info}, nil
+	}
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	if err != nil {
+		return nil, nil, err
+	}
+	cached := *info
+	cached.Size = int64(len(data))
+	return &lruEntry{key: key, size: cached.Size, data: data, info: cached}, nil, nil
+}
+
+// GetRange serves cached objects from memory, ranges of anything
+// else go straight to the wrapped store without filling the cache
+func (c *CachedStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	entry, ok := c.memory.get(key)
+	if !ok {
+		cacheStats.Add("misses", 1)
+		return c.ChunkStore.GetRange(ctx, key, offset, length)
+	}
+	cacheStats.Add("hits", 1)
+	c.touch(ctx, key)
+	info := entry.info
+	reader, err := sliceReader(io.NopCloser(bytes.NewReader(entry.data)), offset, length)
+	return reader, &info, err
+}
+
+func (c *CachedStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	if entry, ok := c.memory.get(key); ok {
+		info := entry.info
+		return &info, nil
+	}
+	return c.ChunkStore.Stat(ctx, key)
+}
+
+func (c *CachedStore) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	c.memory.remove(key)
+	if c.disk != nil {
+		c.dropFromDisk(ctx, key)
+	}
+	return c.ChunkStore.UpdateMetadata(ctx, key, metadata)
+}
+
+func (c *CachedStore) Delete(ctx context.Context, key string) error {
+	c.memory.remove(key)
+	if c.disk != nil {
+		c.dropFromDisk(ctx, key)
+	}
+	c.publishSizes()
+	return c.ChunkStore.Delete(ctx, key)
+}
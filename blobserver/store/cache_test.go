@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+)
+
+// countingStore counts the reads of its ChunkStore
+type countingStore struct {
+	ChunkStore
+	gets atomic.Int64
+}
+
+func (c *countingStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	c.gets.Add(1)
+	return c.ChunkStore.Get(ctx, key)
+}
+
+func TestCachedStoreReadsLargeObjectsOnce(t *testing.T) {
+	ctx := context.Background()
+	base := &countingStore{ChunkStore: NewMemoryStore()}
+	c, err := NewCachedStore(base, 1<<20, 4, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, large := testKey(t, "tiny"), testKey(t, "too large to cache")
+	for key, content := range map[string]string{small.String(): "tiny", large.String(): "too large to cache"} {
+		if err := base.Put(ctx, key, strings.NewReader(content), int64(len(content)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for range 2 {
+		object, _, err := c.Get(ctx, large.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(object)
+		object.Close()
+		if err != nil || string(content) != "too large to cache" {
+			t.Fatalf("Get = %q, %v", content, err)
+		}
+	}
+	if gets := base.gets.Load(); gets != 2 {
+		t.Errorf("two reads of a large object made %d reads of the store, want 2", gets)
+	}
+
+	base.gets.Store(0)
+	for range 2 {
+		object, _, err := c.Get(ctx, small.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		object.Close()
+	}
+	if gets := base.gets.Load(); gets != 1 {
+		t.Errorf("two reads of a small object made %d reads of the store, want 1", gets)
+	}
+}
+
+func TestCachedStoreDiskKeepsMetadata(t *testing.T) {
+	ctx := context.Background()
+	base, disk := NewMemoryStore(), NewMemoryStore()
+	key := testKey(t, "reserved").String()
+	if err := base.Put(ctx, key, strings.NewReader("reserved"), 8, nil); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCachedStore(base, 1<<20, 1<<20, disk, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MissingChunks(ctx, c, []digest.Key{testKey(t, "reserved")})
+	object, _, err := c.Get(ctx, key)
+	readAll(t, object, err)
+
+	// a restart loses the memory cache, the reservation comes back from disk
+	c, err = NewCachedStore(base, 1<<20, 1<<20, disk, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, info, err := c.Get(ctx, key)
+	if got := readAll(t, object, err); got != "reserved" || !IsReserved(info, time.Hour) {
+		t.Errorf("Get from the disk cache = %q, %v, want the reservation", got, info.Metadata)
+	}
+
+	if err := c.UpdateMetadata(ctx, key, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.Stat(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("disk entry after UpdateMetadata = %v, want it dropped", err)
+	}
+	object, info, err = c.Get(ctx, key)
+	if readAll(t, object, err); IsReserved(info, time.Hour) {
+		t.Error("Get still returns the metadata replaced by UpdateMetadata")
+	}
+}
+
+func TestCachedStoreChecksDiskHits(t *testing.T) {
+	ctx := context.Background()
+	base, disk := NewMemoryStore(), NewMemoryStore()
+	key := testKey(t, "content").String()
+	if err := base.Put(ctx, key, strings.NewReader("content"), 7, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.Put(ctx, key, strings.NewReader("corrupt"), 7, nil); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCachedStore(base, 1<<20, 1<<20, disk, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, _, err := c.Get(ctx, key)
+	if got := readAll(t, object, err); got != "content" {
+		t.Errorf("Get over a corrupted disk entry = %q", got)
+	}
+	object, _, err = disk.Get(ctx, key)
+	if got := readAll(t, object, err); got != "content" {
+		t.Errorf("disk entry = %q, want it replaced", got)
+	}
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+)
+
+// MetaQuarantined marks a chunk the scrubber found corrupted,
+// its value is the time it was quarantined
+const MetaQuarantined = "quarantined"
+
+var ErrQuarantined = errors.New("chunk is corrupted and quarantined")
+
+// MetaReserved records the last time a client was told a chunk exists and
+// skipped uploading it. Until its file is saved nothing references the
+// chunk, so it mustn't be deleted for a while even when it is old.
+const MetaReserved = "reserved"
+
+// reservationRefresh limits how often a reservation is written again
+const reservationRefresh = time.Hour
+
+// IsReserved reports whether a client was told about the chunk less than
+// window ago
+func IsReserved(info *ObjectInfo, window time.Duration) bool {
+	reserved, err := time.Parse(time.RFC3339, info.Metadata[MetaReserved])
+	return err == nil && time.Since(reserved) < window
+}
+
+// reserveChunk records that a client relies on the existing chunk described by info
+func reserveChunk(ctx context.Context, s ChunkStore, key string, info *ObjectInfo) {
+	if IsReserved(info, reservationRefresh) {
+		return
+	}
+	metadata := make(map[string]string, len(info.Metadata)+1)
+	for k, v := range info.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetaReserved] = time.Now().UTC().Format(time.RFC3339)
+	if err := s.UpdateMetadata(ctx, key, metadata); err != nil {
+		slog.Error("error reserving chunk", "ObjectName", key, "error", err.Error())
+	}
+}
+
+// IsQuarantined reports whether the object was quarantined by QuarantineChunk
+func IsQuarantined(info *ObjectInfo) bool {
+	_, ok := info.Metadata[MetaQuarantined]
+	return ok
+}
+
+// QuarantineChunk flags a corrupted chunk. It stays in place for
+// inspection, but reads fail and MissingChunks reports it, so the
+// next upload of the same content replaces it.
+func QuarantineChunk(ctx context.Context, s ChunkStore, key digest.Key) error {
+	info, err := s.Stat(ctx, key.String())
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]string, len(info.Metadata)+1)
+	for k, v := range info.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetaQuarantined] = time.Now().UTC().Format(time.RFC3339)
+	return s.UpdateMetadata(ctx, key.String(), metadata)
+}
+
+// UploadChunk streams data into s under its content address,
+// verifying on the way that data really hashes to key.
+// size may be -1 when the length of data is not known upfront.
+func UploadChunk(ctx context.Context, s ChunkStore, key digest.Key, data io.Reader, size int64) error {
+	hash := key.String()
+	verifier := digest.NewReader(data, key, size)
+	info, err := s.Stat(ctx, hash)
+	if err == nil && !IsQuarantined(info) {
+		// the content is still checked, an upload proves the client has
+		// the chunk and lets them reference it
+		if _, err := io.Copy(io.Discard, verifier); err != nil {
+			slog.Warn("rejected upload of existing chunk", "ObjectName", hash, "error", err.Error())
+			if errors.Is(err, digest.ErrMismatch) {
+				return digest.ErrMismatch
+			}
+			return errors.New("error reading chunk content")
+		}
+		slog.Debug("Object already exist", "ObjectName", hash)
+		reserveChunk(ctx, s, hash, info)
+		return nil
+	}
+	err = s.Put(ctx, hash, verifier, size, nil)
+	if verifier.Err() == digest.ErrMismatch {
+		slog.Warn("rejected chunk with mismatching content", "ObjectName", hash)
+		return digest.ErrMismatch
+	}
+	if err != nil {
+		slog.Error("error uploading object", "ObjectName", hash, "error", err.Error())
+		return errors.New("error uploading object")
+	}
+	return nil
+}
+
+// GetChunk returns a reader over the stored chunk, the caller must close it.
+// The reader fails with digest.ErrMismatch if the stored object is corrupted,
+// quarantined chunks aren't read at all.
+func GetChunk(ctx context.Context, s ChunkStore, key digest.Key) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := s.Get(ctx, key.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	if IsQuarantined(info) {
+		object.Close()
+		return nil, nil, ErrQuarantined
+	}
+	verified := struct {
+		io.Reader
+		io.Closer
+	}{digest.NewReader(object, key, info.Size), object}
+	return verified, info, nil
+}
+
+// statConcurrency bounds the parallel Stat calls made by MissingChunks
+const statConcurrency = 16
+
+// MissingChunks returns the keys that s doesn't hold yet, in input order.
+// A key whose Stat fails for any reason is reported missing, uploading
+// it again is harmless since UploadChunk skips existing objects.
+// Quarantined chunks are missing too, so clients upload a good copy. The
+// others get reserved, see MetaReserved.
+func MissingChunks(ctx context.Context, s ChunkStore, keys []digest.Key) []digest.Key {
+	missing := make([]bool, len(keys))
+	semaphore := make(chan struct{}, statConcurrency)
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			info, err := s.Stat(ctx, keys[i].String())
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				slog.Error("error checking object", "ObjectName", keys[i].String(), "error", err.Error())
+			}
+			missing[i] = err != nil || IsQuarantined(info)
+			if !missing[i] {
+				reserveChunk(ctx, s, keys[i].String(), info)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var result []digest.Key
+	for i := range keys {
+		if missing[i] {
+			result = append(result, keys[i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+)
+
+func testKey(t *testing.T, content string) digest.Key {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	key, err := digest.ParseKey(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestMissingChunksReservesExistingChunks(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	stored, absent := testKey(t, "stored"), testKey(t, "absent")
+	if err := UploadChunk(ctx, s, stored, strings.NewReader("stored"), 6); err != nil {
+		t.Fatal(err)
+	}
+	info, err := s.Stat(ctx, stored.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsReserved(info, time.Hour) {
+		t.Fatal("a fresh upload is reserved")
+	}
+
+	missing := MissingChunks(ctx, s, []digest.Key{stored, absent})
+	if len(missing) != 1 || missing[0] != absent {
+		t.Fatalf("MissingChunks = %v, want [%v]", missing, absent)
+	}
+	info, err = s.Stat(ctx, stored.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsReserved(info, time.Hour) {
+		t.Error("the chunk MissingChunks reported present isn't reserved")
+	}
+	if IsReserved(info, 0) {
+		t.Error("a reservation outlives its window")
+	}
+}
+
+func TestUploadOfExistingChunkReserves(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	key := testKey(t, "twice")
+	for range 2 {
+		if err := UploadChunk(ctx, s, key, strings.NewReader("twice"), 5); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := s.Stat(ctx, key.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsReserved(info, time.Hour) {
+		t.Error("the skipped upload didn't reserve the chunk")
+	}
+}
+
+func TestUploadOfExistingChunkChecksContent(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	key := testKey(t, "secret")
+	if err := UploadChunk(ctx, s, key, strings.NewReader("secret"), 6); err != nil {
+		t.Fatal(err)
+	}
+	err := UploadChunk(ctx, s, key, strings.NewReader("guess!"), 6)
+	if !errors.Is(err, digest.ErrMismatch) {
+		t.Fatalf("UploadChunk of wrong content for a stored chunk = %v, want %v", err, digest.ErrMismatch)
+	}
+	info, err := s.Stat(ctx, key.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsReserved(info, time.Hour) {
+		t.Error("a rejected upload reserved the chunk")
+	}
+}
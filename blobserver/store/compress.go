@@ -0,0 +1,193 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingZstd = "zstd"
+
+	// compressionSampleSize is how much of a chunk is compressed upfront
+	// to decide whether compressing the whole chunk is worth it
+	compressionSampleSize = 64 << 10
+)
+
+var ErrDecompress = errors.New("object failed to decompress")
+
+// CompressedStore compresses objects with zstd before handing them to the
+// wrapped store, and decompresses them again on Get. Objects whose sample
+// doesn't compress below MinRatio are stored as they are, and so are packs
+// which are read by range, PackedStore compresses what it packs itself. Sizes reported
+// by Get and Stat are always the uncompressed ones, so content hashes
+// keep being computed over the original bytes.
+type CompressedStore struct {
+	ChunkStore
+	// MinRatio is the compressed to original size ratio
+	// a sample has to reach for the object to be compressed
+	MinRatio float64
+	encoder  *zstd.Encoder
+}
+
+func NewCompressedStore(base ChunkStore, minRatio float64) (*CompressedStore, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressedStore{ChunkStore: base, MinRatio: minRatio, encoder: encoder}, nil
+}
+
+func (c *CompressedStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	if isPackObject(key) {
+		return c.ChunkStore.Put(ctx, key, data, size, metadata)
+	}
+	sample := make([]byte, compressionSampleSize)
+	n, err := io.ReadFull(data, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	sample = sample[:n]
+	data = io.MultiReader(bytes.NewReader(sample), data)
+
+	// the original size has to be recorded, so objects of unknown size stay raw
+	if size < 0 || n == 0 {
+		return c.ChunkStore.Put(ctx, key, data, size, metadata)
+	}
+	compressed := c.encoder.EncodeAll(sample, nil)
+	if float64(len(compressed)) > c.MinRatio*float64(n) {
+		return c.ChunkStore.Put(ctx, key, data, size, metadata)
+	}
+
+	encoded := make(map[string]string, len(metadata)+2)
+	for k, v := range metadata {
+		encoded[k] = v
+	}
+	encoded[MetaEncoding] = EncodingZstd
+	encoded[MetaSize] = strconv.FormatInt(size, 10)
+
+	reader, writer := io.Pipe()
+	go func() {
+		encoder, err := zstd.NewWriter(writer, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			writer.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(encoder, data)
+		if err != nil {
+			// the wrapped store must not commit a truncated object
+			encoder.Close()
+			writer.CloseWithError(err)
+			return
+		}
+		writer.CloseWithError(encoder.Close())
+	}()
+	err = c.ChunkStore.Put(ctx, key, reader, -1, encoded)
+	// unblock the encoder if the wrapped store gave up early
+	reader.CloseWithError(err)
+	return err
+}
+
+func (c *CompressedStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := c.ChunkStore.Get(ctx, key)
+	if err != nil || info.Metadata[MetaEncoding] != EncodingZstd {
+		return object, info, err
+	}
+	info, err = decodedInfo(info)
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+	reader, err := newDecompressingReader(object)
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+	return reader, info, nil
+}
+
+// GetRange has to decompress from the start of compressed objects,
+// raw objects are ranged by the wrapped store
+func (c *CompressedStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := c.ChunkStore.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Metadata[MetaEncoding] != EncodingZstd {
+		return c.ChunkStore.GetRange(ctx, key, offset, length)
+	}
+	object, info, err := c.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := sliceReader(object, offset, length)
+	return reader, info, err
+}
+
+func (c *CompressedStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := c.ChunkStore.Stat(ctx, key)
+	if err != nil || info.Metadata[MetaEncoding] != EncodingZstd {
+		return info, err
+	}
+	return decodedInfo(info)
+}
+
+// decodedInfo reports the uncompressed size of a compressed object
+func decodedInfo(info *ObjectInfo) (*ObjectInfo, error) {
+	size, err := strconv.ParseInt(info.Metadata[MetaSize], 10, 64)
+	if err != nil {
+		return nil, errors.New("compressed object without its original size")
+	}
+	decoded := *info
+	decoded.Size = size
+	return &decoded, nil
+}
+
+// decompressingReader decodes a compressed object, data that fails to
+// decode is reported as ErrDecompress. Errors reading the object itself
+// are passed on.
+type decompressingReader struct {
+	decoder *zstd.Decoder
+	object  io.ReadCloser
+	source  *sourceReader
+}
+
+func newDecompressingReader(object io.ReadCloser) (*decompressingReader, error) {
+	source := &sourceReader{Reader: object}
+	decoder, err := zstd.NewReader(source, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &decompressingReader{decoder: decoder, object: object, source: source}, nil
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	n, err := d.decoder.Read(p)
+	if err != nil && err != io.EOF && d.source.err == nil {
+		return n, ErrDecompress
+	}
+	return n, err
+}
+
+func (d *decompressingReader) Close() error {
+	d.decoder.Close()
+	return d.object.Close()
+}
+
+// sourceReader remembers the last error reading a compressed object
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,408 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+const (
+	MetaCipher     = "cipher"
+	MetaKeyID      = "key-id"
+	MetaWrappedKey = "wrapped-key"
+
+	CipherAES256GCM = "aes-256-gcm"
+
+	// objects are sealed in segments so they can be streamed,
+	// every segment carries its own authentication tag
+	encryptionSegmentSize = 64 << 10
+	encryptionTagSize     = 16
+)
+
+var ErrDecrypt = errors.New("object failed authentication")
+
+// MasterKeys maps key IDs to 32 byte AES keys
+type MasterKeys map[string][]byte
+
+// ParseMasterKeys reads 'id:base64key' entries separated by
+// commas or new lines
+func ParseMasterKeys(spec string) (MasterKeys, error) {
+	keys := make(MasterKeys)
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, found := strings.Cut(entry, ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("invalid master key entry %q", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 base64 encoded bytes", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// EncryptedStore seals objects with AES-256-GCM before handing them to
+// the wrapped store. Every object gets its own random data key, which is
+// stored in the object metadata wrapped by the active master key.
+// Objects written before encryption was enabled are read as they are.
+type EncryptedStore struct {
+	ChunkStore
+	keys        MasterKeys
+	activeKeyID string
+}
+
+func NewEncryptedStore(base ChunkStore, keys MasterKeys, activeKeyID string) (*EncryptedStore, error) {
+	if _, ok := keys[activeKeyID]; !ok {
+		return nil, fmt.Errorf("active master key %q is not configured", activeKeyID)
+	}
+	return &EncryptedStore{ChunkStore: base, keys: keys, activeKeyID: activeKeyID}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrapKey seals a data key under a master key, the object key is used
+// as additional data so a wrapped key can't be moved to another object
+func (e *EncryptedStore) wrapKey(keyID string, objectKey string, dataKey []byte) (string, error) {
+	gcm, err := newGCM(e.keys[keyID])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	wrapped := gcm.Seal(nonce, nonce, dataKey, []byte(objectKey))
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func (e *EncryptedStore) unwrapKey(objectKey string, metadata map[string]string) ([]byte, error) {
+	masterKey, ok := e.keys[metadata[MetaKeyID]]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", metadata[MetaKeyID])
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(metadata[MetaWrappedKey])
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, sealed := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	dataKey, err := gcm.Open(nil, nonce, sealed, []byte(objectKey))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return dataKey, nil
+}
+
+func (e *EncryptedStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	wrapped, err := e.wrapKey(e.activeKeyID, key, dataKey)
+	if err != nil {
+		return err
+	}
+
+	sealed := make(map[string]string, len(metadata)+3)
+	for k, v := range metadata {
+		sealed[k] = v
+	}
+	sealed[MetaCipher] = CipherAES256GCM
+	sealed[MetaKeyID] = e.activeKeyID
+	sealed[MetaWrappedKey] = wrapped
+
+	sealedSize := int64(-1)
+	if size >= 0 {
+		sealedSize = size + encryptionTagSize*segmentCount(size, encryptionSegmentSize)
+	}
+	reader := &sealingReader{
+		src:   bufio.NewReader(data),
+		aead:  gcm,
+		plain: make([]byte, encryptionSegmentSize),
+	}
+	return e.ChunkStore.Put(ctx, key, reader, sealedSize, sealed)
+}
+
+func (e *EncryptedStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := e.ChunkStore.Get(ctx, key)
+	if err != nil || info.Metadata[MetaCipher] == "" {
+		return object, info, err
+	}
+	dataKey, err := e.unwrapKey(key, info.Metadata)
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		object.Close()
+		return nil, nil, err
+	}
+	decrypted := decryptedInfo(info)
+	reader := &openingReader{
+		src:         bufio.NewReader(object),
+		aead:        gcm,
+		sealed:      make([]byte, encryptionSegmentSize+encryptionTagSize),
+		lastSegment: uint64(segmentCount(decrypted.Size, encryptionSegmentSize) - 1),
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{reader, object}, decrypted, nil
+}
+
+// GetRange only fetches the sealed segments overlapping the range
+// from the wrapped store
+func (e *EncryptedStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := e.ChunkStore.Stat(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.Metadata[MetaCipher] == "" {
+		return e.ChunkStore.GetRange(ctx, key, offset, length)
+	}
+	dataKey, err := e.unwrapKey(key, info.Metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypted := decryptedInfo(info)
+	if length < 0 || offset+length > decrypted.Size {
+		length = decrypted.Size - offset
+	}
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), decrypted, nil
+	}
+
+	sealedSegmentSize := int64(encryptionSegmentSize + encryptionTagSize)
+	firstSegment := offset / encryptionSegmentSize
+	endSegment := (offset + length + encryptionSegmentSize - 1) / encryptionSegmentSize
+	sealedOffset := firstSegment * sealedSegmentSize
+	sealedLength := min((endSegment-firstSegment)*sealedSegmentSize, info.Size-sealedOffset)
+	object, _, err := e.ChunkStore.GetRange(ctx, key, sealedOffset, sealedLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := &openingReader{
+		src:         bufio.NewReader(object),
+		aead:        gcm,
+		sealed:      make([]byte, sealedSegmentSize),
+		counter:     uint64(firstSegment),
+		lastSegment: uint64(segmentCount(decrypted.Size, encryptionSegmentSize) - 1),
+	}
+	sliced, err := sliceReader(struct {
+		io.Reader
+		io.Closer
+	}{reader, object}, offset-firstSegment*encryptionSegmentSize, length)
+	return sliced, decrypted, err
+}
+
+func (e *EncryptedStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := e.ChunkStore.Stat(ctx, key)
+	if err != nil || info.Metadata[MetaCipher] == "" {
+		return info, err
+	}
+	return decryptedInfo(info), nil
+}
+
+// RotationReport summarises one master key rotation
+type RotationReport struct {
+	Rewrapped int
+	Skipped   int
+	Errors    int
+}
+
+// Rotate re-wraps the data key of every object that isn't protected by
+// the active master key yet. Only object metadata is rewritten, sealed
+// payloads stay untouched.
+func (e *EncryptedStore) Rotate(ctx context.Context) (*RotationReport, error) {
+	report := &RotationReport{}
+	err := e.ChunkStore.List(ctx, func(object ObjectInfo) error {
+		info, err := e.ChunkStore.Stat(ctx, object.Key)
+		if err != nil {
+			slog.Error("error reading object metadata", "key", object.Key, "error", err.Error())
+			report.Errors++
+			return nil
+		}
+		if info.Metadata[MetaCipher] == "" || info.Metadata[MetaKeyID] == e.activeKeyID {
+			report.Skipped++
+			return nil
+		}
+		err = e.rewrap(ctx, info)
+		if err != nil {
+			slog.Error("error re-wrapping data key", "key", object.Key, "error", err.Error())
+			report.Errors++
+			return nil
+		}
+		report.Rewrapped++
+		return nil
+	})
+	return report, err
+}
+
+func (e *EncryptedStore) rewrap(ctx context.Context, info *ObjectInfo) error {
+	dataKey, err := e.unwrapKey(info.Key, info.Metadata)
+	if err != nil {
+		return err
+	}
+	wrapped, err := e.wrapKey(e.activeKeyID, info.Key, dataKey)
+	if err != nil {
+		return err
+	}
+	metadata := make(map[string]string, len(info.Metadata))
+	for k, v := range info.Metadata {
+		metadata[k] = v
+	}
+	metadata[MetaKeyID] = e.activeKeyID
+	metadata[MetaWrappedKey] = wrapped
+	return e.ChunkStore.UpdateMetadata(ctx, info.Key, metadata)
+}
+
+// segmentCount is the number of segments a payload of size bytes is
+// split into, an empty payload still has one empty segment
+func segmentCount(size int64, segmentSize int64) int64 {
+	if size == 0 {
+		return 1
+	}
+	return (size + segmentSize - 1) / segmentSize
+}
+
+func decryptedInfo(info *ObjectInfo) *ObjectInfo {
+	decrypted := *info
+	sealedSegmentSize := int64(encryptionSegmentSize + encryptionTagSize)
+	decrypted.Size = info.Size - encryptionTagSize*segmentCount(info.Size, sealedSegmentSize)
+	return &decrypted
+}
+
+// segmentNonce derives the nonce of a segment from its position, nonces
+// never repeat because every object is sealed with a fresh data key.
+// The last byte marks the final segment so truncation is detected.
+func segmentNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// readSegment fills buf from src and reports whether the stream ended,
+// unlike io.ReadFull every error other than io.EOF is passed on
+func readSegment(src *bufio.Reader, buf []byte) (int, bool, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := src.Read(buf[n:])
+		n += m
+		if err == io.EOF {
+			return n, true, nil
+		}
+		if err != nil {
+			return n, false, err
+		}
+	}
+	_, err := src.Peek(1)
+	if err == io.EOF {
+		return n, true, nil
+	}
+	return n, false, err
+}
+
+type sealingReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	plain   []byte
+	pending []byte
+	counter uint64
+	done    bool
+}
+
+func (s *sealingReader) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		n, last, err := readSegment(s.src, s.plain)
+		if err != nil {
+			return 0, err
+		}
+		s.pending = s.aead.Seal(s.pending[:0], segmentNonce(s.counter, last), s.plain[:n], nil)
+		s.counter++
+		s.done = last
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// openingReader decrypts sealed segments starting at segment counter.
+// Which segment is the last one comes from the object size rather than
+// from the end of src, so ranges ending before the last segment work and
+// a truncated object still fails authentication.
+type openingReader struct {
+	src         *bufio.Reader
+	aead        cipher.AEAD
+	sealed      []byte
+	pending     []byte
+	counter     uint64
+	lastSegment uint64
+	done        bool
+}
+
+func (o *openingReader) Read(p []byte) (int, error) {
+	for len(o.pending) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		n, eof, err := readSegment(o.src, o.sealed)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 && eof {
+			return 0, io.ErrUnexpectedEOF
+		}
+		last := o.counter == o.lastSegment
+		plain, err := o.aead.Open(o.sealed[:0], segmentNonce(o.counter, last), o.sealed[:n], nil)
+		if err != nil {
+			return 0, ErrDecrypt
+		}
+		o.pending = plain
+		o.counter++
+		o.done = last || eof
+	}
+	n := copy(p, o.pending)
+	o.pending = o.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,130 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testEncryptedStore seals into base with master key "old" or "new"
+func testEncryptedStore(t *testing.T, base ChunkStore, active string) *EncryptedStore {
+	t.Helper()
+	oldKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	keys, err := ParseMasterKeys("old:" + oldKey + "\n# rotated\nnew:" + newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEncryptedStore(base, keys, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryptedStoreSegments(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryStore()
+	e := testEncryptedStore(t, base, "old")
+	// two and a half segments
+	content := strings.Repeat("0123456789abcdef", encryptionSegmentSize*5/32)
+	key := testKey(t, content).String()
+	if err := e.Put(ctx, key, strings.NewReader(content), int64(len(content)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := base.Stat(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed.Size != int64(len(content))+3*encryptionTagSize {
+		t.Errorf("sealed size = %d, want a tag for each of the 3 segments", sealed.Size)
+	}
+	object, info, err := e.Get(ctx, key)
+	if got := readAll(t, object, err); got != content || info.Size != int64(len(content)) {
+		t.Fatalf("Get = %d bytes, size %d", len(got), info.Size)
+	}
+
+	offset := int64(encryptionSegmentSize - 10)
+	for _, length := range []int64{20, encryptionSegmentSize + 20, -1} {
+		object, _, err := e.GetRange(ctx, key, offset, length)
+		want := content[offset:]
+		if length >= 0 {
+			want = content[offset : offset+length]
+		}
+		if got := readAll(t, object, err); got != want {
+			t.Errorf("GetRange(%d, %d) = %d bytes, want %d", offset, length, len(got), len(want))
+		}
+	}
+
+	report, err := testEncryptedStore(t, base, "new").Rotate(ctx)
+	if err != nil || report.Rewrapped != 1 {
+		t.Fatalf("Rotate = %+v, %v", report, err)
+	}
+	object, _, err = e.Get(ctx, key)
+	if got := readAll(t, object, err); got != content {
+		t.Error("the object can't be read after rotation")
+	}
+}
+
+func TestEncryptedStoreDetectsTruncation(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryStore()
+	e := testEncryptedStore(t, base, "old")
+	content := strings.Repeat("x", encryptionSegmentSize*2+100)
+	key := testKey(t, content).String()
+	if err := e.Put(ctx, key, strings.NewReader(content), int64(len(content)), nil); err != nil {
+		t.Fatal(err)
+	}
+	object, info, err := base.Get(ctx, key)
+	sealed := readAll(t, object, err)
+
+	// dropping the last segment leaves a valid looking object,
+	// only the last segment flag gives it away
+	truncated := sealed[:2*(encryptionSegmentSize+encryptionTagSize)]
+	if err := base.Put(ctx, key, strings.NewReader(truncated), int64(len(truncated)), info.Metadata); err != nil {
+		t.Fatal(err)
+	}
+	object, _, err = e.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	if _, err := io.ReadAll(object); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("reading a truncated object = %v, want %v", err, ErrDecrypt)
+	}
+	// a range ending before the cut still reads
+	object, _, err = e.GetRange(ctx, key, 0, 10)
+	if got := readAll(t, object, err); got != content[:10] {
+		t.Errorf("GetRange of the first segment = %q", got)
+	}
+
+	tampered := []byte(sealed)
+	tampered[10] ^= 1
+	if err := base.Put(ctx, key, bytes.NewReader(tampered), int64(len(tampered)), info.Metadata); err != nil {
+		t.Fatal(err)
+	}
+	object, _, err = e.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	if _, err := io.ReadAll(object); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("reading a tampered object = %v, want %v", err, ErrDecrypt)
+	}
+}
+
+func TestParseMasterKeys(t *testing.T) {
+	for _, spec := range []string{"nocolon", ":" + base64.StdEncoding.EncodeToString(make([]byte, 32)), "short:" + base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := ParseMasterKeys(spec); err == nil {
+			t.Errorf("ParseMasterKeys(%q) is accepted", spec)
+		}
+	}
+	if _, err := NewEncryptedStore(NewMemoryStore(), MasterKeys{}, "missing"); err == nil {
+		t.Error("an unknown active key is accepted")
+	}
+}
@@ -0,0 +1,435 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	// shard metadata, the object size and shard index
+	// let any k shards rebuild the original object
+	MetaErasureSize = "erasure-size"
+	MetaShard       = "shard"
+	MetaShardHash   = "shard-hash"
+)
+
+var ErrTooFewShards = errors.New("not enough shards left to rebuild the object")
+
+// ErasureStore splits every object into k data shards and m parity shards
+// with Reed-Solomon coding, shard i lives on backend i. Any k shards rebuild
+// the object, so up to m backends can lose it. Every shard records its own
+// hash, corrupted shards are treated as missing.
+type ErasureStore struct {
+	backends    []ChunkStore
+	names       []string
+	dataShards  int
+	writeQuorum int
+	encoder     reedsolomon.Encoder
+}
+
+// NewErasureStore stripes objects over backends with dataShards of them
+// holding data and the rest parity. Writes succeed once writeQuorum shards
+// are stored, it can't be below dataShards. names are only used in logs.
+func NewErasureStore(backends []ChunkStore, names []string, dataShards int, writeQuorum int) (*ErasureStore, error) {
+	parityShards := len(backends) - dataShards
+	if dataShards < 1 || parityShards < 1 {
+		return nil, fmt.Errorf("erasure coding needs at least 1 data and 1 parity shard, got %d backends for %d data shards", len(backends), dataShards)
+	}
+	if writeQuorum < dataShards || writeQuorum > len(backends) {
+		return nil, fmt.Errorf("write quorum must be between %d and %d", dataShards, len(backends))
+	}
+	encoder, err := reedsolomon.New(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &ErasureStore{
+		backends:    backends,
+		names:       names,
+		dataShards:  dataShards,
+		writeQuorum: writeQuorum,
+		encoder:     encoder,
+	}, nil
+}
+
+func (e *ErasureStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	// chunks are small enough to be coded in memory
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(content)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	shards, err := e.encode(content)
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(e.backends))
+	var wg sync.WaitGroup
+	for i := range e.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = e.putShard(ctx, i, key, shards[i], int64(len(content)), metadata)
+		}()
+	}
+	wg.Wait()
+
+	written := 0
+	for i, err := range errs {
+		if err != nil {
+			slog.Error("error writing shard", "backend", e.names[i], "key", key, "error", err.Error())
+			continue
+		}
+		written++
+	}
+	if written < e.writeQuorum {
+		return ErrQuorum
+	}
+	return nil
+}
+
+// encode splits content into data shards and computes the parity ones
+func (e *ErasureStore) encode(content []byte) ([][]byte, error) {
+	if len(content) == 0 {
+		// the encoder needs something to split, the
+		// recorded size of 0 drops the padding again
+		content = []byte{0}
+	}
+	shards, err := e.encoder.Split(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.encoder.Encode(shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+func (e *ErasureStore) putShard(ctx context.Context, index int, key string, shard []byte, size int64, metadata map[string]string) error {
+	hash := sha256.Sum256(shard)
+	shardMetadata := make(map[string]string, len(metadata)+3)
+	for k, v := range metadata {
+		shardMetadata[k] = v
+	}
+	shardMetadata[MetaErasureSize] = strconv.FormatInt(size, 10)
+	shardMetadata[MetaShard] = strconv.Itoa(index)
+	shardMetadata[MetaShardHash] = hex.EncodeToString(hash[:])
+	return e.backends[index].Put(ctx, key, bytes.NewReader(shard), int64(len(shard)), shardMetadata)
+}
+
+// readShard fetches shard index of key, checking it against its hash
+func (e *ErasureStore) readShard(ctx context.Context, index int, key string) ([]byte, *ObjectInfo, error) {
+	object, info, err := e.backends[index].Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer object.Close()
+	shard, err := io.ReadAll(object)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := sha256.Sum256(shard)
+	if info.Metadata[MetaShard] != strconv.Itoa(index) || info.Metadata[MetaShardHash] != hex.EncodeToString(hash[:]) {
+		return nil, nil, fmt.Errorf("corrupted shard %d on %s", index, e.names[index])
+	}
+	return shard, info, nil
+}
+
+// readShards fetches every shard of key in parallel, missing or
+// corrupted ones are left nil. info comes from any good shard.
+func (e *ErasureStore) readShards(ctx context.Context, key string) ([][]byte, *ObjectInfo, error) {
+	shards := make([][]byte, len(e.backends))
+	infos := make([]*ObjectInfo, len(e.backends))
+	errs := make([]error, len(e.backends))
+	var wg sync.WaitGroup
+	for i := range e.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shards[i], infos[i], errs[i] = e.readShard(ctx, i, key)
+		}()
+	}
+	wg.Wait()
+
+	var info *ObjectInfo
+	present, notFound := 0, 0
+	for i := range shards {
+		if errs[i] == nil {
+			info = infos[i]
+			present++
+			continue
+		}
+		if errors.Is(errs[i], ErrNotFound) {
+			notFound++
+			continue
+		}
+		slog.Warn("unreadable shard", "backend", e.names[i], "key", key, "error", errs[i].Error())
+	}
+	if notFound == len(e.backends) {
+		return nil, nil, ErrNotFound
+	}
+	if present < e.dataShards {
+		return nil, nil, ErrTooFewShards
+	}
+	return shards, info, nil
+}
+
+// decode joins the data shards back into the original object
+func (e *ErasureStore) decode(shards [][]byte, info *ObjectInfo) ([]byte, *ObjectInfo, error) {
+	size, err := strconv.ParseInt(info.Metadata[MetaErasureSize], 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("shard without the object size")
+	}
+	if err := e.encoder.ReconstructData(shards); err != nil {
+		return nil, nil, err
+	}
+	var content bytes.Buffer
+	if err := e.encoder.Join(&content, shards, int(size)); err != nil {
+		return nil, nil, err
+	}
+	return content.Bytes(), objectInfo(info, size), nil
+}
+
+// objectInfo describes the original object from the info of one of its shards
+func objectInfo(shard *ObjectInfo, size int64) *ObjectInfo {
+	info := *shard
+	info.Size = size
+	info.Metadata = make(map[string]string, len(shard.Metadata))
+	for k, v := range shard.Metadata {
+		switch k {
+		case MetaErasureSize, MetaShard, MetaShardHash:
+		default:
+			info.Metadata[k] = v
+		}
+	}
+	return &info
+}
+
+func (e *ErasureStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	shards, info, err := e.readShards(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, info, err := e.decode(shards, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return io.NopCloser(bytes.NewReader(content)), info, nil
+}
+
+func (e *ErasureStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := e.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := sliceReader(object, offset, length)
+	return reader, info, err
+}
+
+// Stat only finds objects that still have enough shards to be read
+func (e *ErasureStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	infos := make([]*ObjectInfo, len(e.backends))
+	var wg sync.WaitGroup
+	for i := range e.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			infos[i], _ = e.backends[i].Stat(ctx, key)
+		}()
+	}
+	wg.Wait()
+
+	var found *ObjectInfo
+	present := 0
+	for _, info := range infos {
+		if info != nil {
+			found = info
+			present++
+		}
+	}
+	if present < e.dataShards {
+		return nil, ErrNotFound
+	}
+	size, err := strconv.ParseInt(found.Metadata[MetaErasureSize], 10, 64)
+	if err != nil {
+		return nil, errors.New("shard without the object size")
+	}
+	return objectInfo(found, size), nil
+}
+
+// UpdateMetadata replaces the metadata of every shard, keeping what
+// the shard needs to be decoded
+func (e *ErasureStore) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	var errs []error
+	for i, backend := range e.backends {
+		info, err := backend.Stat(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		shardMetadata := make(map[string]string, len(metadata)+3)
+		for k, v := range metadata {
+			shardMetadata[k] = v
+		}
+		for _, k := range []string{MetaErasureSize, MetaShard, MetaShardHash} {
+			shardMetadata[k] = info.Metadata[k]
+		}
+		if err := backend.UpdateMetadata(ctx, key, shardMetadata); err != nil {
+			errs = append(errs, fmt.Errorf("updating shard on %s: %w", e.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *ErasureStore) Delete(ctx context.Context, key string) error {
+	var errs []error
+	for _, backend := range e.backends {
+		if err := backend.Delete(ctx, key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List reports every object with at least one shard left once,
+// with its original size
+func (e *ErasureStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	seen := make(map[string]struct{})
+	for i, backend := range e.backends {
+		err := backend.List(ctx, func(shard ObjectInfo) error {
+			if _, ok := seen[shard.Key]; ok {
+				return nil
+			}
+			seen[shard.Key] = struct{}{}
+			info, err := backend.Stat(ctx, shard.Key)
+			if err != nil {
+				return err
+			}
+			size, err := strconv.ParseInt(info.Metadata[MetaErasureSize], 10, 64)
+			if err != nil {
+				return fmt.Errorf("shard %s on %s without the object size", shard.Key, e.names[i])
+			}
+			return fn(*objectInfo(&shard, size))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type RepairReport struct {
+	Objects  int
+	Repaired int
+	Lost     int
+	Errors   int
+}
+
+// Repair walks every backend and regenerates the shards that are missing
+// or corrupted from the remaining ones
+func (e *ErasureStore) Repair(ctx context.Context) (*RepairReport, error) {
+	holders := make(map[string]int)
+	for i, backend := range e.backends {
+		err := backend.List(ctx, func(shard ObjectInfo) error {
+			holders[shard.Key]++
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("listing backend %s: %w", e.names[i], err)
+		}
+	}
+
+	report := &RepairReport{Objects: len(holders)}
+	for key := range holders {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		repaired, err := e.repair(ctx, key)
+		if errors.Is(err, ErrTooFewShards) {
+			slog.Error("object lost, too few shards left", "key", key, "shards", holders[key])
+			report.Lost++
+			continue
+		}
+		if err != nil {
+			slog.Error("error repairing shards", "key", key, "error", err.Error())
+			report.Errors++
+			continue
+		}
+		if repaired {
+			report.Repaired++
+		}
+	}
+	return report, nil
+}
+
+// repair rewrites the bad shards of key and reports whether there were any
+func (e *ErasureStore) repair(ctx context.Context, key string) (bool, error) {
+	shards, info, err := e.readShards(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	var missing []int
+	for i := range shards {
+		if shards[i] == nil {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+
+	if err := e.encoder.Reconstruct(shards); err != nil {
+		return false, err
+	}
+	size, err := strconv.ParseInt(info.Metadata[MetaErasureSize], 10, 64)
+	if err != nil {
+		return false, errors.New("shard without the object size")
+	}
+	metadata := objectInfo(info, size).Metadata
+	for _, i := range missing {
+		if err := e.putShard(ctx, i, key, shards[i], size, metadata); err != nil {
+			return false, fmt.Errorf("writing shard %d on %s: %w", i, e.names[i], err)
+		}
+		slog.Info("regenerated shard", "backend", e.names[i], "key", key, "shard", i)
+	}
+	return true, nil
+}
+
+// StartRepairer runs Repair every interval
+func (e *ErasureStore) StartRepairer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				report, err := e.Repair(ctx)
+				if err != nil {
+					slog.Error("error repairing shards", "error", err.Error())
+					continue
+				}
+				slog.Info("shard repair done", "objects", report.Objects, "repaired", report.Repaired, "lost", report.Lost, "errors", report.Errors)
+
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readOnlyStore refuses the writes to its ChunkStore
+type readOnlyStore struct {
+	ChunkStore
+}
+
+func (readOnlyStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	return errors.New("backend is read only")
+}
+
+// testErasureStore stripes over memory stores, 3 data and 2 parity shards
+func testErasureStore(t *testing.T) (*ErasureStore, []ChunkStore) {
+	t.Helper()
+	backends := make([]ChunkStore, 5)
+	for i := range backends {
+		backends[i] = NewMemoryStore()
+	}
+	e, err := NewErasureStore(backends, []string{"a", "b", "c", "d", "e"}, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, backends
+}
+
+func TestErasureStoreSurvivesLostShards(t *testing.T) {
+	ctx := context.Background()
+	e, backends := testErasureStore(t)
+	content := strings.Repeat("erasure coded ", 100)
+	key := testKey(t, content).String()
+	if err := e.Put(ctx, key, strings.NewReader(content), int64(len(content)), map[string]string{"owner": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// one shard lost and one corrupted, as many as there are parity shards
+	if err := backends[0].Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := backends[3].Put(ctx, key, strings.NewReader("corrupted"), 9, nil); err != nil {
+		t.Fatal(err)
+	}
+	object, info, err := e.Get(ctx, key)
+	if got := readAll(t, object, err); got != content {
+		t.Fatalf("Get with two bad shards = %q", got)
+	}
+	if info.Size != int64(len(content)) || info.Metadata["owner"] != "alice" || info.Metadata[MetaShard] != "" {
+		t.Errorf("Get info = %+v, want the original size and metadata", info)
+	}
+	object, _, err = e.GetRange(ctx, key, 14, 8)
+	if got := readAll(t, object, err); got != "erasure " {
+		t.Errorf("GetRange = %q", got)
+	}
+
+	report, err := e.Repair(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Objects != 1 || report.Repaired != 1 || report.Lost != 0 {
+		t.Errorf("Repair = %+v, want the object repaired", report)
+	}
+	// the repaired shards are enough once two others are gone
+	for _, i := range []int{1, 2} {
+		if err := backends[i].Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	object, _, err = e.Get(ctx, key)
+	if got := readAll(t, object, err); got != content {
+		t.Errorf("Get after repair = %q", got)
+	}
+
+	if err := backends[4].Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.Get(ctx, key); !errors.Is(err, ErrTooFewShards) {
+		t.Errorf("Get with too few shards = %v, want %v", err, ErrTooFewShards)
+	}
+	report, err = e.Repair(ctx)
+	if err != nil || report.Lost != 1 {
+		t.Errorf("Repair of a lost object = %+v, %v", report, err)
+	}
+}
+
+func TestErasureStoreEmptyObject(t *testing.T) {
+	ctx := context.Background()
+	e, _ := testErasureStore(t)
+	key := testKey(t, "").String()
+	if err := e.Put(ctx, key, strings.NewReader(""), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	object, info, err := e.Get(ctx, key)
+	if got := readAll(t, object, err); got != "" || info.Size != 0 {
+		t.Errorf("Get of an empty object = %q, size %d", got, info.Size)
+	}
+	if _, _, err := e.Get(ctx, testKey(t, "absent").String()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get of an absent object = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestErasureStoreWriteQuorum(t *testing.T) {
+	ctx := context.Background()
+	backends := []ChunkStore{NewMemoryStore(), NewMemoryStore(), readOnlyStore{NewMemoryStore()}, readOnlyStore{NewMemoryStore()}}
+	e, err := NewErasureStore(backends, []string{"a", "b", "c", "d"}, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Put(ctx, testKey(t, "quorum").String(), strings.NewReader("quorum"), 6, nil); !errors.Is(err, ErrQuorum) {
+		t.Errorf("Put on two of four backends = %v, want %v", err, ErrQuorum)
+	}
+	if _, err := NewErasureStore(backends, []string{"a", "b", "c", "d"}, 2, 1); err == nil {
+		t.Error("a write quorum below the data shards is accepted")
+	}
+}
@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+)
+
+// LegacyKeyStore finds the chunks stored before keys named their hash
+// algorithm, under their bare hex digest. New chunks are written under the
+// full key, the old objects are read and deleted where they are and
+// listed under the key they would have today.
+type LegacyKeyStore struct {
+	base ChunkStore
+}
+
+func NewLegacyKeyStore(base ChunkStore) *LegacyKeyStore {
+	return &LegacyKeyStore{base: base}
+}
+
+// legacyKey returns the name a chunk of key had, if it could have one
+func legacyKey(key string) (string, bool) {
+	return strings.CutPrefix(key, digest.DefaultAlgorithm+":")
+}
+
+// isLegacyKey tells whether an object name is a bare digest of DefaultAlgorithm
+func isLegacyKey(name string) bool {
+	key, err := digest.ParseKey(name)
+	return err == nil && name == key.Hex
+}
+
+func (l *LegacyKeyStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	return l.base.Put(ctx, key, data, size, metadata)
+}
+
+func (l *LegacyKeyStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := l.base.Get(ctx, key)
+	if old, ok := legacyKey(key); ok && errors.Is(err, ErrNotFound) {
+		object, info, err = l.base.Get(ctx, old)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Key = key
+	return object, info, nil
+}
+
+func (l *LegacyKeyStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := l.base.GetRange(ctx, key, offset, length)
+	if old, ok := legacyKey(key); ok && errors.Is(err, ErrNotFound) {
+		object, info, err = l.base.GetRange(ctx, old, offset, length)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Key = key
+	return object, info, nil
+}
+
+func (l *LegacyKeyStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := l.base.Stat(ctx, key)
+	if old, ok := legacyKey(key); ok && errors.Is(err, ErrNotFound) {
+		info, err = l.base.Stat(ctx, old)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Key = key
+	return info, nil
+}
+
+func (l *LegacyKeyStore) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	err := l.base.UpdateMetadata(ctx, key, metadata)
+	if old, ok := legacyKey(key); ok && errors.Is(err, ErrNotFound) {
+		err = l.base.UpdateMetadata(ctx, old, metadata)
+	}
+	return err
+}
+
+// Delete removes the chunk under both names, an upload may have stored it
+// again under its full key
+func (l *LegacyKeyStore) Delete(ctx context.Context, key string) error {
+	if err := l.base.Delete(ctx, key); err != nil {
+		return err
+	}
+	if old, ok := legacyKey(key); ok {
+		return l.base.Delete(ctx, old)
+	}
+	return nil
+}
+
+func (l *LegacyKeyStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return l.base.List(ctx, func(info ObjectInfo) error {
+		if isLegacyKey(info.Key) {
+			info.Key = digest.DefaultAlgorithm + ":" + info.Key
+		}
+		return fn(info)
+	})
+}
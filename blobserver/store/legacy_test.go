@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+)
+
+func TestLegacyKeyStore(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryStore()
+	key := testKey(t, "old chunk")
+	// stored by the baseline under the bare digest
+	if err := base.Put(ctx, key.Hex, strings.NewReader("old chunk"), 9, nil); err != nil {
+		t.Fatal(err)
+	}
+	s := NewLegacyKeyStore(base)
+
+	object, info, err := GetChunk(ctx, s, key)
+	if err != nil {
+		t.Fatalf("GetChunk of a legacy chunk: %v", err)
+	}
+	content, err := io.ReadAll(object)
+	object.Close()
+	if err != nil || string(content) != "old chunk" || info.Key != key.String() {
+		t.Errorf("GetChunk = %q, %q, %v", content, info.Key, err)
+	}
+	if missing := MissingChunks(ctx, s, []digest.Key{key}); len(missing) != 0 {
+		t.Error("a legacy chunk is missing")
+	}
+
+	var listed []string
+	err = s.List(ctx, func(info ObjectInfo) error {
+		listed = append(listed, info.Key)
+		return nil
+	})
+	if err != nil || len(listed) != 1 || listed[0] != key.String() {
+		t.Errorf("List = %v, %v, want [%s]", listed, err, key)
+	}
+
+	if err := s.Delete(ctx, key.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := base.Stat(ctx, key.Hex); !errors.Is(err, ErrNotFound) {
+		t.Errorf("the legacy object survived Delete: %v", err)
+	}
+}
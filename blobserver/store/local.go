@@ -0,0 +1,246 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const localTempDir = ".tmp"
+
+const localMetaSuffix = ".meta"
+
+// LocalStore keeps objects as files below a root directory. Files are
+// fanned out into two levels of sub directories taken from the digest
+// so no single directory grows too large, and are written to a temp
+// file first and renamed into place so readers never see partial data.
+// Object metadata lives in a json side file next to the object.
+type LocalStore struct {
+	root string
+}
+
+func NewLocalStore(root string) (*LocalStore, error) {
+	if root == "" {
+		return nil, errors.New("local store needs a root directory")
+	}
+	err := os.MkdirAll(filepath.Join(root, localTempDir), 0o750)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{root: root}, nil
+}
+
+// path maps 'sha256:abcdef..' to '<root>/ab/cd/sha256:abcdef..'
+func (l *LocalStore) path(key string) string {
+	name := url.PathEscape(key)
+	digest := key[strings.LastIndex(key, ":")+1:]
+	if len(digest) < 4 {
+		return filepath.Join(l.root, "_", name)
+	}
+	return filepath.Join(l.root, digest[0:2], digest[2:4], name)
+}
+
+func (l *LocalStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	path := l.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0o750)
+	if err != nil {
+		return err
+	}
+	tmpData, err := l.writeTemp(data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpData)
+
+	// the metadata goes first, so it is in place once the object shows up
+	if len(metadata) > 0 {
+		err = l.writeMetadata(path, metadata)
+	} else {
+		err = os.Remove(path + localMetaSuffix)
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpData, path)
+}
+
+// writeTemp copies data into a new file of the temp directory
+// and returns its name
+func (l *LocalStore) writeTemp(data io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(l.root, localTempDir), "put-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(tmp, data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func (l *LocalStore) writeMetadata(path string, metadata map[string]string) error {
+	content, err := json.Marshal(lowerKeys(metadata))
+	if err != nil {
+		return err
+	}
+	tmpMeta, err := l.writeTemp(bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpMeta, path+localMetaSuffix)
+	if err != nil {
+		os.Remove(tmpMeta)
+	}
+	return err
+}
+
+func (l *LocalStore) readMetadata(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path + localMetaSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]string
+	err = json.Unmarshal(content, &metadata)
+	return metadata, err
+}
+
+func (l *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	path := l.path(key)
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	info := fileInfo(key, stat)
+	info.Metadata, err = l.readMetadata(path)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, info, nil
+}
+
+func (l *LocalStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := l.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	file := object.(*os.File)
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if length < 0 {
+		return file, info, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(file, length), file}, info, nil
+}
+
+func (l *LocalStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	path := l.path(key)
+	stat, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := fileInfo(key, stat)
+	info.Metadata, err = l.readMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (l *LocalStore) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	path := l.path(key)
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return l.writeMetadata(path, metadata)
+}
+
+func (l *LocalStore) Delete(ctx context.Context, key string) error {
+	path := l.path(key)
+	for _, name := range []string{path, path + localMetaSuffix} {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *LocalStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(l.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if entry.Name() == localTempDir {
+				return filepath.SkipDir
+			}
+			return ctx.Err()
+		}
+		if strings.HasSuffix(entry.Name(), localMetaSuffix) {
+			return nil
+		}
+		key, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			return nil
+		}
+		stat, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(*fileInfo(key, stat))
+	})
+}
+
+func fileInfo(key string, stat fs.FileInfo) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          key,
+		Size:         stat.Size(),
+		LastModified: stat.ModTime(),
+	}
+}
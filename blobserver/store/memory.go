@@ -0,0 +1,119 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryObject struct {
+	data         []byte
+	lastModified time.Time
+	metadata     map[string]string
+}
+
+// MemoryStore keeps every object in process memory, it is meant
+// for development and tests
+type MemoryStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{objects: make(map[string]memoryObject)}
+}
+
+func (m *MemoryStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	content, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{data: content, lastModified: time.Now(), metadata: lowerKeys(metadata)}
+	return nil
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(object.data)), object.info(key), nil
+}
+
+func (m *MemoryStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := m.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := sliceReader(object, offset, length)
+	return reader, info, err
+}
+
+func (m *MemoryStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return object.info(key), nil
+}
+
+func (m *MemoryStore) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return ErrNotFound
+	}
+	object.metadata = lowerKeys(metadata)
+	m.objects[key] = object
+	return nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *MemoryStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	m.mu.RLock()
+	infos := make([]ObjectInfo, 0, len(m.objects))
+	for key, object := range m.objects {
+		infos = append(infos, *object.info(key))
+	}
+	m.mu.RUnlock()
+
+	for i := range infos {
+		if err := fn(infos[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o memoryObject) info(key string) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          key,
+		Size:         int64(len(o.data)),
+		LastModified: o.lastModified,
+		Metadata:     o.metadata,
+	}
+}
+
+func lowerKeys(metadata map[string]string) map[string]string {
+	lowered := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		lowered[strings.ToLower(key)] = value
+	}
+	return lowered
+}
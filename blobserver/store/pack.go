@@ -0,0 +1,746 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/melsonic/skyvault/blobserver/digest"
+)
+
+const (
+	packPrefix      = "pack-"
+	packIndexSuffix = ".idx"
+)
+
+// packEntry locates one chunk inside a pack, Length bytes at Offset. A
+// chunk compressed with Encoding is Size bytes once decompressed.
+type packEntry struct {
+	Key      string            `json:"key"`
+	Offset   int64             `json:"offset"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Encoding string            `json:"encoding,omitempty"`
+	Size     int64             `json:"size,omitempty"`
+}
+
+// size returns the length of the chunk itself
+func (e packEntry) size() int64 {
+	if e.Encoding != "" {
+		return e.Size
+	}
+	return e.Length
+}
+
+// packIndex is stored next to its pack as <pack>.idx, unlike the pack it
+// is rewritten whenever one of its chunks is deleted
+type packIndex struct {
+	Pack    string      `json:"pack"`
+	Entries []packEntry `json:"entries"`
+}
+
+type pack struct {
+	name         string
+	size         int64
+	lastModified time.Time
+	entries      map[string]packEntry
+	live         int64
+}
+
+func (p *pack) index() packIndex {
+	index := packIndex{Pack: p.name}
+	for _, entry := range p.entries {
+		index.Entries = append(index.Entries, entry)
+	}
+	return index
+}
+
+type PackReport struct {
+	Packed    int
+	Packs     int
+	Compacted int
+	Reclaimed int64
+	Errors    int
+}
+
+// PackedStore moves objects smaller than Threshold into pack objects of
+// about PackSize bytes, so the wrapped store doesn't have to hold millions
+// of tiny objects. Objects are written on their own as usual and packed
+// later by Pack, which also compacts packs whose live ratio dropped below
+// MinLiveRatio. Packed objects are read with a range request into the pack,
+// so with CompressPacked each of them is compressed on its own rather than
+// the whole pack.
+type PackedStore struct {
+	ChunkStore
+	Threshold    int64
+	PackSize     int64
+	MinLiveRatio float64
+
+	// encoder compresses the objects being packed when not nil, the ones
+	// that don't shrink below minRatio of their size are packed raw
+	encoder  *zstd.Encoder
+	minRatio float64
+
+	mu      sync.RWMutex
+	packs   map[string]*pack
+	located map[string]*pack
+
+	// writeMu orders index rewrites, packing and deletes
+	writeMu sync.Mutex
+	packing bool
+	// changed holds the keys written or deleted while Pack runs,
+	// their copy in the pack being built is stale
+	changed map[string]struct{}
+}
+
+// NewPackedStore wraps base and loads the index of every pack it holds
+func NewPackedStore(base ChunkStore, threshold int64, packSize int64, minLiveRatio float64) (*PackedStore, error) {
+	p := &PackedStore{
+		ChunkStore:   base,
+		Threshold:    threshold,
+		PackSize:     packSize,
+		MinLiveRatio: minLiveRatio,
+		packs:        make(map[string]*pack),
+		located:      make(map[string]*pack),
+	}
+	ctx := context.Background()
+	stored := make(map[string]ObjectInfo)
+	var indexes []string
+	err := base.List(ctx, func(object ObjectInfo) error {
+		if strings.HasPrefix(object.Key, packPrefix) {
+			if strings.HasSuffix(object.Key, packIndexSuffix) {
+				indexes = append(indexes, object.Key)
+			} else {
+				stored[object.Key] = object
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range indexes {
+		index, err := p.readIndex(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("reading pack index %s: %w", key, err)
+		}
+		object, ok := stored[index.Pack]
+		if !ok {
+			slog.Error("pack index without its pack", "index", key)
+			continue
+		}
+		p.addPack(object, index.Entries)
+	}
+	slog.Info("pack index loaded", "packs", len(p.packs), "objects", len(p.located))
+	return p, nil
+}
+
+// CompressPacked compresses the objects Pack moves into packs like a
+// CompressedStore with minRatio would
+func (p *PackedStore) CompressPacked(minRatio float64) error {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return err
+	}
+	p.encoder, p.minRatio = encoder, minRatio
+	return nil
+}
+
+func isPackObject(key string) bool {
+	return strings.HasPrefix(key, packPrefix)
+}
+
+func (p *PackedStore) readIndex(ctx context.Context, key string) (*packIndex, error) {
+	object, _, err := p.ChunkStore.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	var index packIndex
+	err = json.NewDecoder(object).Decode(&index)
+	return &index, err
+}
+
+func (p *PackedStore) writeIndex(ctx context.Context, index packIndex) error {
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return p.ChunkStore.Put(ctx, index.Pack+packIndexSuffix, bytes.NewReader(content), int64(len(content)), nil)
+}
+
+// addPack makes the entries of a stored pack visible, an object found
+// in two packs after an interrupted compaction stays in the first one
+func (p *PackedStore) addPack(object ObjectInfo, entries []packEntry) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addPackLocked(object, entries)
+}
+
+func (p *PackedStore) addPackLocked(object ObjectInfo, entries []packEntry) {
+	pk := &pack{
+		name:         object.Key,
+		size:         object.Size,
+		lastModified: object.LastModified,
+		entries:      make(map[string]packEntry, len(entries)),
+	}
+	for _, entry := range entries {
+		if _, ok := p.located[entry.Key]; ok {
+			continue
+		}
+		pk.entries[entry.Key] = entry
+		pk.live += entry.Length
+		p.located[entry.Key] = pk
+	}
+	p.packs[pk.name] = pk
+}
+
+func (p *PackedStore) locate(key string) (*pack, packEntry, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	pk, ok := p.located[key]
+	if !ok {
+		return nil, packEntry{}, false
+	}
+	return pk, pk.entries[key], true
+}
+
+func packedInfo(pk *pack, entry packEntry) *ObjectInfo {
+	return &ObjectInfo{
+		Key:          entry.Key,
+		Size:         entry.size(),
+		LastModified: pk.lastModified,
+		Metadata:     entry.Metadata,
+	}
+}
+
+// getPacked reads a range of a packed object, ok is false when key isn't packed
+func (p *PackedStore) getPacked(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, bool, error) {
+	// a compaction may move the object while it is looked up, so look twice
+	for range 2 {
+		pk, entry, ok := p.locate(key)
+		if !ok {
+			return nil, nil, false, nil
+		}
+		if entry.Encoding != "" {
+			object, err := p.getCompressed(ctx, pk, entry, offset, length)
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return object, packedInfo(pk, entry), true, err
+		}
+		offset = min(offset, entry.Length)
+		readLength := entry.Length - offset
+		if length >= 0 {
+			readLength = min(readLength, length)
+		}
+		if readLength == 0 {
+			return io.NopCloser(bytes.NewReader(nil)), packedInfo(pk, entry), true, nil
+		}
+		object, _, err := p.ChunkStore.GetRange(ctx, pk.name, entry.Offset+offset, readLength)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, true, err
+		}
+		return object, packedInfo(pk, entry), true, nil
+	}
+	return nil, nil, true, ErrNotFound
+}
+
+// getCompressed reads a compressed packed object, only the object itself
+// is read from the pack and decompressed
+func (p *PackedStore) getCompressed(ctx context.Context, pk *pack, entry packEntry, offset int64, length int64) (io.ReadCloser, error) {
+	if entry.Encoding != EncodingZstd {
+		return nil, fmt.Errorf("unknown encoding %q of packed object", entry.Encoding)
+	}
+	object, _, err := p.ChunkStore.GetRange(ctx, pk.name, entry.Offset, entry.Length)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newDecompressingReader(object)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	return sliceReader(reader, offset, length)
+}
+
+func (p *PackedStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	return p.GetRange(ctx, key, 0, -1)
+}
+
+func (p *PackedStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	if object, info, ok, err := p.getPacked(ctx, key, offset, length); ok {
+		return object, info, err
+	}
+	var object io.ReadCloser
+	var info *ObjectInfo
+	var err error
+	if offset == 0 && length < 0 {
+		object, info, err = p.ChunkStore.Get(ctx, key)
+	} else {
+		object, info, err = p.ChunkStore.GetRange(ctx, key, offset, length)
+	}
+	if errors.Is(err, ErrNotFound) {
+		// packed since it was looked up
+		if object, info, ok, err := p.getPacked(ctx, key, offset, length); ok {
+			return object, info, err
+		}
+	}
+	return object, info, err
+}
+
+func (p *PackedStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	if pk, entry, ok := p.locate(key); ok {
+		return packedInfo(pk, entry), nil
+	}
+	info, err := p.ChunkStore.Stat(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		if pk, entry, ok := p.locate(key); ok {
+			return packedInfo(pk, entry), nil
+		}
+	}
+	return info, err
+}
+
+// Put writes the object on its own, a packed copy is dropped first so
+// reads don't keep being served from it
+func (p *PackedStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	if err := p.forget(ctx, key); err != nil {
+		return err
+	}
+	return p.ChunkStore.Put(ctx, key, data, size, metadata)
+}
+
+func (p *PackedStore) Delete(ctx context.Context, key string) error {
+	if err := p.forget(ctx, key); err != nil {
+		return err
+	}
+	return p.ChunkStore.Delete(ctx, key)
+}
+
+// forget removes key from its pack index, the pack itself keeps the
+// bytes until it is compacted
+func (p *PackedStore) forget(ctx context.Context, key string) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	if p.packing {
+		p.changed[key] = struct{}{}
+	}
+	pk, entry, ok := p.locate(key)
+	if !ok {
+		return nil
+	}
+	index := pk.index()
+	index.Entries = removeEntry(index.Entries, key)
+	if err := p.writeIndex(ctx, index); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	delete(pk.entries, key)
+	delete(p.located, key)
+	pk.live -= entry.Length
+	p.mu.Unlock()
+	return nil
+}
+
+func removeEntry(entries []packEntry, key string) []packEntry {
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.Key != key {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+func (p *PackedStore) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	pk, entry, ok := p.locate(key)
+	if !ok {
+		return p.ChunkStore.UpdateMetadata(ctx, key, metadata)
+	}
+	entry.Metadata = lowerKeys(metadata)
+	index := pk.index()
+	for i := range index.Entries {
+		if index.Entries[i].Key == key {
+			index.Entries[i] = entry
+		}
+	}
+	if err := p.writeIndex(ctx, index); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	pk.entries[key] = entry
+	p.mu.Unlock()
+	return nil
+}
+
+// List reports loose and packed objects, but not the packs themselves
+func (p *PackedStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	seen := make(map[string]struct{})
+	err := p.ChunkStore.List(ctx, func(object ObjectInfo) error {
+		if isPackObject(object.Key) {
+			return nil
+		}
+		seen[object.Key] = struct{}{}
+		return fn(object)
+	})
+	if err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	var packed []ObjectInfo
+	for key, pk := range p.located {
+		if _, ok := seen[key]; !ok {
+			packed = append(packed, *packedInfo(pk, pk.entries[key]))
+		}
+	}
+	p.mu.RUnlock()
+	for _, object := range packed {
+		if err := fn(object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packBuilder collects objects for a new pack
+type packBuilder struct {
+	content bytes.Buffer
+	entries []packEntry
+}
+
+// add appends the stored bytes of entry, its offset and length are set here
+func (b *packBuilder) add(entry packEntry, data []byte) {
+	entry.Offset = int64(b.content.Len())
+	entry.Length = int64(len(data))
+	b.entries = append(b.entries, entry)
+	b.content.Write(data)
+}
+
+// compress returns how an object of data goes into a pack
+func (p *PackedStore) compress(key string, data []byte, metadata map[string]string) (packEntry, []byte) {
+	entry := packEntry{Key: key, Metadata: metadata}
+	if p.encoder == nil || len(data) == 0 {
+		return entry, data
+	}
+	compressed := p.encoder.EncodeAll(data, nil)
+	if float64(len(compressed)) > p.minRatio*float64(len(data)) {
+		return entry, data
+	}
+	entry.Encoding, entry.Size = EncodingZstd, int64(len(data))
+	return entry, compressed
+}
+
+func newPackName() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s%d-%s", packPrefix, time.Now().UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+// Pack moves small loose objects into new packs and compacts the packs
+// that are mostly deleted. Packs without an index are leftovers of an
+// interrupted run, their objects are still loose so they are removed.
+func (p *PackedStore) Pack(ctx context.Context) (*PackReport, error) {
+	p.writeMu.Lock()
+	p.packing = true
+	p.changed = make(map[string]struct{})
+	p.writeMu.Unlock()
+	defer func() {
+		p.writeMu.Lock()
+		p.packing = false
+		p.changed = nil
+		p.writeMu.Unlock()
+	}()
+
+	report := &PackReport{}
+	var loose []string
+	var orphans []string
+	err := p.ChunkStore.List(ctx, func(object ObjectInfo) error {
+		if isPackObject(object.Key) {
+			p.mu.RLock()
+			_, indexed := p.packs[strings.TrimSuffix(object.Key, packIndexSuffix)]
+			p.mu.RUnlock()
+			if !indexed {
+				orphans = append(orphans, object.Key)
+			}
+			return nil
+		}
+		if object.Size < p.Threshold {
+			loose = append(loose, object.Key)
+		}
+		return nil
+	})
+	// a loose object that is packed already is left from a run
+	// that couldn't delete it
+	var unpacked []string
+	for _, key := range loose {
+		if _, _, packed := p.locate(key); !packed {
+			unpacked = append(unpacked, key)
+		} else {
+			orphans = append(orphans, key)
+		}
+	}
+	loose = unpacked
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range orphans {
+		if err := p.ChunkStore.Delete(ctx, key); err != nil {
+			slog.Error("error deleting pack leftover", "key", key, "error", err.Error())
+			report.Errors++
+		}
+	}
+
+	builder := &packBuilder{}
+	for _, key := range loose {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		data, metadata, err := p.readLoose(ctx, key)
+		if err != nil {
+			slog.Warn("not packing object", "key", key, "error", err.Error())
+			continue
+		}
+		builder.add(p.compress(key, data, metadata))
+		if int64(builder.content.Len()) >= p.PackSize {
+			p.flush(ctx, builder, nil, report)
+			builder = &packBuilder{}
+		}
+	}
+	if len(builder.entries) > 0 {
+		p.flush(ctx, builder, nil, report)
+	}
+
+	p.compact(ctx, report)
+	return report, nil
+}
+
+// readLoose reads an object to pack, objects that don't match their hash
+// or were quarantined are left alone for the scrubber
+func (p *PackedStore) readLoose(ctx context.Context, key string) ([]byte, map[string]string, error) {
+	object, info, err := p.ChunkStore.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer object.Close()
+	if _, quarantined := info.Metadata[MetaQuarantined]; quarantined {
+		return nil, nil, ErrQuarantined
+	}
+	var content io.Reader = object
+	if parsed, err := digest.ParseKey(key); err == nil {
+		content = digest.NewReader(object, parsed, info.Size)
+	}
+	data, err := io.ReadAll(content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, portableMetadata(info.Metadata), nil
+}
+
+// flush stores the pack being built and its index, then removes the
+// packed objects from where they were: loose objects for a new pack,
+// the source packs for a compaction
+func (p *PackedStore) flush(ctx context.Context, builder *packBuilder, sources []*pack, report *PackReport) {
+	name, err := newPackName()
+	if err != nil {
+		report.Errors++
+		return
+	}
+	size := int64(builder.content.Len())
+	if err := p.ChunkStore.Put(ctx, name, bytes.NewReader(builder.content.Bytes()), size, nil); err != nil {
+		slog.Error("error writing pack", "pack", name, "error", err.Error())
+		report.Errors++
+		return
+	}
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	// objects written or deleted in the meantime have a newer state elsewhere
+	var entries []packEntry
+	for _, entry := range builder.entries {
+		if _, changed := p.changed[entry.Key]; changed {
+			continue
+		}
+		if sources != nil {
+			current, ok := p.sourceEntry(sources, entry.Key)
+			if !ok {
+				continue
+			}
+			entry.Metadata = current.Metadata
+		}
+		entries = append(entries, entry)
+	}
+	index := packIndex{Pack: name, Entries: entries}
+	if err := p.writeIndex(ctx, index); err != nil {
+		slog.Error("error writing pack index", "pack", name, "error", err.Error())
+		report.Errors++
+		// the pack is deleted as a leftover by the next run
+		return
+	}
+
+	// swap in one go, readers always find the object somewhere
+	p.mu.Lock()
+	for _, source := range sources {
+		for key := range source.entries {
+			if p.located[key] == source {
+				delete(p.located, key)
+			}
+		}
+		delete(p.packs, source.name)
+	}
+	p.addPackLocked(ObjectInfo{Key: name, Size: size, LastModified: time.Now()}, entries)
+	p.mu.Unlock()
+	report.Packs++
+
+	if sources == nil {
+		for _, entry := range entries {
+			if err := p.ChunkStore.Delete(ctx, entry.Key); err != nil {
+				slog.Error("error deleting packed object", "key", entry.Key, "error", err.Error())
+				report.Errors++
+			}
+		}
+		report.Packed += len(entries)
+		return
+	}
+	for _, source := range sources {
+		p.deletePack(ctx, source, report)
+		report.Compacted++
+		report.Reclaimed += source.size - source.live
+	}
+}
+
+// sourceEntry finds the current entry of key in one of the packs being compacted
+func (p *PackedStore) sourceEntry(sources []*pack, key string) (packEntry, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, source := range sources {
+		if p.located[key] == source {
+			return source.entries[key], true
+		}
+	}
+	return packEntry{}, false
+}
+
+// deletePack removes the index before the pack, a pack without
+// index is cleaned up by the next run anyway
+func (p *PackedStore) deletePack(ctx context.Context, pk *pack, report *PackReport) {
+	if err := p.ChunkStore.Delete(ctx, pk.name+packIndexSuffix); err != nil {
+		slog.Error("error deleting pack index", "pack", pk.name, "error", err.Error())
+		report.Errors++
+		return
+	}
+	if err := p.ChunkStore.Delete(ctx, pk.name); err != nil {
+		slog.Error("error deleting pack", "pack", pk.name, "error", err.Error())
+		report.Errors++
+	}
+}
+
+// compact rewrites the live objects of the packs below MinLiveRatio
+// into new packs, packs with nothing left are deleted right away
+func (p *PackedStore) compact(ctx context.Context, report *PackReport) {
+	var sparse []*pack
+	p.mu.RLock()
+	for _, pk := range p.packs {
+		if float64(pk.live) < p.MinLiveRatio*float64(pk.size) {
+			sparse = append(sparse, pk)
+		}
+	}
+	p.mu.RUnlock()
+
+	builder := &packBuilder{}
+	var sources []*pack
+	for _, pk := range sparse {
+		if ctx.Err() != nil {
+			return
+		}
+		p.mu.RLock()
+		live := pk.live
+		entries := make([]packEntry, 0, len(pk.entries))
+		for _, entry := range pk.entries {
+			entries = append(entries, entry)
+		}
+		p.mu.RUnlock()
+
+		if live == 0 {
+			p.mu.Lock()
+			delete(p.packs, pk.name)
+			p.mu.Unlock()
+			p.deletePack(ctx, pk, report)
+			report.Compacted++
+			report.Reclaimed += pk.size
+			continue
+		}
+
+		object, _, err := p.ChunkStore.Get(ctx, pk.name)
+		if err != nil {
+			slog.Error("error reading pack", "pack", pk.name, "error", err.Error())
+			report.Errors++
+			continue
+		}
+		content, err := io.ReadAll(object)
+		object.Close()
+		if err != nil {
+			slog.Error("error reading pack", "pack", pk.name, "error", err.Error())
+			report.Errors++
+			continue
+		}
+		for _, entry := range entries {
+			if entry.Offset+entry.Length > int64(len(content)) {
+				slog.Error("pack shorter than its index", "pack", pk.name, "key", entry.Key)
+				report.Errors++
+				continue
+			}
+			// compressed objects move as they are
+			builder.add(entry, content[entry.Offset:entry.Offset+entry.Length])
+		}
+		sources = append(sources, pk)
+		if int64(builder.content.Len()) >= p.PackSize {
+			p.flush(ctx, builder, sources, report)
+			builder, sources = &packBuilder{}, nil
+		}
+	}
+	if len(sources) > 0 {
+		p.flush(ctx, builder, sources, report)
+	}
+}
+
+// StartPacker runs Pack every interval
+func (p *PackedStore) StartPacker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				report, err := p.Pack(ctx)
+				if err != nil {
+					slog.Error("error packing objects", "error", err.Error())
+					continue
+				}
+				slog.Info("packing done", "packed", report.Packed, "packs", report.Packs, "compacted", report.Compacted, "reclaimed", report.Reclaimed, "errors", report.Errors)
+
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
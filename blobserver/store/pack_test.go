@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// rangeRecorder remembers the ranges read from its ChunkStore
+type rangeRecorder struct {
+	ChunkStore
+	lengths []int64
+}
+
+func (r *rangeRecorder) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	r.lengths = append(r.lengths, length)
+	return r.ChunkStore.GetRange(ctx, key, offset, length)
+}
+
+func readAll(t *testing.T, object io.ReadCloser, err error) string {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	content, err := io.ReadAll(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestPackedStoreCompressesAndCompacts(t *testing.T) {
+	ctx := context.Background()
+	base := NewMemoryStore()
+	compressed, err := NewCompressedStore(base, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &rangeRecorder{ChunkStore: compressed}
+	packed, err := NewPackedStore(recorder, 1<<10, 1<<20, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := packed.CompressPacked(0.9); err != nil {
+		t.Fatal(err)
+	}
+
+	contents := []string{strings.Repeat("a", 500), strings.Repeat("b", 500), strings.Repeat("c", 500)}
+	keys := make([]string, len(contents))
+	for i, content := range contents {
+		keys[i] = testKey(t, content).String()
+		if err := packed.Put(ctx, keys[i], strings.NewReader(content), int64(len(content)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err := packed.Pack(ctx)
+	if err != nil || report.Packed != 3 || report.Packs != 1 {
+		t.Fatalf("Pack = %+v, %v, want 3 objects in 1 pack", report, err)
+	}
+
+	var packSize int64
+	err = base.List(ctx, func(object ObjectInfo) error {
+		if isPackObject(object.Key) && !strings.HasSuffix(object.Key, packIndexSuffix) {
+			packSize = object.Size
+			if object.Metadata[MetaEncoding] != "" {
+				t.Errorf("pack %s was compressed as a whole", object.Key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packSize == 0 || packSize >= 1500 {
+		t.Errorf("pack of %d bytes, the objects weren't compressed", packSize)
+	}
+
+	recorder.lengths = nil
+	object, info, err := packed.GetRange(ctx, keys[1], 10, 20)
+	if content := readAll(t, object, err); content != contents[1][10:30] {
+		t.Errorf("GetRange = %q", content)
+	}
+	if info.Size != 500 {
+		t.Errorf("Size = %d, want the uncompressed 500", info.Size)
+	}
+	for _, length := range recorder.lengths {
+		if length < 0 || length >= packSize {
+			t.Errorf("GetRange of one object read %d bytes of a %d byte pack", length, packSize)
+		}
+	}
+
+	// two of three deleted, below MinLiveRatio
+	for _, key := range keys[:2] {
+		if err := packed.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report, err = packed.Pack(ctx)
+	if err != nil || report.Compacted != 1 || report.Reclaimed <= 0 {
+		t.Fatalf("Pack = %+v, %v, want the pack compacted", report, err)
+	}
+	object, _, err = packed.Get(ctx, keys[2])
+	if content := readAll(t, object, err); content != contents[2] {
+		t.Errorf("Get after compaction = %q", content)
+	}
+	if _, err := packed.Stat(ctx, keys[0]); err != ErrNotFound {
+		t.Errorf("Stat of a deleted object = %v, want %v", err, ErrNotFound)
+	}
+	packs := 0
+	base.List(ctx, func(object ObjectInfo) error {
+		if isPackObject(object.Key) && !strings.HasSuffix(object.Key, packIndexSuffix) {
+			packs++
+		}
+		return nil
+	})
+	if packs != 1 {
+		t.Errorf("%d packs left after compaction, want 1", packs)
+	}
+}
@@ -0,0 +1,531 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+)
+
+const (
+	// replicaRepairs bounds the read repairs running in the background
+	replicaRepairs = 8
+	// replicaProbeKey is looked up to find out whether a replica is back
+	replicaProbeKey = "replica-probe"
+	// tombstonePrefix names the markers Delete leaves on the replicas, a
+	// replica that missed the delete loses its copy on Reconcile instead
+	// of handing it back to the others
+	tombstonePrefix = "tombstone-"
+)
+
+var ErrQuorum = errors.New("not enough replicas accepted the write")
+
+// replica tracks how one backend of a ReplicatedStore is doing
+type replica struct {
+	ChunkStore
+	name string
+
+	mu      sync.Mutex
+	latency time.Duration
+	// down replicas are tried last until the probe finds them back
+	down bool
+}
+
+func (r *replica) succeeded(elapsed time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// moving average, recent reads weigh a quarter
+	if r.latency == 0 {
+		r.latency = elapsed
+	} else {
+		r.latency = (3*r.latency + elapsed) / 4
+	}
+}
+
+func (r *replica) failed(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.down = true
+	slog.Warn("replica failed", "replica", r.name, "error", err.Error())
+}
+
+func (r *replica) recovered() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.down = false
+}
+
+func (r *replica) healthy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !r.down
+}
+
+func (r *replica) averageLatency() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latency
+}
+
+// ReplicatedStore writes every object to all of its replicas and succeeds
+// once WriteQuorum of them accepted it. Reads go to the fastest healthy
+// replica. Replicas found missing an object, or holding one that doesn't
+// match its hash, are repaired in the background from a good copy.
+type ReplicatedStore struct {
+	replicas    []*replica
+	writeQuorum int
+	repairs     chan struct{}
+}
+
+// NewReplicatedStore combines backends, names are only used in logs
+func NewReplicatedStore(backends []ChunkStore, names []string, writeQuorum int) (*ReplicatedStore, error) {
+	if writeQuorum < 1 || writeQuorum > len(backends) {
+		return nil, fmt.Errorf("write quorum must be between 1 and %d", len(backends))
+	}
+	r := &ReplicatedStore{
+		writeQuorum: writeQuorum,
+		repairs:     make(chan struct{}, replicaRepairs),
+	}
+	for i := range backends {
+		r.replicas = append(r.replicas, &replica{ChunkStore: backends[i], name: names[i]})
+	}
+	return r, nil
+}
+
+// ordered returns the replicas healthy first, fastest first
+func (r *ReplicatedStore) ordered() []*replica {
+	ordered := make([]*replica, len(r.replicas))
+	copy(ordered, r.replicas)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		healthyI, healthyJ := ordered[i].healthy(), ordered[j].healthy()
+		if healthyI != healthyJ {
+			return healthyI
+		}
+		return ordered[i].averageLatency() < ordered[j].averageLatency()
+	})
+	return ordered
+}
+
+func (r *ReplicatedStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	writers := make([]*io.PipeWriter, len(r.replicas))
+	errs := make([]error, len(r.replicas))
+	var wg sync.WaitGroup
+	for i := range r.replicas {
+		reader, writer := io.Pipe()
+		writers[i] = writer
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = r.replicas[i].Put(ctx, key, reader, size, metadata)
+			// unblock the fan out if the replica gave up early
+			reader.CloseWithError(errors.Join(errs[i], io.ErrClosedPipe))
+		}()
+	}
+
+	// fan data out to every replica still accepting it, a slow
+	// replica slows the upload down but a failed one doesn't stop it
+	alive := len(writers)
+	buf := make([]byte, 64<<10)
+	var readErr error
+	for alive > 0 {
+		n, err := data.Read(buf)
+		for i, writer := range writers {
+			if writer == nil || n == 0 {
+				continue
+			}
+			if _, err := writer.Write(buf[:n]); err != nil {
+				writers[i] = nil
+				alive--
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = err
+			break
+		}
+	}
+	for _, writer := range writers {
+		if writer != nil {
+			writer.CloseWithError(readErr)
+		}
+	}
+	wg.Wait()
+	if readErr != nil {
+		return readErr
+	}
+
+	written := 0
+	for i := range r.replicas {
+		if errs[i] != nil {
+			r.replicas[i].failed(errs[i])
+			continue
+		}
+		written++
+	}
+	if written < r.writeQuorum {
+		return ErrQuorum
+	}
+	return nil
+}
+
+func (r *ReplicatedStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	var missing []*replica
+	for _, rep := range r.ordered() {
+		start := time.Now()
+		object, info, err := rep.Get(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			missing = append(missing, rep)
+			continue
+		}
+		if err != nil {
+			rep.failed(err)
+			continue
+		}
+		rep.succeeded(time.Since(start))
+		parsed, err := digest.ParseKey(key)
+		if err != nil {
+			return object, info, nil
+		}
+		reader := &repairingReader{
+			Reader:  digest.NewReader(object, parsed, info.Size),
+			object:  object,
+			store:   r,
+			key:     key,
+			source:  rep,
+			missing: missing,
+		}
+		return reader, info, nil
+	}
+	if len(missing) == len(r.replicas) {
+		return nil, nil, ErrNotFound
+	}
+	return nil, nil, errors.New("no replica could serve the object")
+}
+
+// repairingReader starts the read repair once the object was read to
+// the end: missing replicas get a copy of a verified object, and a
+// replica serving a corrupted object gets a good copy from another one
+type repairingReader struct {
+	io.Reader
+	object  io.ReadCloser
+	store   *ReplicatedStore
+	key     string
+	source  *replica
+	missing []*replica
+	done    bool
+}
+
+func (rr *repairingReader) Read(p []byte) (int, error) {
+	n, err := rr.Reader.Read(p)
+	if rr.done || err == nil {
+		return n, err
+	}
+	rr.done = true
+	if err == io.EOF && len(rr.missing) > 0 {
+		rr.store.repairInBackground(rr.key, rr.missing)
+	}
+	if err == digest.ErrMismatch {
+		slog.Error("replica holds a corrupted object", "replica", rr.source.name, "key", rr.key)
+		rr.store.repairInBackground(rr.key, []*replica{rr.source})
+	}
+	return n, err
+}
+
+func (rr *repairingReader) Close() error {
+	return rr.object.Close()
+}
+
+func (r *ReplicatedStore) repairInBackground(key string, targets []*replica) {
+	select {
+	case r.repairs <- struct{}{}:
+	default:
+		// plenty of repairs already running, reconcile catches up later
+		return
+	}
+	go func() {
+		defer func() { <-r.repairs }()
+		if err := r.repair(context.Background(), key, targets); err != nil {
+			slog.Error("error repairing replicas", "key", key, "error", err.Error())
+		}
+	}()
+}
+
+// repair copies a verified object from any replica not in targets
+// onto every replica in targets, objects not named after their hash
+// are copied as they are
+func (r *ReplicatedStore) repair(ctx context.Context, key string, targets []*replica) error {
+	parsed, err := digest.ParseKey(key)
+	verify := err == nil
+	isTarget := make(map[*replica]bool, len(targets))
+	for _, target := range targets {
+		isTarget[target] = true
+	}
+	for _, target := range targets {
+		repaired := false
+		for _, source := range r.ordered() {
+			if isTarget[source] {
+				continue
+			}
+			object, info, err := source.Get(ctx, key)
+			if err != nil {
+				continue
+			}
+			var content io.Reader = object
+			if verify {
+				content = digest.NewReader(object, parsed, info.Size)
+			}
+			err = target.Put(ctx, key, content, info.Size, portableMetadata(info.Metadata))
+			object.Close()
+			if err == nil {
+				slog.Info("repaired replica", "replica", target.name, "key", key, "source", source.name)
+				repaired = true
+				break
+			}
+		}
+		if !repaired {
+			return fmt.Errorf("no good copy to repair replica %s", target.name)
+		}
+	}
+	return nil
+}
+
+func (r *ReplicatedStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	notFound := 0
+	for _, rep := range r.ordered() {
+		start := time.Now()
+		object, info, err := rep.GetRange(ctx, key, offset, length)
+		if errors.Is(err, ErrNotFound) {
+			notFound++
+			continue
+		}
+		if err != nil {
+			rep.failed(err)
+			continue
+		}
+		rep.succeeded(time.Since(start))
+		return object, info, nil
+	}
+	if notFound == len(r.replicas) {
+		return nil, nil, ErrNotFound
+	}
+	return nil, nil, errors.New("no replica could serve the object")
+}
+
+func (r *ReplicatedStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	notFound := 0
+	for _, rep := range r.ordered() {
+		info, err := rep.Stat(ctx, key)
+		if errors.Is(err, ErrNotFound) {
+			notFound++
+			continue
+		}
+		if err != nil {
+			rep.failed(err)
+			continue
+		}
+		return info, nil
+	}
+	if notFound == len(r.replicas) {
+		return nil, ErrNotFound
+	}
+	return nil, errors.New("no replica could stat the object")
+}
+
+func (r *ReplicatedStore) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	var errs []error
+	for _, rep := range r.replicas {
+		err := rep.UpdateMetadata(ctx, key, metadata)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *ReplicatedStore) Delete(ctx context.Context, key string) error {
+	var errs []error
+	for _, rep := range r.replicas {
+		err := rep.Put(ctx, tombstonePrefix+key, bytes.NewReader(nil), 0, nil)
+		if err == nil {
+			err = rep.Delete(ctx, key)
+		}
+		if err != nil {
+			rep.failed(err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// List reports every object held by at least one replica once
+func (r *ReplicatedStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	seen := make(map[string]struct{})
+	for _, rep := range r.replicas {
+		err := rep.List(ctx, func(object ObjectInfo) error {
+			if _, ok := seen[object.Key]; ok || strings.HasPrefix(object.Key, tombstonePrefix) {
+				return nil
+			}
+			seen[object.Key] = struct{}{}
+			return fn(object)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicaCopy is an object held by a replica, as listed by Reconcile
+type replicaCopy struct {
+	rep      *replica
+	modified time.Time
+}
+
+// Reconcile walks every replica and copies objects onto the replicas
+// that miss them, it brings a replica up to date after an outage. Copies
+// older than the tombstone of their key were missed by a delete and are
+// deleted instead.
+func (r *ReplicatedStore) Reconcile(ctx context.Context) error {
+	holders := make(map[string][]replicaCopy)
+	tombstones := make(map[string]time.Time)
+	for _, rep := range r.replicas {
+		err := rep.List(ctx, func(object ObjectInfo) error {
+			if key, ok := strings.CutPrefix(object.Key, tombstonePrefix); ok {
+				if object.LastModified.After(tombstones[key]) {
+					tombstones[key] = object.LastModified
+				}
+				return nil
+			}
+			holders[object.Key] = append(holders[object.Key], replicaCopy{rep: rep, modified: object.LastModified})
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("listing replica %s: %w", rep.name, err)
+		}
+	}
+
+	for key, deleted := range tombstones {
+		holders[key] = r.buryStale(ctx, key, deleted, holders[key])
+		if len(holders[key]) == 0 {
+			delete(holders, key)
+		}
+	}
+
+	repaired, failed := 0, 0
+	for key, present := range holders {
+		if len(present) == len(r.replicas) {
+			continue
+		}
+		var targets []*replica
+		for _, rep := range r.replicas {
+			if !holdsCopy(present, rep) {
+				targets = append(targets, rep)
+			}
+		}
+		if err := r.repair(ctx, key, targets); err != nil {
+			slog.Error("error reconciling replicas", "key", key, "error", err.Error())
+			failed++
+			continue
+		}
+		repaired++
+	}
+	slog.Info("replica reconcile done", "objects", len(holders), "repaired", repaired, "failed", failed)
+	return ctx.Err()
+}
+
+// buryStale deletes the copies of key written before it was deleted and
+// returns the ones left, an upload since the delete keeps its copies. The
+// tombstones go once no stale copy is left.
+func (r *ReplicatedStore) buryStale(ctx context.Context, key string, deleted time.Time, copies []replicaCopy) []replicaCopy {
+	var live []replicaCopy
+	buried := true
+	for _, c := range copies {
+		if c.modified.After(deleted) {
+			live = append(live, c)
+			continue
+		}
+		if err := c.rep.Delete(ctx, key); err != nil {
+			slog.Error("error deleting stale replica copy", "replica", c.rep.name, "key", key, "error", err.Error())
+			buried = false
+			continue
+		}
+		slog.Info("deleted stale replica copy", "replica", c.rep.name, "key", key)
+	}
+	if !buried {
+		return live
+	}
+	for _, rep := range r.replicas {
+		if err := rep.Delete(ctx, tombstonePrefix+key); err != nil {
+			slog.Error("error deleting tombstone", "replica", rep.name, "key", key, "error", err.Error())
+		}
+	}
+	return live
+}
+
+func holdsCopy(copies []replicaCopy, rep *replica) bool {
+	for i := range copies {
+		if copies[i].rep == rep {
+			return true
+		}
+	}
+	return false
+}
+
+// StartReconciler reconciles every interval, and right away whenever a
+// replica that was failing answers the periodic probe again
+func (r *ReplicatedStore) StartReconciler(ctx context.Context, interval time.Duration, probeInterval time.Duration) {
+	reconcileTicker := time.NewTicker(interval)
+	probeTicker := time.NewTicker(probeInterval)
+
+	go func() {
+		for {
+			select {
+			case <-reconcileTicker.C:
+				if err := r.Reconcile(ctx); err != nil {
+					slog.Error("error reconciling replicas", "error", err.Error())
+				}
+
+			case <-probeTicker.C:
+				if !r.probe(ctx) {
+					continue
+				}
+				if err := r.Reconcile(ctx); err != nil {
+					slog.Error("error reconciling replicas", "error", err.Error())
+				}
+
+			case <-ctx.Done():
+				reconcileTicker.Stop()
+				probeTicker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// probe checks the failing replicas and reports whether one recovered
+func (r *ReplicatedStore) probe(ctx context.Context) bool {
+	recovered := false
+	for _, rep := range r.replicas {
+		if rep.healthy() {
+			continue
+		}
+		_, err := rep.Stat(ctx, replicaProbeKey)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			continue
+		}
+		slog.Info("replica is back", "replica", rep.name)
+		rep.recovered()
+		recovered = true
+	}
+	return recovered
+}
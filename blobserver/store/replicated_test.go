@@ -0,0 +1,102 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// unreachableStore fails the deletes of its ChunkStore while down
+type unreachableStore struct {
+	ChunkStore
+	down bool
+}
+
+func (u *unreachableStore) Delete(ctx context.Context, key string) error {
+	if u.down {
+		return errors.New("replica unreachable")
+	}
+	return u.ChunkStore.Delete(ctx, key)
+}
+
+func TestReconcileKeepsMetadataAndDeletes(t *testing.T) {
+	ctx := context.Background()
+	a, b := NewMemoryStore(), &unreachableStore{ChunkStore: NewMemoryStore()}
+	r, err := NewReplicatedStore([]ChunkStore{a, b}, []string{"a", "b"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, deleted := testKey(t, "kept"), testKey(t, "deleted")
+
+	// written while b was away
+	if err := a.Put(ctx, kept.String(), strings.NewReader("kept"), 4, map[string]string{MetaReserved: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Put(ctx, deleted.String(), strings.NewReader("deleted"), 7, nil); err != nil {
+		t.Fatal(err)
+	}
+	// b misses the delete
+	b.down = true
+	if err := r.Delete(ctx, deleted.String()); err == nil {
+		t.Fatal("Delete succeeded on an unreachable replica")
+	}
+	b.down = false
+
+	if err := r.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	info, err := b.Stat(ctx, kept.String())
+	if err != nil {
+		t.Fatalf("the object wasn't copied to b: %v", err)
+	}
+	if info.Metadata[MetaReserved] != "1" {
+		t.Errorf("the copy lost its metadata: %v", info.Metadata)
+	}
+	for name, replica := range map[string]ChunkStore{"a": a, "b": b} {
+		if _, err := replica.Stat(ctx, deleted.String()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the deleted object is back on %s: %v", name, err)
+		}
+		if _, err := replica.Stat(ctx, tombstonePrefix+deleted.String()); !errors.Is(err, ErrNotFound) {
+			t.Errorf("the tombstone stayed on %s: %v", name, err)
+		}
+	}
+}
+
+func TestReconcileKeepsUploadsAfterDelete(t *testing.T) {
+	ctx := context.Background()
+	a, b := NewMemoryStore(), NewMemoryStore()
+	r, err := NewReplicatedStore([]ChunkStore{a, b}, []string{"a", "b"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testKey(t, "again")
+	if err := r.Put(ctx, key.String(), strings.NewReader("again"), 5, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(ctx, key.String()); err != nil {
+		t.Fatal(err)
+	}
+	// uploaded again while b was away
+	if err := a.Put(ctx, key.String(), strings.NewReader("again"), 5, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var listed []string
+	err = r.List(ctx, func(info ObjectInfo) error {
+		listed = append(listed, info.Key)
+		return nil
+	})
+	if err != nil || len(listed) != 1 || listed[0] != key.String() {
+		t.Errorf("List = %v, %v, want only %s", listed, err, key)
+	}
+
+	if err := r.Reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for name, replica := range map[string]ChunkStore{"a": a, "b": b} {
+		if _, err := replica.Stat(ctx, key.String()); err != nil {
+			t.Errorf("the upload after the delete is gone from %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object doesn't exist")
+
+// Keys of the object metadata written by the store wrappers
+const (
+	MetaEncoding = "encoding"
+	MetaSize     = "size"
+)
+
+// ObjectInfo describes a stored object without its content
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	// Metadata holds small string values stored along with the
+	// object, keys are always lower case
+	Metadata map[string]string
+}
+
+// ChunkStore is implemented by every storage backend of blobserver.
+// Objects are immutable once written, a Put only becomes visible after
+// data has been read to the end without error.
+type ChunkStore interface {
+	Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error
+	// Get returns ErrNotFound if there is no object named key,
+	// the caller must close the returned reader
+	Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error)
+	// GetRange is Get limited to length bytes starting at offset,
+	// a negative length reads to the end of the object
+	GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	// UpdateMetadata replaces the metadata of an object without
+	// rewriting its content
+	UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error
+	// Delete doesn't fail when the object is already gone
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every stored object until fn returns an error
+	List(ctx context.Context, fn func(ObjectInfo) error) error
+}
+
+// accessTracker is implemented by stores that have to know
+// about the reads a wrapper above them answered on its own
+type accessTracker interface {
+	Touch(key string)
+}
+
+// portableMetadata drops what the wrappers recorded about how they stored
+// an object, it describes the stored copy and not the object itself
+func portableMetadata(metadata map[string]string) map[string]string {
+	portable := make(map[string]string)
+	for k, v := range metadata {
+		switch k {
+		case MetaEncoding, MetaSize, MetaCipher, MetaKeyID, MetaWrappedKey:
+		default:
+			portable[k] = v
+		}
+	}
+	return portable
+}
+
+// sliceReader turns a reader over a whole object into one over a range,
+// for stores that can't seek into their objects
+func sliceReader(object io.ReadCloser, offset int64, length int64) (io.ReadCloser, error) {
+	_, err := io.CopyN(io.Discard, object, offset)
+	if err != nil {
+		object.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return object, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(object, length), object}, nil
+}
@@ -0,0 +1,335 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/melsonic/skyvault/blobserver/digest"
+)
+
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+
+	// tierAccessKey holds the last access times between restarts
+	tierAccessKey = "tier-access"
+	// tierPromotions bounds the promotions running in the background
+	tierPromotions = 4
+)
+
+type untrackedKey struct{}
+
+// Untracked marks reads that shouldn't count as an access,
+// like the ones of the scrubber
+func Untracked(ctx context.Context) context.Context {
+	return context.WithValue(ctx, untrackedKey{}, true)
+}
+
+func isUntracked(ctx context.Context) bool {
+	untracked, _ := ctx.Value(untrackedKey{}).(bool)
+	return untracked
+}
+
+type TierReport struct {
+	Demoted  int
+	Promoted int
+	Errors   int
+}
+
+// TieredStore keeps recently read objects in the wrapped hot store and
+// moves the ones nobody read for ColdAfter to the cold store. Reads fall
+// back to the cold store, and when Promote is set bring the object back
+// unless it is pinned to TierCold.
+// Last accesses are kept in memory and saved with every Migrate, objects
+// never read since use their modification time.
+type TieredStore struct {
+	ChunkStore
+	cold      ChunkStore
+	ColdAfter time.Duration
+	Promote   bool
+	// Overrides returns the objects whose tier is decided per file,
+	// pinned to TierHot or sent to TierCold right away
+	Overrides func(ctx context.Context) (map[string]string, error)
+
+	mu         sync.Mutex
+	lastAccess map[string]time.Time
+	// pinnedCold holds the objects overridden to TierCold as of the last
+	// Migrate, reads don't promote them
+	pinnedCold map[string]bool
+	promotions chan struct{}
+}
+
+func NewTieredStore(hot ChunkStore, cold ChunkStore, coldAfter time.Duration, promote bool) (*TieredStore, error) {
+	t := &TieredStore{
+		ChunkStore: hot,
+		cold:       cold,
+		ColdAfter:  coldAfter,
+		Promote:    promote,
+		lastAccess: make(map[string]time.Time),
+		promotions: make(chan struct{}, tierPromotions),
+	}
+	object, _, err := hot.Get(context.Background(), tierAccessKey)
+	if errors.Is(err, ErrNotFound) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	if err := json.NewDecoder(object).Decode(&t.lastAccess); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Touch records a read of key, wrappers answering reads
+// themselves call it so the object stays hot
+func (t *TieredStore) Touch(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastAccess[key] = time.Now()
+}
+
+func (t *TieredStore) isPinnedCold(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pinnedCold[key]
+}
+
+func (t *TieredStore) touch(ctx context.Context, key string) {
+	if !isUntracked(ctx) {
+		t.Touch(key)
+	}
+}
+
+func (t *TieredStore) Get(ctx context.Context, key string) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := t.ChunkStore.Get(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		object, info, err = t.cold.Get(ctx, key)
+		if err == nil && t.Promote && !isUntracked(ctx) && !t.isPinnedCold(key) {
+			t.promoteInBackground(key)
+		}
+	}
+	if err == nil {
+		t.touch(ctx, key)
+	}
+	return object, info, err
+}
+
+func (t *TieredStore) GetRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, *ObjectInfo, error) {
+	object, info, err := t.ChunkStore.GetRange(ctx, key, offset, length)
+	if errors.Is(err, ErrNotFound) {
+		object, info, err = t.cold.GetRange(ctx, key, offset, length)
+	}
+	if err == nil {
+		t.touch(ctx, key)
+	}
+	return object, info, err
+}
+
+func (t *TieredStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	info, err := t.ChunkStore.Stat(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return t.cold.Stat(ctx, key)
+	}
+	return info, err
+}
+
+func (t *TieredStore) Put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	err := t.ChunkStore.Put(ctx, key, data, size, metadata)
+	if err == nil {
+		t.touch(ctx, key)
+	}
+	return err
+}
+
+func (t *TieredStore) UpdateMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	err := t.ChunkStore.UpdateMetadata(ctx, key, metadata)
+	if errors.Is(err, ErrNotFound) {
+		return t.cold.UpdateMetadata(ctx, key, metadata)
+	}
+	return err
+}
+
+func (t *TieredStore) Delete(ctx context.Context, key string) error {
+	t.mu.Lock()
+	delete(t.lastAccess, key)
+	t.mu.Unlock()
+	return errors.Join(t.ChunkStore.Delete(ctx, key), t.cold.Delete(ctx, key))
+}
+
+// List reports the objects of both tiers once
+func (t *TieredStore) List(ctx context.Context, fn func(ObjectInfo) error) error {
+	seen := make(map[string]struct{})
+	err := t.ChunkStore.List(ctx, func(object ObjectInfo) error {
+		if object.Key == tierAccessKey {
+			return nil
+		}
+		seen[object.Key] = struct{}{}
+		return fn(object)
+	})
+	if err != nil {
+		return err
+	}
+	return t.cold.List(ctx, func(object ObjectInfo) error {
+		if _, ok := seen[object.Key]; ok {
+			return nil
+		}
+		return fn(object)
+	})
+}
+
+func (t *TieredStore) promoteInBackground(key string) {
+	select {
+	case t.promotions <- struct{}{}:
+	default:
+		// busy, the next read tries again
+		return
+	}
+	go func() {
+		defer func() { <-t.promotions }()
+		if err := move(context.Background(), t.cold, t.ChunkStore, key); err != nil {
+			slog.Error("error promoting object", "key", key, "error", err.Error())
+		}
+	}()
+}
+
+// move copies key from one tier to the other and deletes the source copy
+// once the destination holds it, chunks are checked against their hash
+func move(ctx context.Context, from ChunkStore, to ChunkStore, key string) error {
+	object, info, err := from.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer object.Close()
+	var content io.Reader = object
+	if parsed, err := digest.ParseKey(key); err == nil {
+		content = digest.NewReader(object, parsed, info.Size)
+	}
+	if err := to.Put(ctx, key, content, info.Size, portableMetadata(info.Metadata)); err != nil {
+		return err
+	}
+	return from.Delete(ctx, key)
+}
+
+// Migrate moves the hot objects last read more than ColdAfter ago, and the
+// ones overridden to TierCold, to the cold store. Objects overridden to
+// TierHot are brought back.
+func (t *TieredStore) Migrate(ctx context.Context) (*TierReport, error) {
+	overrides := map[string]string{}
+	if t.Overrides != nil {
+		var err error
+		overrides, err = t.Overrides(ctx)
+		if err != nil {
+			// without them pinned objects could end up cold
+			return nil, err
+		}
+	}
+	pinnedCold := make(map[string]bool)
+	for key, tier := range overrides {
+		if tier == TierCold {
+			pinnedCold[key] = true
+		}
+	}
+	t.mu.Lock()
+	t.pinnedCold = pinnedCold
+	t.mu.Unlock()
+
+	cutoff := time.Now().Add(-t.ColdAfter)
+	var demote []string
+	err := t.ChunkStore.List(ctx, func(object ObjectInfo) error {
+		if object.Key == tierAccessKey {
+			return nil
+		}
+		switch overrides[object.Key] {
+		case TierHot:
+			return nil
+		case TierCold:
+			demote = append(demote, object.Key)
+			return nil
+		}
+		t.mu.Lock()
+		lastAccess, ok := t.lastAccess[object.Key]
+		t.mu.Unlock()
+		if !ok {
+			lastAccess = object.LastModified
+		}
+		if lastAccess.Before(cutoff) {
+			demote = append(demote, object.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &TierReport{}
+	for _, key := range demote {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		if err := move(ctx, t.ChunkStore, t.cold, key); err != nil {
+			slog.Error("error moving object to the cold tier", "key", key, "error", err.Error())
+			report.Errors++
+			continue
+		}
+		t.mu.Lock()
+		delete(t.lastAccess, key)
+		t.mu.Unlock()
+		report.Demoted++
+	}
+	for key, tier := range overrides {
+		if tier != TierHot {
+			continue
+		}
+		if _, err := t.cold.Stat(ctx, key); err != nil {
+			continue
+		}
+		if err := move(ctx, t.cold, t.ChunkStore, key); err != nil {
+			slog.Error("error moving object to the hot tier", "key", key, "error", err.Error())
+			report.Errors++
+			continue
+		}
+		report.Promoted++
+	}
+	return report, t.saveAccess(ctx)
+}
+
+func (t *TieredStore) saveAccess(ctx context.Context) error {
+	t.mu.Lock()
+	content, err := json.Marshal(t.lastAccess)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return t.ChunkStore.Put(ctx, tierAccessKey, bytes.NewReader(content), int64(len(content)), nil)
+}
+
+// StartMigrator runs Migrate every interval
+func (t *TieredStore) StartMigrator(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				report, err := t.Migrate(ctx)
+				if err != nil {
+					slog.Error("error migrating objects between tiers", "error", err.Error())
+					continue
+				}
+				slog.Info("tier migration done", "demoted", report.Demoted, "promoted", report.Promoted, "errors", report.Errors)
+
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTieredStoreDoesNotPromotePinnedCold(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := NewMemoryStore(), NewMemoryStore()
+	tiered, err := NewTieredStore(hot, cold, time.Nanosecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned, idle := testKey(t, "pinned"), testKey(t, "idle")
+	tiered.Overrides = func(ctx context.Context) (map[string]string, error) {
+		return map[string]string{pinned.String(): TierCold}, nil
+	}
+	for key, content := range map[string]string{pinned.String(): "pinned", idle.String(): "idle"} {
+		if err := tiered.Put(ctx, key, strings.NewReader(content), int64(len(content)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := tiered.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{pinned.String(), idle.String()} {
+		object, _, err := tiered.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, object)
+		object.Close()
+	}
+	// the idle object comes back on its own
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := hot.Stat(ctx, idle.String()); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the idle object wasn't promoted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := hot.Stat(ctx, pinned.String()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("the object pinned cold was promoted: %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package types
 
+import "time"
+
 type BlobData struct {
 	Hash string `json:"hash"`
 	Data []byte `json:"data"`
@@ -9,3 +11,34 @@ type BlobDataResponse struct {
 	Data    []byte `json:"data"`
 	Message string `json:"message"`
 }
+
+type MissingChunksRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+type MissingChunksResponse struct {
+	Missing []string `json:"missing"`
+}
+
+// ChunkUploadsRequest tells metadata that Email uploaded the chunks
+type ChunkUploadsRequest struct {
+	Email  string   `json:"email"`
+	Hashes []string `json:"hashes"`
+}
+
+// ReadableChunksResponse lists the requested chunks the caller can read
+type ReadableChunksResponse struct {
+	Readable []string `json:"readable"`
+}
+
+// ChunkInfo is one line of the GET /chunks listing
+type ChunkInfo struct {
+	Hash         string    `json:"hash"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ChunkTiersResponse maps chunks to the tier their files are pinned to
+type ChunkTiersResponse struct {
+	Tiers map[string]string `json:"tiers"`
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/melsonic/skyvault/metadata/db"
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// writeAccessError answers the errors of the sharing handlers
+func writeAccessError(w http.ResponseWriter, nodeID string, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, db.ErrInvalidRole), errors.Is(err, db.ErrInvalidGrant):
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		slog.Error("error handling access", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// accessListHandler lists who a file or folder is shared with
+func accessListHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleOwner)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	entries, err := db.ListAccess(owner, nodeID)
+	if err != nil {
+		writeAccessError(w, nodeID, err)
+		return
+	}
+	writeJSON(w, types.AccessResponse{Entries: entries})
+}
+
+// accessGrantHandler shares a file or folder with the user {email} under
+// the role of the body, folders are shared with everything below them
+func accessGrantHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	owner, ok := authorize(w, caller, nodeID, db.RoleOwner)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	var request types.AccessRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+	err = db.GrantAccess(owner, nodeID, r.PathValue("email"), request.Role, caller)
+	if err != nil {
+		writeAccessError(w, nodeID, err)
+		return
+	}
+	w.Write([]byte("access granted!"))
+}
+
+// accessRevokeHandler stops sharing a file or folder with the user {email}
+func accessRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleOwner)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	err := db.RevokeAccess(owner, nodeID, r.PathValue("email"))
+	if err != nil {
+		writeAccessError(w, nodeID, err)
+		return
+	}
+	w.Write([]byte("access revoked!"))
+}
+
+// sharedHandler lists the files and folders other users shared with the caller
+func sharedHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	shared, err := db.SharedWith(caller)
+	if err != nil {
+		slog.Error("error listing shared nodes", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, types.SharedResponse{Shared: shared})
+}
+
+// chunkAccessHandler tells blobserver whether the caller can read a chunk,
+// it can when one of the files built from it is readable to the caller
+func chunkAccessHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	hash := r.PathValue("hash")
+	readable, err := db.CanReadChunk(caller, hash)
+	if err != nil {
+		slog.Error("error checking chunk access", "hash", hash, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !readable {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("no readable file uses this chunk"))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// readableHashes answers 403 unless the caller can read every chunk of a
+// file they save, otherwise knowing a hash would be enough to get a chunk
+func readableHashes(w http.ResponseWriter, caller string, hashes []string) bool {
+	unreadable, err := db.UnreadableChunks(caller, hashes)
+	if err != nil {
+		slog.Error("error checking chunk access", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return false
+	}
+	if len(unreadable) > 0 {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("chunk " + unreadable[0] + " was neither uploaded by nor shared with the caller"))
+		return false
+	}
+	return true
+}
+
+// chunkUploadsHandler records the chunks a user sent to blobserver
+func chunkUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	var request types.ChunkUploadsRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil || request.Email == "" || len(request.Hashes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+	if err := db.RecordUploads(request.Email, request.Hashes); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// readableChunksHandler tells which of the requested chunks the caller can
+// read, blobserver only reports those as present to users
+func readableChunksHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	var request types.ChunkFilesRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+	unreadable, err := db.UnreadableChunks(caller, request.Hashes)
+	if err != nil {
+		slog.Error("error checking chunk access", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	refused := make(map[string]bool, len(unreadable))
+	for _, hash := range unreadable {
+		refused[hash] = true
+	}
+	readable := []string{}
+	for _, hash := range request.Hashes {
+		if !refused[hash] {
+			readable = append(readable, hash)
+		}
+	}
+	writeJSON(w, types.ReadableChunksResponse{Readable: readable})
+}
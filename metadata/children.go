@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/melsonic/skyvault/metadata/db"
+)
+
+const (
+	defaultChildrenLimit = 100
+	maxChildrenLimit     = 1000
+)
+
+// childrenQuery reads the listing options of the query string: limit,
+// cursor, sort (name, size or modified), order (asc or desc), folders=true,
+// ext and the tag and prop filters of propertyFilter. It answers 400 itself
+// when one is invalid.
+func childrenQuery(w http.ResponseWriter, r *http.Request) (db.ChildrenQuery, bool) {
+	params := r.URL.Query()
+	query := db.ChildrenQuery{
+		Sort:        db.SortByName,
+		Limit:       defaultChildrenLimit,
+		FoldersOnly: params.Get("folders") == "true",
+		Cursor:      params.Get("cursor"),
+	}
+	if sort := params.Get("sort"); sort != "" {
+		query.Sort = sort
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.Descending = true
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("order must be asc or desc"))
+		return query, false
+	}
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxChildrenLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("invalid limit"))
+			return query, false
+		}
+		query.Limit = value
+	}
+	if ext := params.Get("ext"); ext != "" {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		query.Extension = ext
+	}
+	filter, ok := propertyFilter(w, r)
+	if !ok {
+		return query, false
+	}
+	query.Filter = filter
+	return query, true
+}
+
+// childrenHandler lists a folder a page at a time, nodeid "root" lists the
+// caller's root. See childrenQuery for the query parameters.
+func childrenHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleViewer)
+	if !ok {
+		return
+	}
+	query, ok := childrenQuery(w, r)
+	if !ok {
+		return
+	}
+	writeChildren(w, owner, r.PathValue("nodeid"), query)
+}
+
+// writeChildren answers a page of the folder nodeID
+func writeChildren(w http.ResponseWriter, owner string, nodeID string, query db.ChildrenQuery) {
+	children, err := db.ListChildren(owner, nodeID, query)
+	if errors.Is(err, db.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, db.ErrInvalidCursor) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		slog.Error("error listing folder", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	response, err := json.Marshal(children)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
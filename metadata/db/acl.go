@@ -0,0 +1,417 @@
+package db
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/melsonic/skyvault/metadata/types"
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+// roles of an access control entry, each one allows what the ones before do
+const (
+	RoleViewer = "viewer"
+	// comments aren't kept by this service, commenters read like viewers
+	RoleCommenter = "commenter"
+	RoleEditor    = "editor"
+	// owners of a subtree share it further
+	RoleOwner = "owner"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer:    1,
+	RoleCommenter: 2,
+	RoleEditor:    3,
+	RoleOwner:     4,
+}
+
+var (
+	ErrForbidden    = errors.New("not allowed on this node")
+	ErrInvalidRole  = errors.New("role is viewer, commenter, editor or owner")
+	ErrInvalidGrant = errors.New("invalid grantee")
+	ErrInvalidID    = errors.New("invalid node id")
+)
+
+// IsRole tells whether role is one of the roles of an access control entry
+func IsRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// effectiveRole returns the role user holds on nodeID: the one of the entry
+// closest above it, an entry lower in the tree overrides the ones above.
+// It is empty when nothing is shared with user.
+func effectiveRole(q rowQuerier, user string, nodeID int64) (string, error) {
+	var role string
+	err := q.QueryRow(`
+		WITH RECURSIVE ANCESTORS (ID, PARENT_FOLDER, DEPTH) AS (
+			SELECT ID, PARENT_FOLDER, 0 FROM NODE WHERE ID = $1
+			UNION ALL
+			SELECT NODE.ID, NODE.PARENT_FOLDER, ANCESTORS.DEPTH + 1 FROM NODE JOIN ANCESTORS ON NODE.ID = ANCESTORS.PARENT_FOLDER
+		)
+		SELECT
+			NODE_ACL.ROLE
+		FROM
+			ANCESTORS
+			JOIN NODE_ACL ON NODE_ACL.NODE_ID = ANCESTORS.ID
+		WHERE
+			NODE_ACL.GRANTEE = $2
+		ORDER BY
+			ANCESTORS.DEPTH
+		LIMIT 1
+	`, nodeID, user).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		slog.Error("error fetching role", "error", err.Error(), "id", nodeID)
+		return "", errors.New("error checking access")
+	}
+	return role, nil
+}
+
+// Authorize checks that user holds at least role on nodeID and returns the
+// owner of the tree the node is in, the one the other functions of this
+// package take. "root" is user's own root. Nodes shared with nobody are
+// ErrNotFound, to not tell they exist.
+func Authorize(user string, nodeID string, role string) (string, error) {
+	if nodeID == ROOT_NAME {
+		return user, nil
+	}
+	id, err := strconv.ParseInt(nodeID, 10, 64)
+	if err != nil {
+		return "", ErrInvalidID
+	}
+	var owner string
+	err = DBConnPool.QueryRow(`
+		SELECT
+			OWNER
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND TRASHED_AT IS NULL
+	`, id).Scan(&owner)
+	if err == pgx.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching node owner", "error", err.Error(), "id", id)
+		return "", errors.New("error checking access")
+	}
+	if owner == user {
+		return owner, nil
+	}
+
+	held, err := effectiveRole(DBConnPool, user, id)
+	if err != nil {
+		return "", err
+	}
+	if held == "" {
+		return "", ErrNotFound
+	}
+	if roleRanks[held] < roleRanks[role] {
+		return "", ErrForbidden
+	}
+	return owner, nil
+}
+
+// NodeParent returns the folder a node of owner's tree is in
+func NodeParent(owner string, nodeID string) (string, error) {
+	var parent int64
+	err := DBConnPool.QueryRow(`
+		SELECT
+			PARENT_FOLDER
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND OWNER = $2 AND TRASHED_AT IS NULL AND PARENT_FOLDER IS NOT NULL
+	`, nodeID, owner).Scan(&parent)
+	if err == pgx.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching parent", "error", err.Error(), "id", nodeID)
+		return "", errors.New("error fetching node")
+	}
+	return strconv.FormatInt(parent, 10), nil
+}
+
+// ListAccess returns the entries giving access to a node of owner's tree,
+// the ones set on the folders above it come with Inherited
+func ListAccess(owner string, nodeID string) ([]types.AccessEntry, error) {
+	id, err := ownedNode(DBConnPool, owner, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DBConnPool.Query(`
+		WITH RECURSIVE ANCESTORS (ID, PARENT_FOLDER, DEPTH) AS (
+			SELECT ID, PARENT_FOLDER, 0 FROM NODE WHERE ID = $1
+			UNION ALL
+			SELECT NODE.ID, NODE.PARENT_FOLDER, ANCESTORS.DEPTH + 1 FROM NODE JOIN ANCESTORS ON NODE.ID = ANCESTORS.PARENT_FOLDER
+		)
+		SELECT DISTINCT ON (NODE_ACL.GRANTEE)
+			NODE_ACL.GRANTEE, NODE_ACL.ROLE, NODE_ACL.NODE_ID, NODE_ACL.GRANTED_BY, NODE_ACL.CREATED_AT
+		FROM
+			ANCESTORS
+			JOIN NODE_ACL ON NODE_ACL.NODE_ID = ANCESTORS.ID
+		ORDER BY
+			NODE_ACL.GRANTEE, ANCESTORS.DEPTH
+	`, id)
+	if err != nil {
+		slog.Error("error listing access", "error", err.Error(), "id", id)
+		return nil, errors.New("error listing access")
+	}
+	defer rows.Close()
+
+	entries := []types.AccessEntry{}
+	for rows.Next() {
+		var entry types.AccessEntry
+		var grantedOn int64
+		err := rows.Scan(&entry.Email, &entry.Role, &grantedOn, &entry.GrantedBy, &entry.CreatedAt)
+		if err != nil {
+			slog.Error("error scanning access", "error", err.Error(), "id", id)
+			return nil, errors.New("error listing access")
+		}
+		entry.NodeID = strconv.FormatInt(grantedOn, 10)
+		entry.Inherited = grantedOn != id
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error listing access", "error", err.Error(), "id", id)
+		return nil, errors.New("error listing access")
+	}
+	return entries, nil
+}
+
+// GrantAccess gives grantee role on a node of owner's tree and everything
+// below it, replacing the entry grantee had on that node
+func GrantAccess(owner string, nodeID string, grantee string, role string, grantedBy string) error {
+	if !IsRole(role) {
+		return ErrInvalidRole
+	}
+	grantee = strings.TrimSpace(grantee)
+	if !strings.Contains(grantee, "@") || grantee == owner {
+		return ErrInvalidGrant
+	}
+	id, err := ownedNode(DBConnPool, owner, nodeID)
+	if err != nil {
+		return err
+	}
+	_, err = DBConnPool.Exec(`
+		INSERT INTO NODE_ACL (NODE_ID, GRANTEE, ROLE, GRANTED_BY, CREATED_AT)
+			VALUES ($1, $2, $3, $4, current_timestamp)
+		ON CONFLICT (NODE_ID, GRANTEE) DO UPDATE SET ROLE = EXCLUDED.ROLE, GRANTED_BY = EXCLUDED.GRANTED_BY
+	`, id, grantee, role, grantedBy)
+	if err != nil {
+		slog.Error("error granting access", "error", err.Error(), "id", id)
+		return errors.New("error granting access")
+	}
+	return nil
+}
+
+// RevokeAccess deletes the entry of grantee on a node of owner's tree, the
+// ones of the folders above still apply
+func RevokeAccess(owner string, nodeID string, grantee string) error {
+	id, err := ownedNode(DBConnPool, owner, nodeID)
+	if err != nil {
+		return err
+	}
+	_, err = DBConnPool.Exec(`DELETE FROM NODE_ACL WHERE NODE_ID = $1 AND GRANTEE = $2`, id, grantee)
+	if err != nil {
+		slog.Error("error revoking access", "error", err.Error(), "id", id)
+		return errors.New("error revoking access")
+	}
+	return nil
+}
+
+// SharedWith returns the nodes of other users shared with user, the ones
+// an entry was set on
+func SharedWith(user string) ([]types.SharedNode, error) {
+	rows, err := DBConnPool.Query(`
+		SELECT
+			NODE.ID, NODE.FOLDER, NODE.NAME, COALESCE(FILE_METADATA.FILE_TYPE, ''), COALESCE(FILE_METADATA.FILE_SIZE, 0),
+			NODE.CREATED_AT, NODE.LAST_ACCESS, NODE.LAST_MODIFIED, NODE.OWNER, NODE_ACL.ROLE, NODE_ACL.GRANTED_BY, NODE_ACL.CREATED_AT
+		FROM
+			NODE_ACL
+			JOIN NODE ON NODE.ID = NODE_ACL.NODE_ID
+			LEFT JOIN FILE_METADATA ON FILE_METADATA.NODE_ID = NODE.ID
+		WHERE
+			NODE_ACL.GRANTEE = $1 AND NODE.OWNER <> $1 AND NODE.TRASHED_AT IS NULL
+		ORDER BY
+			NODE_ACL.CREATED_AT DESC, NODE.ID
+	`, user)
+	if err != nil {
+		slog.Error("error listing shared nodes", "error", err.Error())
+		return nil, errors.New("error listing shared nodes")
+	}
+	defer rows.Close()
+
+	shared := []types.SharedNode{}
+	for rows.Next() {
+		var node types.SharedNode
+		var id int64
+		err := rows.Scan(&id, &node.IsFolder, &node.Name, &node.FileType, &node.FileSize,
+			&node.CreatedAt, &node.LastAccess, &node.LastModified, &node.Owner, &node.Role, &node.SharedBy, &node.SharedAt)
+		if err != nil {
+			slog.Error("error scanning shared nodes", "error", err.Error())
+			return nil, errors.New("error listing shared nodes")
+		}
+		node.NodeID = strconv.FormatInt(id, 10)
+		shared = append(shared, node)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error listing shared nodes", "error", err.Error())
+		return nil, errors.New("error listing shared nodes")
+	}
+	return shared, nil
+}
+
+// chunkSpellings returns the ways a file may list a chunk, older files
+// list sha256 chunks by their bare hex digest as blobserver accepts
+func chunkSpellings(hash string) []string {
+	canonical := util.CanonicalHash(hash)
+	return []string{canonical, strings.TrimPrefix(canonical, util.DefaultHashAlgorithm+":")}
+}
+
+// RecordUploads remembers that user sent the content of the chunks to
+// blobserver, which proves they have it
+func RecordUploads(user string, hashes []string) error {
+	canonical := make([]string, len(hashes))
+	for i := range hashes {
+		canonical[i] = util.CanonicalHash(hashes[i])
+	}
+	_, err := DBConnPool.Exec(`
+		INSERT INTO CHUNK_UPLOAD (HASH, UPLOADER, CREATED_AT)
+			SELECT DISTINCT unnest($1::text[]), $2, current_timestamp
+		ON CONFLICT (HASH, UPLOADER) DO NOTHING
+	`, canonical, user)
+	if err != nil {
+		slog.Error("error recording uploads", "error", err.Error())
+		return errors.New("error recording uploads")
+	}
+	return nil
+}
+
+// readableChunks returns the canonical hashes of the chunks of hashes user
+// uploaded, or can read a file or a version of one built from. Every
+// chunk is checked by one query: the files using them are walked up to
+// the root of their tree, and any entry of user on the way gives read
+// access. Only the trees of owners who shared something with user are walked.
+func readableChunks(user string, hashes []string) (map[string]bool, error) {
+	var canonical, spellings, spelledHashes []string
+	seen := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		hash = util.CanonicalHash(hash)
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		canonical = append(canonical, hash)
+		for _, spelling := range chunkSpellings(hash) {
+			spellings = append(spellings, spelling)
+			spelledHashes = append(spelledHashes, hash)
+		}
+	}
+
+	rows, err := DBConnPool.Query(`
+		WITH RECURSIVE SPELLING (SPELLING, HASH) AS (
+			SELECT * FROM unnest($1::text[], $2::text[])
+		),
+		CANDIDATE (HASH, NODE_ID) AS (
+			SELECT SPELLING.HASH, USES.NODE_ID FROM (
+				SELECT NODE_ID, unnest(HASH_IDS) AS SPELLING FROM FILE_METADATA WHERE HASH_IDS && $1::text[]
+				UNION
+				SELECT NODE_ID, unnest(HASH_IDS) AS SPELLING FROM FILE_VERSION WHERE HASH_IDS && $1::text[]
+			) USES JOIN SPELLING ON SPELLING.SPELLING = USES.SPELLING
+		),
+		ANCESTORS (FILE_ID, ID, PARENT_FOLDER) AS (
+			SELECT ID, ID, PARENT_FOLDER FROM NODE
+			WHERE
+				ID IN (SELECT NODE_ID FROM CANDIDATE) AND TRASHED_AT IS NULL AND OWNER IN (
+					SELECT NODE.OWNER FROM NODE_ACL JOIN NODE ON NODE.ID = NODE_ACL.NODE_ID WHERE NODE_ACL.GRANTEE = $3
+				)
+			UNION ALL
+			SELECT ANCESTORS.FILE_ID, NODE.ID, NODE.PARENT_FOLDER FROM NODE JOIN ANCESTORS ON NODE.ID = ANCESTORS.PARENT_FOLDER
+		)
+		SELECT
+			HASH
+		FROM
+			CHUNK_UPLOAD
+		WHERE
+			UPLOADER = $3 AND HASH = ANY($4::text[])
+		UNION
+		SELECT
+			CANDIDATE.HASH
+		FROM
+			CANDIDATE
+			JOIN NODE ON NODE.ID = CANDIDATE.NODE_ID
+		WHERE
+			NODE.OWNER = $3
+		UNION
+		SELECT
+			CANDIDATE.HASH
+		FROM
+			CANDIDATE
+			JOIN ANCESTORS ON ANCESTORS.FILE_ID = CANDIDATE.NODE_ID
+			JOIN NODE_ACL ON NODE_ACL.NODE_ID = ANCESTORS.ID
+		WHERE
+			NODE_ACL.GRANTEE = $3
+	`, spellings, spelledHashes, user, canonical)
+	if err != nil {
+		slog.Error("error checking chunk access", "error", err.Error())
+		return nil, errors.New("error checking access")
+	}
+	defer rows.Close()
+
+	readable := make(map[string]bool)
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			slog.Error("error scanning readable chunk", "error", err.Error())
+			return nil, errors.New("error checking access")
+		}
+		readable[hash] = true
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error checking chunk access", "error", err.Error())
+		return nil, errors.New("error checking access")
+	}
+	return readable, nil
+}
+
+// UnreadableChunks returns the hashes user can't read, knowing the hash of
+// a chunk isn't enough to put it in a file
+func UnreadableChunks(user string, hashes []string) ([]string, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	readable, err := readableChunks(user, hashes)
+	if err != nil {
+		return nil, err
+	}
+	var unreadable []string
+	checked := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		if checked[hash] {
+			continue
+		}
+		checked[hash] = true
+		if !readable[util.CanonicalHash(hash)] {
+			unreadable = append(unreadable, hash)
+		}
+	}
+	return unreadable, nil
+}
+
+// CanReadChunk tells whether user uploaded the chunk hash, or can read a
+// file or a version of one built from it
+func CanReadChunk(user string, hash string) (bool, error) {
+	readable, err := readableChunks(user, []string{hash})
+	if err != nil {
+		return false, err
+	}
+	return readable[util.CanonicalHash(hash)], nil
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// testFile saves a file of owner at path/name built from hashes
+func testFile(t *testing.T, owner string, path string, name string, hashes ...string) string {
+	t.Helper()
+	data := types.Metadata{FileName: name, FilePath: path, Hashes: hashes, FileSize: 1}
+	id, err := SaveMetadata(owner, &data)
+	if err != nil {
+		t.Fatalf("saving %s/%s: %v", path, name, err)
+	}
+	return strconv.Itoa(id)
+}
+
+// testFolder makes the folders of path in owner's tree and returns the last one
+func testFolder(t *testing.T, owner string, path string) string {
+	t.Helper()
+	id, err := MakeFolders(owner, path)
+	if err != nil {
+		t.Fatalf("making %s: %v", path, err)
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+func TestAuthorizeInheritsAndOverrides(t *testing.T) {
+	testDB(t)
+	const alice, bob, carol = "alice@example.com", "bob@example.com", "carol@example.com"
+	projects := testFolder(t, alice, "/projects")
+	secret := testFolder(t, alice, "/projects/secret")
+	plan := testFile(t, alice, "/projects/secret", "plan.txt", strings.Repeat("a", 64))
+
+	if err := GrantAccess(alice, projects, bob, RoleEditor, alice); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := Authorize(bob, plan, RoleEditor)
+	if err != nil || owner != alice {
+		t.Fatalf("Authorize of a file below a shared folder = %q, %v, want %q", owner, err, alice)
+	}
+
+	// an entry lower in the tree overrides the inherited one, even downwards
+	if err := GrantAccess(alice, secret, bob, RoleViewer, alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authorize(bob, plan, RoleEditor); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Authorize editor below a viewer entry = %v, want %v", err, ErrForbidden)
+	}
+	if _, err := Authorize(bob, plan, RoleViewer); err != nil {
+		t.Errorf("Authorize viewer below a viewer entry = %v", err)
+	}
+	if _, err := Authorize(bob, projects, RoleEditor); err != nil {
+		t.Errorf("Authorize editor above the viewer entry = %v", err)
+	}
+
+	if err := RevokeAccess(alice, secret, bob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authorize(bob, plan, RoleEditor); err != nil {
+		t.Errorf("Authorize once the override is revoked = %v", err)
+	}
+
+	if _, err := Authorize(carol, plan, RoleViewer); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Authorize of a node shared with someone else = %v, want %v", err, ErrNotFound)
+	}
+	if _, err := Authorize(bob, "plan", RoleViewer); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("Authorize of a malformed id = %v, want %v", err, ErrInvalidID)
+	}
+	if owner, err := Authorize(bob, ROOT_NAME, RoleOwner); err != nil || owner != bob {
+		t.Errorf("Authorize of the root = %q, %v, want %q", owner, err, bob)
+	}
+}
+
+func TestCanReadChunk(t *testing.T) {
+	testDB(t)
+	const alice, bob, carol = "alice@example.com", "bob@example.com", "carol@example.com"
+	shared, uploaded := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	folder := testFolder(t, alice, "/shared")
+	testFile(t, alice, "/shared", "a.txt", "sha256:"+shared)
+
+	readable := func(user string, hash string) bool {
+		t.Helper()
+		ok, err := CanReadChunk(user, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !readable(alice, shared) {
+		t.Error("the owner of a file can't read its chunk")
+	}
+	if readable(bob, "sha256:"+shared) {
+		t.Error("knowing the hash of a chunk is enough to read it")
+	}
+	unreadable, err := UnreadableChunks(bob, []string{"sha256:" + shared, "sha256:" + shared})
+	if err != nil || len(unreadable) != 1 {
+		t.Errorf("UnreadableChunks = %v, %v, want the chunk once", unreadable, err)
+	}
+
+	if err := GrantAccess(alice, folder, bob, RoleViewer, alice); err != nil {
+		t.Fatal(err)
+	}
+	// files may list a chunk by its bare hex digest
+	if !readable(bob, shared) || !readable(bob, "SHA256:"+strings.ToUpper(shared)) {
+		t.Error("a viewer of the file can't read its chunk")
+	}
+
+	if err := RecordUploads(carol, []string{uploaded}); err != nil {
+		t.Fatal(err)
+	}
+	if !readable(carol, "sha256:"+uploaded) {
+		t.Error("the uploader of a chunk can't read it")
+	}
+	if readable(bob, uploaded) {
+		t.Error("someone else's upload is readable")
+	}
+	if err := ForgetChunk("sha256:" + uploaded); err != nil {
+		t.Fatal(err)
+	}
+	if readable(carol, uploaded) {
+		t.Error("the upload of a swept chunk still grants access")
+	}
+
+	// a file of bob's own, even trashed, and one of a tree shared with him
+	own := strings.Repeat("c", 64)
+	if err := DeleteMetadata(bob, testFile(t, bob, "/mine", "c.txt", own)); err != nil {
+		t.Fatal(err)
+	}
+	unreadable, err = UnreadableChunks(bob, []string{shared, "sha256:" + uploaded, own, "SHA256:" + strings.ToUpper(shared)})
+	if err != nil || len(unreadable) != 1 || unreadable[0] != "sha256:"+uploaded {
+		t.Errorf("UnreadableChunks of several chunks = %v, %v, want only %s", unreadable, err, uploaded)
+	}
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// sort orders of a folder listing
+const (
+	SortByName     = "name"
+	SortBySize     = "size"
+	SortByModified = "modified"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// sortColumns are the expressions a listing can be ordered by
+var sortColumns = map[string]string{
+	SortByName:     "NODE.NAME",
+	SortBySize:     "COALESCE(FILE_METADATA.FILE_SIZE, 0)",
+	SortByModified: "NODE.LAST_MODIFIED",
+}
+
+// ChildrenQuery selects a page of a folder listing. Folders come before
+// files, each ordered by Sort and then by id.
+type ChildrenQuery struct {
+	Sort       string
+	Descending bool
+	Limit      int
+	// FoldersOnly leaves files out, Extension keeps only files of that type
+	FoldersOnly bool
+	Extension   string
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Filter PropertyFilter
+}
+
+// cursor is the position of the last node of a page
+type cursor struct {
+	Sort     string    `json:"s"`
+	Folder   bool      `json:"f"`
+	Name     string    `json:"n,omitempty"`
+	Size     int       `json:"z,omitempty"`
+	Modified time.Time `json:"m"`
+	ID       int64     `json:"i"`
+}
+
+func encodeCursor(c cursor) string {
+	content, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decodeCursor(value string) (*cursor, error) {
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// sortValue is the value of node compared against a cursor sorted by sort
+func (c *cursor) sortValue() any {
+	switch c.Sort {
+	case SortBySize:
+		return c.Size
+	case SortByModified:
+		return c.Modified
+	default:
+		return c.Name
+	}
+}
+
+// ListChildren returns a page of the folder nodeID of owner's tree, "root"
+// stands for the root folder
+func ListChildren(owner string, nodeID string, query ChildrenQuery) (*types.ChildrenResponse, error) {
+	column, ok := sortColumns[query.Sort]
+	if !ok {
+		return nil, errors.New("unknown sort order")
+	}
+
+	var folderID int
+	if nodeID == ROOT_NAME {
+		var err error
+		folderID, err = RootFolder(owner)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := DBConnPool.QueryRow(`
+			SELECT
+				ID
+			FROM
+				NODE
+			WHERE
+				ID = $1 AND OWNER = $2 AND FOLDER AND TRASHED_AT IS NULL
+		`, nodeID, owner).Scan(&folderID)
+		if err == pgx.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			slog.Error("error fetching folder", "error", err.Error(), "id", nodeID)
+			return nil, errors.New("error listing folder")
+		}
+	}
+
+	direction, compare := "ASC", ">"
+	if query.Descending {
+		direction, compare = "DESC", "<"
+	}
+	conditions := []string{"NODE.PARENT_FOLDER = $1", "NODE.OWNER = $2", "NODE.TRASHED_AT IS NULL"}
+	args := []any{folderID, owner}
+	if query.FoldersOnly {
+		conditions = append(conditions, "NODE.FOLDER")
+	}
+	if query.Extension != "" {
+		args = append(args, strings.ToLower(query.Extension))
+		conditions = append(conditions, fmt.Sprintf("lower(FILE_METADATA.FILE_TYPE) = $%d", len(args)))
+	}
+	conditions = append(conditions, query.Filter.conditions(&args)...)
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if after.Sort != query.Sort {
+			// the position means nothing in another order
+			return nil, ErrInvalidCursor
+		}
+		args = append(args, !after.Folder, after.sortValue(), after.ID)
+		n := len(args)
+		// folders first whatever the direction, then (sort, id) past the cursor
+		conditions = append(conditions, fmt.Sprintf(
+			"((NOT NODE.FOLDER) > $%d OR ((NOT NODE.FOLDER) = $%d AND (%s, NODE.ID) %s ($%d, $%d)))",
+			n-2, n-2, column, compare, n-1, n,
+		))
+	}
+	// one more row tells whether there is a next page
+	args = append(args, query.Limit+1)
+
+	rows, err := DBConnPool.Query(fmt.Sprintf(`
+		SELECT
+			NODE.ID, NODE.FOLDER, NODE.NAME, COALESCE(FILE_METADATA.FILE_TYPE, ''), COALESCE(FILE_METADATA.FILE_SIZE, 0),
+			NODE.CREATED_AT, NODE.LAST_ACCESS, NODE.LAST_MODIFIED
+		FROM
+			NODE
+			LEFT JOIN FILE_METADATA ON FILE_METADATA.NODE_ID = NODE.ID
+		WHERE
+			%s
+		ORDER BY
+			NOT NODE.FOLDER, %s %s, NODE.ID %s
+		LIMIT $%d
+	`, strings.Join(conditions, " AND "), column, direction, direction, len(args)), args...)
+	if err != nil {
+		slog.Error("error listing folder", "error", err.Error(), "id", folderID)
+		return nil, errors.New("error listing folder")
+	}
+	defer rows.Close()
+
+	response := &types.ChildrenResponse{Children: []types.Node{}}
+	var ids []int64
+	for rows.Next() {
+		var node types.Node
+		var id int64
+		err := rows.Scan(&id, &node.IsFolder, &node.Name, &node.FileType, &node.FileSize, &node.CreatedAt, &node.LastAccess, &node.LastModified)
+		if err != nil {
+			slog.Error("error scanning folder listing", "error", err.Error())
+			return nil, errors.New("error listing folder")
+		}
+		node.NodeID = strconv.FormatInt(id, 10)
+		response.Children = append(response.Children, node)
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error listing folder", "error", err.Error(), "id", folderID)
+		return nil, errors.New("error listing folder")
+	}
+
+	if len(response.Children) > query.Limit {
+		response.Children = response.Children[:query.Limit]
+		last := response.Children[query.Limit-1]
+		response.NextCursor = encodeCursor(cursor{
+			Sort:     query.Sort,
+			Folder:   last.IsFolder,
+			Name:     last.Name,
+			Size:     last.FileSize,
+			Modified: last.LastModified,
+			ID:       ids[query.Limit-1],
+		})
+	}
+	return response, nil
+}
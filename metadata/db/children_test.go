@@ -0,0 +1,77 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDecodeCursor(t *testing.T) {
+	c := cursor{Sort: SortByName, Folder: true, Name: "a", ID: 7}
+	decoded, err := decodeCursor(encodeCursor(c))
+	if err != nil || decoded.Name != "a" || decoded.ID != 7 || !decoded.Folder {
+		t.Errorf("decodeCursor(encodeCursor(%+v)) = %+v, %v", c, decoded, err)
+	}
+	for _, value := range []string{"not base64!", "bm90IGpzb24"} {
+		if _, err := decodeCursor(value); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("decodeCursor(%q) = %v, want %v", value, err, ErrInvalidCursor)
+		}
+	}
+}
+
+func TestListChildrenPages(t *testing.T) {
+	testDB(t)
+	const alice = "alice@example.com"
+	docs := testFolder(t, alice, "/docs")
+	testFolder(t, alice, "/docs/b")
+	testFolder(t, alice, "/docs/y")
+	for i, name := range []string{"e.txt", "a.txt", "d.txt", "c.txt", "z.txt"} {
+		testFile(t, alice, "/docs", name, strings.Repeat(strconv.Itoa(i), 64))
+	}
+
+	// walk every page of two nodes
+	list := func(descending bool) []string {
+		t.Helper()
+		query := ChildrenQuery{Sort: SortByName, Descending: descending, Limit: 2}
+		var names []string
+		for {
+			page, err := ListChildren(alice, docs, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, node := range page.Children {
+				names = append(names, node.Name)
+			}
+			if page.NextCursor == "" {
+				return names
+			}
+			if len(names) > 7 {
+				t.Fatalf("listing doesn't end: %v", names)
+			}
+			query.Cursor = page.NextCursor
+		}
+	}
+	ascending := []string{"b", "y", "a.txt", "c.txt", "d.txt", "e.txt", "z.txt"}
+	if names := list(false); !slices.Equal(names, ascending) {
+		t.Errorf("ascending pages = %v, want %v", names, ascending)
+	}
+	// folders stay first in either direction
+	descending := []string{"y", "b", "z.txt", "e.txt", "d.txt", "c.txt", "a.txt"}
+	if names := list(true); !slices.Equal(names, descending) {
+		t.Errorf("descending pages = %v, want %v", names, descending)
+	}
+
+	page, err := ListChildren(alice, docs, ChildrenQuery{Sort: SortByName, Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ListChildren(alice, docs, ChildrenQuery{Sort: SortBySize, Limit: 3, Cursor: page.NextCursor})
+	if !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("cursor of another sort order = %v, want %v", err, ErrInvalidCursor)
+	}
+	if _, err := ListChildren("bob@example.com", docs, ChildrenQuery{Sort: SortByName, Limit: 3}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("listing someone else's folder = %v, want %v", err, ErrNotFound)
+	}
+}
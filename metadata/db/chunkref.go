@@ -0,0 +1,179 @@
+package db
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/melsonic/skyvault/metadata/types"
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+// addChunkRefs counts one more reference for every distinct chunk of a file
+func addChunkRefs(tx *pgx.Tx, hashes []string) error {
+	canonical := make([]string, len(hashes))
+	for i := range hashes {
+		canonical[i] = util.CanonicalHash(hashes[i])
+	}
+	_, err := tx.Exec(`
+		INSERT INTO CHUNK_REF (HASH, REF_COUNT)
+			SELECT DISTINCT unnest($1::text[]), 1
+		ON CONFLICT (HASH) DO UPDATE
+			SET REF_COUNT = CHUNK_REF.REF_COUNT + 1
+	`, util.FormatHashedChunks(canonical))
+	if err != nil {
+		slog.Error("error adding chunk references", "error", err.Error())
+		return errors.New("error saving chunk references")
+	}
+	return nil
+}
+
+// deleteFileContent deletes the FILE_METADATA row of nodeID and drops the
+// references it held. Only the transaction that deleted the row releases
+// them, so a concurrent delete of the same file can't release them twice.
+func deleteFileContent(tx *pgx.Tx, nodeID int64) error {
+	var hashIDs pgtype.TextArray
+	err := tx.QueryRow(`DELETE FROM FILE_METADATA WHERE NODE_ID = $1 RETURNING HASH_IDS`, nodeID).Scan(&hashIDs)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		slog.Error("error deleting file content", "error", err.Error(), "node_id", nodeID)
+		return errors.New("error releasing chunk references")
+	}
+	hashes := make([]string, len(hashIDs.Elements))
+	for i := range hashIDs.Elements {
+		hashes[i] = hashIDs.Elements[i].String
+	}
+	return releaseHashRefs(tx, hashes)
+}
+
+// releaseHashRefs drops one reference of every distinct chunk of hashes
+func releaseHashRefs(tx *pgx.Tx, hashes []string) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	canonical := make([]string, len(hashes))
+	for i := range hashes {
+		canonical[i] = util.CanonicalHash(hashes[i])
+	}
+
+	_, err := tx.Exec(`
+		UPDATE
+			CHUNK_REF
+		SET
+			REF_COUNT = REF_COUNT - 1
+		WHERE
+			HASH IN (SELECT DISTINCT unnest($1::text[]))
+	`, util.FormatHashedChunks(canonical))
+	if err != nil {
+		slog.Error("error releasing chunk references", "error", err.Error())
+		return errors.New("error releasing chunk references")
+	}
+	return nil
+}
+
+// ReferencedChunks returns the canonical hash of every chunk that
+// is still part of at least one file
+func ReferencedChunks() (map[string]struct{}, error) {
+	rows, err := DBConnPool.Query(`SELECT HASH FROM CHUNK_REF WHERE REF_COUNT > 0`)
+	if err != nil {
+		slog.Error("error fetching referenced chunks", "error", err.Error())
+		return nil, errors.New("error fetching referenced chunks")
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]struct{})
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			slog.Error("error scanning referenced chunk", "error", err.Error())
+			return nil, errors.New("error fetching referenced chunks")
+		}
+		referenced[hash] = struct{}{}
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error fetching referenced chunks", "error", err.Error())
+		return nil, errors.New("error fetching referenced chunks")
+	}
+	return referenced, nil
+}
+
+// IsChunkReferenced looks a single chunk up again right before it is
+// swept, in case a file started using it after the mark phase
+func IsChunkReferenced(hash string) (bool, error) {
+	var referenced bool
+	err := DBConnPool.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM CHUNK_REF WHERE HASH = $1 AND REF_COUNT > 0
+		)
+	`, hash).Scan(&referenced)
+	if err != nil {
+		slog.Error("error checking chunk reference", "error", err.Error(), "hash", hash)
+		return false, errors.New("error checking chunk reference")
+	}
+	return referenced, nil
+}
+
+// ForgetChunk removes the bookkeeping rows of a swept chunk
+func ForgetChunk(hash string) error {
+	_, err := DBConnPool.Exec(`DELETE FROM CHUNK_REF WHERE HASH = $1 AND REF_COUNT <= 0`, hash)
+	if err != nil {
+		slog.Error("error deleting chunk reference", "error", err.Error(), "hash", hash)
+		return errors.New("error deleting chunk reference")
+	}
+	// the uploads of a deleted chunk prove nothing anymore
+	_, err = DBConnPool.Exec(`DELETE FROM CHUNK_UPLOAD WHERE HASH = $1`, hash)
+	if err != nil {
+		slog.Error("error deleting chunk uploads", "error", err.Error(), "hash", hash)
+		return errors.New("error deleting chunk reference")
+	}
+	return nil
+}
+
+// FilesUsingChunks returns the files built from any of the given chunks,
+// once for every chunk they use. Hashes are matched with and without
+// the default algorithm prefix since older files store bare digests.
+func FilesUsingChunks(hashes []string) ([]types.ChunkFile, error) {
+	var candidates []string
+	for i := range hashes {
+		canonical := util.CanonicalHash(hashes[i])
+		candidates = append(candidates, canonical, strings.TrimPrefix(canonical, util.DefaultHashAlgorithm+":"))
+	}
+	rows, err := DBConnPool.Query(`
+		SELECT DISTINCT
+			NODE.ID, NODE.NAME, CHUNK.HASH
+		FROM
+			FILE_METADATA
+			JOIN NODE ON NODE.ID = FILE_METADATA.NODE_ID
+			CROSS JOIN LATERAL unnest(FILE_METADATA.HASH_IDS) AS CHUNK(HASH)
+		WHERE
+			FILE_METADATA.HASH_IDS && $1::text[] AND CHUNK.HASH = ANY($1::text[])
+	`, util.FormatHashedChunks(candidates))
+	if err != nil {
+		slog.Error("error fetching files of chunks", "error", err.Error())
+		return nil, errors.New("error fetching files of chunks")
+	}
+	defer rows.Close()
+
+	var files []types.ChunkFile
+	for rows.Next() {
+		var nodeID int64
+		var file types.ChunkFile
+		if err := rows.Scan(&nodeID, &file.FileName, &file.Hash); err != nil {
+			slog.Error("error scanning file of chunk", "error", err.Error())
+			return nil, errors.New("error fetching files of chunks")
+		}
+		file.NodeID = strconv.FormatInt(nodeID, 10)
+		file.Hash = util.CanonicalHash(file.Hash)
+		files = append(files, file)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error fetching files of chunks", "error", err.Error())
+		return nil, errors.New("error fetching files of chunks")
+	}
+	return files, nil
+}
@@ -0,0 +1,213 @@
+package db
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/melsonic/skyvault/metadata/types"
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+// copyRow creates a copy of nodeID called name in folderID. The copy of a
+// file points at the same chunks, which get one more reference each, and
+// starts over at version 1.
+func copyRow(tx *pgx.Tx, owner string, nodeID int64, folderID int64, name string) (int64, error) {
+	var copyID int64
+	err := tx.QueryRow(`
+		INSERT INTO NODE (FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED, OWNER)
+			SELECT
+				FOLDER, $1, $2, current_timestamp, current_timestamp, current_timestamp, OWNER
+			FROM
+				NODE
+			WHERE
+				ID = $3 AND OWNER = $4
+		RETURNING ID
+	`, name, folderID, nodeID, owner).Scan(&copyID)
+	if err != nil {
+		slog.Error("error copying node", "error", err.Error(), "id", nodeID)
+		return -1, errors.New("error copying node")
+	}
+	if err := copyProperties(tx, nodeID, copyID); err != nil {
+		return -1, err
+	}
+
+	var hashIDs pgtype.TextArray
+	err = tx.QueryRow(`
+		INSERT INTO FILE_METADATA (FILE_TYPE, FILE_SIZE, HASH_IDS, NODE_ID, STORAGE_TIER, AUTHOR)
+			SELECT
+				FILE_TYPE, FILE_SIZE, HASH_IDS, $1, STORAGE_TIER, AUTHOR
+			FROM
+				FILE_METADATA
+			WHERE
+				NODE_ID = $2
+		RETURNING HASH_IDS
+	`, copyID, nodeID).Scan(&hashIDs)
+	if err == pgx.ErrNoRows {
+		// a folder
+		return copyID, nil
+	}
+	if err != nil {
+		slog.Error("error copying file metadata", "error", err.Error(), "id", nodeID)
+		return -1, errors.New("error copying node")
+	}
+	hashes := make([]string, len(hashIDs.Elements))
+	for i := range hashIDs.Elements {
+		hashes[i] = hashIDs.Elements[i].String
+	}
+	if err := addChunkRefs(tx, hashes); err != nil {
+		return -1, err
+	}
+	return copyID, nil
+}
+
+// childIDs returns the ids of the nodes directly inside folderID
+func childIDs(tx *pgx.Tx, owner string, folderID int64) ([]int64, []string, error) {
+	rows, err := tx.Query(`
+		SELECT
+			ID, NAME
+		FROM
+			NODE
+		WHERE
+			PARENT_FOLDER = $1 AND OWNER = $2 AND TRASHED_AT IS NULL
+	`, folderID, owner)
+	if err != nil {
+		slog.Error("error listing folder", "error", err.Error(), "id", folderID)
+		return nil, nil, errors.New("error listing folder")
+	}
+	defer rows.Close()
+	var ids []int64
+	var names []string
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			slog.Error("error scanning folder listing", "error", err.Error())
+			return nil, nil, errors.New("error listing folder")
+		}
+		ids = append(ids, id)
+		names = append(names, name)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error listing folder", "error", err.Error(), "id", folderID)
+		return nil, nil, errors.New("error listing folder")
+	}
+	return ids, names, nil
+}
+
+// CopyNode deep copies nodeID of owner's tree into a folder in one
+// transaction. No data is copied, the files of the copy share the chunks of
+// the original. A node of the same name in the destination is handled by
+// request.OnConflict.
+func CopyNode(owner string, nodeID string, request types.CopyRequest) (*types.Node, error) {
+	id, err := strconv.ParseInt(nodeID, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid node id")
+	}
+	if !util.IsConflictPolicy(request.OnConflict) {
+		return nil, errors.New("unknown conflict policy")
+	}
+	if request.Name != "" && !util.IsValidNodeName(request.Name) {
+		return nil, errors.New("invalid node name")
+	}
+
+	tx, err := DBConnPool.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err.Error())
+		return nil, errors.New("error copying node")
+	}
+	defer tx.Rollback()
+	if err := lockTree(tx, owner); err != nil {
+		return nil, err
+	}
+
+	var isFolder bool
+	var name string
+	var parent pgtype.Int8
+	err = tx.QueryRow(`
+		SELECT
+			FOLDER, NAME, PARENT_FOLDER
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND OWNER = $2 AND TRASHED_AT IS NULL
+	`, id, owner).Scan(&isFolder, &name, &parent)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching node", "error", err.Error(), "id", id)
+		return nil, errors.New("error copying node")
+	}
+
+	if request.Name != "" {
+		name = request.Name
+	}
+	var folderID int64
+	switch {
+	case request.Parent != "":
+		folderID, err = resolveFolder(tx, owner, request.Parent)
+		if err != nil {
+			return nil, err
+		}
+	case parent.Status == pgtype.Null:
+		return nil, errors.New("root folder needs a destination to be copied to")
+	default:
+		folderID = parent.Int
+	}
+	if isFolder {
+		// the copy would have to contain itself
+		inside, err := isDescendant(tx, folderID, id)
+		if err != nil {
+			return nil, err
+		}
+		if inside {
+			return nil, ErrCycle
+		}
+	} else if _, err := util.GetFileExtension(name); err != nil {
+		return nil, err
+	}
+	name, err = freeName(tx, owner, folderID, name, isFolder, -1, id, request.OnConflict)
+	if err != nil {
+		return nil, err
+	}
+
+	copyID, err := copyRow(tx, owner, id, folderID, name)
+	if err != nil {
+		return nil, err
+	}
+	// breadth first, pairs of an original folder and its copy
+	originals, copies := []int64{id}, []int64{copyID}
+	for isFolder && len(originals) > 0 {
+		original, copied := originals[0], copies[0]
+		originals, copies = originals[1:], copies[1:]
+		ids, names, err := childIDs(tx, owner, original)
+		if err != nil {
+			return nil, err
+		}
+		for i := range ids {
+			childCopyID, err := copyRow(tx, owner, ids[i], copied, names[i])
+			if err != nil {
+				return nil, err
+			}
+			originals = append(originals, ids[i])
+			copies = append(copies, childCopyID)
+		}
+	}
+	if err := touchFolders(tx, folderID); err != nil {
+		return nil, err
+	}
+
+	node, err := fetchNode(tx, owner, copyID)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("error committing copy", "error", err.Error(), "id", id)
+		return nil, errors.New("error copying node")
+	}
+	return node, nil
+}
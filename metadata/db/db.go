@@ -7,7 +7,6 @@ import (
 	"log/slog"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/jackc/pgx"
@@ -18,9 +17,10 @@ import (
 )
 
 var (
-	DBConnPool  *pgx.ConnPool
-	ROOT_FOLDER = -1
-	ROOT_NAME   = "root"
+	DBConnPool *pgx.ConnPool
+	ROOT_NAME  = "root"
+
+	ErrNotFound = errors.New("node not found")
 )
 
 func connectDB() error {
@@ -84,17 +84,244 @@ func setupDB() error {
 		return errors.New("error creating FILE_METADATA table")
 	}
 
-	_ = DBConnPool.QueryRow("SELECT ID FROM NODE WHERE NAME = $1", ROOT_NAME).Scan(&ROOT_FOLDER)
-	if ROOT_FOLDER == -1 {
-		err = DBConnPool.QueryRow(`INSERT INTO NODE (FOLDER, NAME, CREATED_AT, LAST_ACCESS, LAST_MODIFIED) VALUES ($1, $2, current_timestamp, current_timestamp, current_timestamp) RETURNING ID`, true, ROOT_NAME).Scan(&ROOT_FOLDER)
+	_, err = DBConnPool.Exec(`
+		ALTER TABLE FILE_METADATA ADD COLUMN IF NOT EXISTS STORAGE_TIER text NOT NULL DEFAULT ''
+	`)
+	if err != nil {
+		slog.Error("error adding STORAGE_TIER column", "error", err.Error())
+		return errors.New("error creating FILE_METADATA table")
+	}
+
+	_, err = DBConnPool.Exec(`
+		CREATE TABLE IF NOT EXISTS CHUNK_REF (
+			HASH text PRIMARY KEY,
+			REF_COUNT bigint NOT NULL
+		)
+	`)
+	if err != nil {
+		slog.Error("error creating CHUNK_REF table", "error", err.Error())
+		return errors.New("error creating CHUNK_REF table")
+	}
+
+	// deleted nodes stay in the trash until purged, TRASH_ROOT is the node
+	// the delete was asked for and TRASH_PATH the path of its folder then
+	_, err = DBConnPool.Exec(`
+		ALTER TABLE NODE
+			ADD COLUMN IF NOT EXISTS TRASHED_AT timestamptz,
+			ADD COLUMN IF NOT EXISTS TRASH_ROOT bigint,
+			ADD COLUMN IF NOT EXISTS TRASH_PATH text
+	`)
+	if err != nil {
+		slog.Error("error adding trash columns", "error", err.Error())
+		return errors.New("error creating node table")
+	}
+
+	_, err = DBConnPool.Exec(`
+		CREATE INDEX IF NOT EXISTS NODE_TRASH_ROOT ON NODE (TRASH_ROOT) WHERE TRASH_ROOT IS NOT NULL
+	`)
+	if err != nil {
+		slog.Error("error creating NODE_TRASH_ROOT index", "error", err.Error())
+		return errors.New("error creating node table")
+	}
+
+	// the current version of a file stays in FILE_METADATA, older ones
+	// move to FILE_VERSION and keep holding their chunk references
+	_, err = DBConnPool.Exec(`
+		ALTER TABLE FILE_METADATA
+			ADD COLUMN IF NOT EXISTS VERSION integer NOT NULL DEFAULT 1,
+			ADD COLUMN IF NOT EXISTS AUTHOR text NOT NULL DEFAULT ''
+	`)
+	if err != nil {
+		slog.Error("error adding VERSION and AUTHOR columns", "error", err.Error())
+		return errors.New("error creating FILE_METADATA table")
+	}
+
+	_, err = DBConnPool.Exec(`
+		CREATE TABLE IF NOT EXISTS FILE_VERSION (
+			ID bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+			NODE_ID bigint NOT NULL references NODE(ID),
+			VERSION integer NOT NULL,
+			FILE_TYPE text NOT NULL,
+			FILE_SIZE bigint NOT NULL,
+			HASH_IDS text[] NOT NULL,
+			AUTHOR text NOT NULL,
+			CREATED_AT timestamptz NOT NULL,
+			UNIQUE (NODE_ID, VERSION)
+		)
+	`)
+	if err != nil {
+		slog.Error("error creating FILE_VERSION table", "error", err.Error())
+		return errors.New("error creating FILE_VERSION table")
+	}
+
+	// every user owns a tree, nodes created before had no owner
+	_, err = DBConnPool.Exec(`
+		ALTER TABLE NODE ADD COLUMN IF NOT EXISTS OWNER text NOT NULL DEFAULT ''
+	`)
+	if err != nil {
+		slog.Error("error adding OWNER column", "error", err.Error())
+		return errors.New("error creating node table")
+	}
+
+	// one root per owner, RootFolder relies on it when creating them concurrently
+	_, err = DBConnPool.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS NODE_OWNER_ROOT ON NODE (OWNER) WHERE PARENT_FOLDER IS NULL
+	`)
+	if err != nil {
+		slog.Error("error creating NODE_OWNER_ROOT index", "error", err.Error())
+		return errors.New("error creating node table")
+	}
+
+	_, err = DBConnPool.Exec(`
+		CREATE INDEX IF NOT EXISTS NODE_OWNER_PARENT ON NODE (OWNER, PARENT_FOLDER, NAME)
+	`)
+	if err != nil {
+		slog.Error("error creating NODE_OWNER_PARENT index", "error", err.Error())
+		return errors.New("error creating node table")
+	}
+
+	// tags are keys without a value
+	_, err = DBConnPool.Exec(`
+		CREATE TABLE IF NOT EXISTS NODE_PROPERTY (
+			NODE_ID bigint NOT NULL REFERENCES NODE(ID) ON DELETE CASCADE,
+			KEY text NOT NULL,
+			VALUE jsonb,
+			PRIMARY KEY (NODE_ID, KEY)
+		)
+	`)
+	if err != nil {
+		slog.Error("error creating NODE_PROPERTY table", "error", err.Error())
+		return errors.New("error creating NODE_PROPERTY table")
+	}
+
+	_, err = DBConnPool.Exec(`
+		CREATE INDEX IF NOT EXISTS NODE_PROPERTY_KEY_VALUE ON NODE_PROPERTY (KEY, (VALUE #>> '{}'))
+	`)
+	if err != nil {
+		slog.Error("error creating NODE_PROPERTY_KEY_VALUE index", "error", err.Error())
+		return errors.New("error creating NODE_PROPERTY table")
+	}
+
+	_, err = DBConnPool.Exec(`
+		CREATE TABLE IF NOT EXISTS NODE_ACL (
+			NODE_ID bigint NOT NULL REFERENCES NODE(ID) ON DELETE CASCADE,
+			GRANTEE text NOT NULL,
+			ROLE text NOT NULL,
+			GRANTED_BY text NOT NULL,
+			CREATED_AT timestamptz NOT NULL,
+			PRIMARY KEY (NODE_ID, GRANTEE)
+		)
+	`)
+	if err != nil {
+		slog.Error("error creating NODE_ACL table", "error", err.Error())
+		return errors.New("error creating NODE_ACL table")
+	}
+
+	// SharedWith lists by grantee
+	_, err = DBConnPool.Exec(`
+		CREATE INDEX IF NOT EXISTS NODE_ACL_GRANTEE ON NODE_ACL (GRANTEE)
+	`)
+	if err != nil {
+		slog.Error("error creating NODE_ACL_GRANTEE index", "error", err.Error())
+		return errors.New("error creating NODE_ACL table")
+	}
+
+	// who sent the content of a chunk, files may only list chunks their
+	// author uploaded or can read
+	_, err = DBConnPool.Exec(`
+		CREATE TABLE IF NOT EXISTS CHUNK_UPLOAD (
+			HASH text NOT NULL,
+			UPLOADER text NOT NULL,
+			CREATED_AT timestamptz NOT NULL,
+			PRIMARY KEY (HASH, UPLOADER)
+		)
+	`)
+	if err != nil {
+		slog.Error("error creating CHUNK_UPLOAD table", "error", err.Error())
+		return errors.New("error creating CHUNK_UPLOAD table")
+	}
+
+	if err := setupSearchIndexes(); err != nil {
+		return err
+	}
+	if err := setupMigrations(); err != nil {
+		return err
+	}
+	// FILE_VERSION has to exist, older versions hold references too
+	if err := runMigration(MigrationChunkRefs, backfillChunkRefs); err != nil {
+		return err
+	}
+	if err := runMigration(MigrationUniqueNames, uniqueNodeNames); err != nil {
+		return err
+	}
+	return migrateLegacyNodes()
+}
+
+// setupSearchIndexes creates the indexes SearchNodes relies on, name
+// matching goes through a trigram index of pg_trgm
+func setupSearchIndexes() error {
+	_, err := DBConnPool.Exec(`CREATE EXTENSION IF NOT EXISTS pg_trgm`)
+	if err != nil {
+		slog.Error("error creating pg_trgm extension", "error", err.Error())
+		return errors.New("error creating search indexes")
+	}
+
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS NODE_NAME_TRGM ON NODE USING gin (lower(NAME) gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS NODE_OWNER_CREATED ON NODE (OWNER, CREATED_AT)`,
+		`CREATE INDEX IF NOT EXISTS NODE_OWNER_MODIFIED ON NODE (OWNER, LAST_MODIFIED)`,
+		`CREATE INDEX IF NOT EXISTS FILE_METADATA_NODE ON FILE_METADATA (NODE_ID)`,
+		`CREATE INDEX IF NOT EXISTS FILE_METADATA_TYPE ON FILE_METADATA (lower(FILE_TYPE))`,
+		`CREATE INDEX IF NOT EXISTS FILE_METADATA_SIZE ON FILE_METADATA (FILE_SIZE)`,
+		// readableChunks looks files up by chunk
+		`CREATE INDEX IF NOT EXISTS FILE_METADATA_HASHES ON FILE_METADATA USING gin (HASH_IDS)`,
+		`CREATE INDEX IF NOT EXISTS FILE_VERSION_HASHES ON FILE_VERSION USING gin (HASH_IDS)`,
+	}
+	for _, index := range indexes {
+		_, err = DBConnPool.Exec(index)
 		if err != nil {
-			slog.Error("error inserting root node", "error", err.Error())
-			return errors.New("error inserting root node")
+			slog.Error("error creating search index", "error", err.Error(), "index", index)
+			return errors.New("error creating search indexes")
 		}
 	}
 	return nil
 }
 
+// RootFolder returns the root node of owner's tree, creating it on first use
+func RootFolder(owner string) (int, error) {
+	var rootID int
+	err := DBConnPool.QueryRow(`
+		SELECT
+			ID
+		FROM
+			NODE
+		WHERE
+			OWNER = $1 AND PARENT_FOLDER IS NULL
+	`, owner).Scan(&rootID)
+	if err == nil {
+		return rootID, nil
+	}
+	if err != pgx.ErrNoRows {
+		slog.Error("error fetching root node", "error", err.Error(), "owner", owner)
+		return -1, errors.New("error fetching root node")
+	}
+
+	// a concurrent request may have created it since
+	err = DBConnPool.QueryRow(`
+		INSERT INTO NODE (OWNER, FOLDER, NAME, CREATED_AT, LAST_ACCESS, LAST_MODIFIED)
+		VALUES
+			($1, $2, $3, current_timestamp, current_timestamp, current_timestamp)
+		ON CONFLICT (OWNER) WHERE PARENT_FOLDER IS NULL
+		DO UPDATE SET OWNER = EXCLUDED.OWNER
+		RETURNING ID
+	`, owner, true, ROOT_NAME).Scan(&rootID)
+	if err != nil {
+		slog.Error("error inserting root node", "error", err.Error(), "owner", owner)
+		return -1, errors.New("error inserting root node")
+	}
+	return rootID, nil
+}
+
 func InitDB() error {
 	err := connectDB()
 	if err != nil {
@@ -104,101 +331,124 @@ func InitDB() error {
 	return err
 }
 
-func SaveMetadata(data *types.Metadata) (int, error) {
+// SaveMetadata creates the missing folders of data's path in owner's tree,
+// and the file itself unless data is a folder
+func SaveMetadata(owner string, data *types.Metadata) (int, error) {
 	fileExtension, err := util.GetFileExtension(data.FileName)
 	if !data.IsFolder && err != nil {
 		slog.Error("unsupported file format")
 		return -1, err
 	}
-	path := strings.Split(data.FilePath, "/")
-	folderID := ROOT_FOLDER
-	var index int = 0
-	var currentFolderID int
-	for index = 0; index < len(path); index++ {
-
-		if path[index] == "" {
-			continue
-		}
+	if !data.IsFolder && !util.IsValidNodeName(data.FileName) {
+		return -1, errors.New("invalid node name")
+	}
+	if data.IsFolder {
+		folderID, err := MakeFoldersIn(owner, parentOf(data), data.FilePath)
+		return int(folderID), err
+	}
+	if !util.IsStorageTier(data.StorageTier) {
+		return -1, errors.New("unknown storage tier")
+	}
+	// Below code runs only when the input is a file
+	hashes := util.FormatHashedChunks(data.Hashes)
+	if data.Author == "" {
+		data.Author = owner
+	}
 
-		err := DBConnPool.QueryRow(`
-			SELECT 
-				ID 
-			FROM 
-				NODE 
-			WHERE 
-				NAME = $1
-		`, path[index]).Scan(&currentFolderID)
-		if err != nil {
-			break
-		}
-		folderID = currentFolderID
+	// the folders, the lookup and the inserts see the tree as one save
+	// does, two saves of a new file make one file and a version of it
+	tx, err := DBConnPool.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err.Error())
+		return -1, errors.New("error saving node")
+	}
+	defer tx.Rollback()
+	folderID, err := makeFolders(tx, owner, parentOf(data), data.FilePath)
+	if err != nil {
+		return -1, err
 	}
-	for ; index < len(path); index++ {
 
-		if path[index] == "" {
-			continue
+	// saving over an existing file makes a new version of it
+	existingID, existingFolder, err := childByName(tx, owner, folderID, data.FileName)
+	if err == nil {
+		if existingFolder {
+			return -1, ErrNameTaken
 		}
-
-		err := DBConnPool.QueryRow(`
-			INSERT INTO NODE (FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED) 
-			VALUES 
-				($1, $2, $3, current_timestamp, current_timestamp, current_timestamp) 
-			RETURNING ID
-		`, true, path[index], folderID).Scan(&currentFolderID)
-		if err != nil {
-			slog.Error("error inserting node", "error", err.Error(), "nodename", path[index])
-			return -1, errors.New("error saving node")
+		if err := saveVersion(tx, existingID, data, string(fileExtension)); err != nil {
+			return -1, err
 		}
-
-		folderID = currentFolderID
+		return int(existingID), commitSave(tx, data.FileName)
 	}
-	if data.IsFolder {
-		return folderID, nil
+	if !errors.Is(err, ErrNotFound) {
+		return -1, err
 	}
-	// Below code runs only when the input is a file
-	hashes := util.FormatHashedChunks(data.Hashes)
 
 	var nodeID int
-	err = DBConnPool.QueryRow(`
+	err = tx.QueryRow(`
 		INSERT INTO NODE (
-			FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED
+			FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED, OWNER
 		) 
 		VALUES 
-			($1, $2, $3, current_timestamp, current_timestamp, current_timestamp)
+			($1, $2, $3, current_timestamp, current_timestamp, current_timestamp, $4)
 		RETURNING ID, CREATED_AT, LAST_ACCESS, LAST_MODIFIED
-	`, data.IsFolder, data.FileName, folderID).Scan(&nodeID, &data.CreatedAt, &data.LastAccess, &data.LastModified)
+	`, data.IsFolder, data.FileName, folderID, owner).Scan(&nodeID, &data.CreatedAt, &data.LastAccess, &data.LastModified)
 	if err != nil {
 		slog.Error("error saving file", "error", err.Error(), "filename", data.FileName)
 		return -1, errors.New("error saving file")
 	}
 
-	_, err = DBConnPool.Exec(`
+	_, err = tx.Exec(`
 		INSERT INTO FILE_METADATA (
-			FILE_TYPE, FILE_SIZE, NODE_ID, HASH_IDS
+			FILE_TYPE, FILE_SIZE, NODE_ID, HASH_IDS, STORAGE_TIER, AUTHOR
 		) 
 		VALUES 
 		(
-			$1, $2, $3, $4
+			$1, $2, $3, $4, $5, $6
 		)
-	`, fileExtension, data.FileSize, nodeID, hashes)
+	`, fileExtension, data.FileSize, nodeID, hashes, data.StorageTier, data.Author)
 	if err != nil {
 		slog.Error("error inserting node", "error", err.Error())
 		return -1, errors.New("error saving node")
 	}
-	return nodeID, nil
+	err = addChunkRefs(tx, data.Hashes)
+	if err != nil {
+		return -1, err
+	}
+	return nodeID, commitSave(tx, data.FileName)
+}
+
+// parentOf returns the folder data's path starts at
+func parentOf(data *types.Metadata) string {
+	if data.Parent == "" {
+		return ROOT_NAME
+	}
+	return data.Parent
 }
 
-func FetchMetadata(nodeID string) (*types.Metadata, error) {
+// commitSave commits the transaction of SaveMetadata
+func commitSave(tx *pgx.Tx, fileName string) error {
+	if err := tx.Commit(); err != nil {
+		slog.Error("error committing file metadata", "error", err.Error(), "filename", fileName)
+		return errors.New("error saving node")
+	}
+	return nil
+}
+
+// FetchMetadata returns a file of owner's tree
+func FetchMetadata(owner string, nodeID string) (*types.Metadata, error) {
 	var hashIDs pgtype.TextArray
 	var fileNodeData types.Metadata
 	err := DBConnPool.QueryRow(`
 		SELECT 
-			NODE.CREATED_AT, NODE.LAST_ACCESS, NODE.LAST_MODIFIED, FILE_METADATA.FILE_SIZE, FILE_METADATA.HASH_IDS, NODE.NAME 
+			NODE.CREATED_AT, NODE.LAST_ACCESS, NODE.LAST_MODIFIED, FILE_METADATA.FILE_SIZE, FILE_METADATA.HASH_IDS, NODE.NAME, FILE_METADATA.STORAGE_TIER, FILE_METADATA.VERSION, FILE_METADATA.AUTHOR 
 		FROM 
 			NODE, FILE_METADATA 
 		WHERE 
-			NODE.ID = FILE_METADATA.NODE_ID AND NODE.ID=$1
-	`, nodeID).Scan(&fileNodeData.CreatedAt, &fileNodeData.LastAccess, &fileNodeData.LastModified, &fileNodeData.FileSize, &hashIDs, &fileNodeData.FileName)
+			NODE.ID = FILE_METADATA.NODE_ID AND NODE.ID=$1 AND NODE.OWNER=$2 AND NODE.TRASHED_AT IS NULL
+	`, nodeID, owner).Scan(&fileNodeData.CreatedAt, &fileNodeData.LastAccess, &fileNodeData.LastModified, &fileNodeData.FileSize, &hashIDs, &fileNodeData.FileName, &fileNodeData.StorageTier, &fileNodeData.Version, &fileNodeData.Author)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		slog.Error("error in querying node db", "error", err.Error())
 		return nil, errors.New("error fetching data from db")
@@ -208,80 +458,67 @@ func FetchMetadata(nodeID string) (*types.Metadata, error) {
 		hashes = append(hashes, hashIDs.Elements[i].String)
 	}
 	fileNodeData.Hashes = hashes
+
+	id, err := strconv.ParseInt(nodeID, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid node id")
+	}
+	properties, err := nodeProperties(id)
+	if err != nil {
+		return nil, err
+	}
+	fileNodeData.Tags = properties.Tags
+	fileNodeData.Properties = properties.Properties
 	return &fileNodeData, nil
 }
 
-// In case of delete, we need to delete all the child folders/files
-func DeleteMetadata(nodeID string) error {
+// DeleteMetadata moves a node of owner's tree, with everything below it,
+// to owner's trash where it stays until purged
+func DeleteMetadata(owner string, nodeID string) error {
 	id, err := strconv.ParseInt(nodeID, 10, 64)
 	if err != nil {
 		slog.Error("invalid nodeID", "id", nodeID, "error", err.Error())
 		return errors.New("invalid node id")
 	}
-	queue := []int64{id}
-	nodeIDs := []int64{id}
-
-	// bfs
-	for len(queue) > 0 {
-		currentNodeID := queue[0]
-		queue = queue[1:]
-		rows, err := DBConnPool.Query(`
-			SELECT 
-				ID
-			FROM 
-				NODE
-			WHERE
-				PARENT_FOLDER = $1
-		`, currentNodeID)
-		if err != nil {
-			slog.Error("error travelling all nodes", "error", err.Error())
-			return errors.New("error deleting node")
-		}
-		defer rows.Close()
 
-		var id int64
-		for rows.Next() {
-			if err := rows.Scan(&id); err != nil {
-				slog.Error("error fetching id from rows", "error", err.Error())
-				return errors.New("error deleting node")
-			}
-			queue = append(queue, id)
-			nodeIDs = append(nodeIDs, id)
-		}
-
-		if err = rows.Err(); err != nil {
-			slog.Error("error fetching id from rows end", "error", err.Error())
-			return errors.New("error deleting node")
-		}
+	tx, err := DBConnPool.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err.Error())
+		return errors.New("error deleting node")
+	}
+	defer tx.Rollback()
+	if err := lockTree(tx, owner); err != nil {
+		return err
 	}
 
-	for i := range nodeIDs {
-		_, err = DBConnPool.Exec(`
-			DELETE FROM
-				FILE_METADATA
-			WHERE
-				NODE_ID = $1
-		`, nodeIDs[i])
-
-		if err != nil {
-			slog.Error("error deleting row in file_metadata", "error", err.Error(), "node_id", nodeIDs[i])
-			return errors.New("error deleting file_metadata")
-		}
-
-		_, err = DBConnPool.Exec(`
-			DELETE FROM
-				NODE
-			WHERE
-				ID = $1
-		`, nodeIDs[i])
-
-		if err != nil {
-			slog.Error("error deleting row node", "error", err.Error(), "id", nodeIDs[i])
-			return errors.New("error deleting node")
-		}
-
+	var parent pgtype.Int8
+	err = tx.QueryRow(`
+		SELECT
+			PARENT_FOLDER
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND OWNER = $2 AND TRASHED_AT IS NULL
+	`, id, owner).Scan(&parent)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching node", "error", err.Error(), "id", id)
+		return errors.New("error deleting node")
+	}
+	if parent.Status == pgtype.Null {
+		return errors.New("root folder can't be deleted")
 	}
 
+	if err := trashSubtree(tx, owner, id, parent.Int); err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("error committing delete", "error", err.Error(), "id", id)
+		return errors.New("error deleting node")
+	}
 	return nil
 }
 
@@ -297,7 +534,9 @@ func CleanOrphanNodes(ctx context.Context) {
 			case <-ticker.C:
 				// clean up the table
 				// TODO: optimize the query/approach
-				_, err := DBConnPool.Exec(`DELETE FROM NODE WHERE PARENT_FOLDER NOT IN (SELECT ID FROM NODE)`)
+				// trashed nodes may have lost their parent to a purge, restoring
+				// them recreates it
+				_, err := DBConnPool.Exec(`DELETE FROM NODE WHERE PARENT_FOLDER NOT IN (SELECT ID FROM NODE) AND TRASHED_AT IS NULL`)
 				if err != nil {
 					slog.Error("error fetching node ids in gorouting", "error", err.Error())
 					continue
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+func TestConcurrentSavesMakeOneFile(t *testing.T) {
+	testDB(t)
+	const owner, saves = "alice@example.com", 8
+	ids := make([]int, saves)
+	errs := make([]error, saves)
+	var wg sync.WaitGroup
+	for i := range saves {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := types.Metadata{FileName: "report.txt", FilePath: "/new/folder", Hashes: []string{strings.Repeat("a", 64)}, FileSize: 1}
+			ids[i], errs[i] = SaveMetadata(owner, &data)
+		}()
+	}
+	wg.Wait()
+	for i := range saves {
+		if errs[i] != nil {
+			t.Fatalf("save %d: %v", i, errs[i])
+		}
+		if ids[i] != ids[0] {
+			t.Fatalf("saves made files %d and %d", ids[0], ids[i])
+		}
+	}
+	var nodes int
+	err := DBConnPool.QueryRow(`SELECT count(*) FROM NODE WHERE OWNER = $1 AND NAME IN ('new', 'folder', 'report.txt')`, owner).Scan(&nodes)
+	if err != nil || nodes != 3 {
+		t.Errorf("nodes = %d, %v, want 3", nodes, err)
+	}
+	data, err := FetchMetadata(owner, strconv.Itoa(ids[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Version != saves {
+		t.Errorf("Version = %d, want %d", data.Version, saves)
+	}
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgx"
+)
+
+// testTables are dropped before every test, the database of TEST_DB_*
+// must be a throwaway one
+var testTables = []string{
+	"NODE_ACL", "NODE_PROPERTY", "FILE_VERSION", "FILE_METADATA", "CHUNK_REF", "CHUNK_UPLOAD", "METADATA_MIGRATION", "NODE",
+}
+
+// testDB points DBConnPool at the Postgres of TEST_DB_HOST, TEST_DB_PORT,
+// TEST_DB_USER, TEST_DB_PASSWORD and TEST_DB_DATABASE with a fresh schema,
+// the test is skipped when TEST_DB_HOST isn't set
+func testDB(t *testing.T) {
+	t.Helper()
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST not set")
+	}
+	port, err := strconv.ParseUint(os.Getenv("TEST_DB_PORT"), 10, 16)
+	if err != nil {
+		port = 5432
+	}
+	DBConnPool, err = pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig: pgx.ConnConfig{
+			Host:     host,
+			Port:     uint16(port),
+			User:     os.Getenv("TEST_DB_USER"),
+			Password: os.Getenv("TEST_DB_PASSWORD"),
+			Database: os.Getenv("TEST_DB_DATABASE"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	t.Cleanup(DBConnPool.Close)
+
+	for _, table := range testTables {
+		if _, err := DBConnPool.Exec(`DROP TABLE IF EXISTS ` + table + ` CASCADE`); err != nil {
+			t.Fatalf("dropping %s: %v", table, err)
+		}
+	}
+	if err := setupDB(); err != nil {
+		t.Fatalf("setting the schema up: %v", err)
+	}
+}
+
+// mustExec runs a statement of a test fixture
+func mustExec(t *testing.T, sql string, args ...any) {
+	t.Helper()
+	if _, err := DBConnPool.Exec(sql, args...); err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+}
+
+// mustID runs an INSERT ... RETURNING ID of a test fixture
+func mustID(t *testing.T, sql string, args ...any) int64 {
+	t.Helper()
+	var id int64
+	if err := DBConnPool.QueryRow(sql, args...).Scan(&id); err != nil {
+		t.Fatalf("%s: %v", sql, err)
+	}
+	return id
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+
+	"github.com/jackc/pgx"
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+// one time data migrations, recorded in METADATA_MIGRATION once applied
+const (
+	MigrationChunkRefs   = "chunk_ref_backfill"
+	MigrationLegacyOwner = "legacy_owner"
+	MigrationUniqueNames = "unique_node_names"
+)
+
+// setupMigrations creates the table recording the applied migrations
+func setupMigrations() error {
+	_, err := DBConnPool.Exec(`
+		CREATE TABLE IF NOT EXISTS METADATA_MIGRATION (
+			NAME text PRIMARY KEY,
+			APPLIED_AT timestamptz NOT NULL
+		)
+	`)
+	if err != nil {
+		slog.Error("error creating METADATA_MIGRATION table", "error", err.Error())
+		return errors.New("error creating METADATA_MIGRATION table")
+	}
+	return nil
+}
+
+// runMigration applies migrate in a transaction unless name was applied
+// before, instances starting together apply it once
+func runMigration(name string, migrate func(tx *pgx.Tx) error) error {
+	tx, err := DBConnPool.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err.Error())
+		return errors.New("error migrating database")
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('METADATA_MIGRATION'))`)
+	if err != nil {
+		slog.Error("error locking migrations", "error", err.Error())
+		return errors.New("error migrating database")
+	}
+
+	var applied bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM METADATA_MIGRATION WHERE NAME = $1)`, name).Scan(&applied)
+	if err != nil {
+		slog.Error("error checking migration", "error", err.Error(), "migration", name)
+		return errors.New("error migrating database")
+	}
+	if applied {
+		return nil
+	}
+	if err := migrate(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO METADATA_MIGRATION (NAME, APPLIED_AT) VALUES ($1, current_timestamp)`, name)
+	if err != nil {
+		slog.Error("error recording migration", "error", err.Error(), "migration", name)
+		return errors.New("error migrating database")
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("error committing migration", "error", err.Error(), "migration", name)
+		return errors.New("error migrating database")
+	}
+	slog.Info("applied migration", "migration", name)
+	return nil
+}
+
+// MigrationApplied tells whether the migration name has run
+func MigrationApplied(name string) (bool, error) {
+	var applied bool
+	err := DBConnPool.QueryRow(`SELECT EXISTS (SELECT 1 FROM METADATA_MIGRATION WHERE NAME = $1)`, name).Scan(&applied)
+	if err != nil {
+		slog.Error("error checking migration", "error", err.Error(), "migration", name)
+		return false, errors.New("error checking migration")
+	}
+	return applied, nil
+}
+
+// backfillChunkRefs counts the references of the files and versions saved
+// before CHUNK_REF existed, one per distinct chunk of each row like
+// addChunkRefs does. The counts are recomputed from scratch, so the files
+// saved since are not counted twice.
+func backfillChunkRefs(tx *pgx.Tx) error {
+	// saves wait for the recount instead of updating counts it replaces
+	_, err := tx.Exec(`LOCK TABLE CHUNK_REF IN EXCLUSIVE MODE`)
+	if err != nil {
+		slog.Error("error locking CHUNK_REF", "error", err.Error())
+		return errors.New("error backfilling chunk references")
+	}
+	// the CASE is util.CanonicalHash
+	_, err = tx.Exec(`
+		INSERT INTO CHUNK_REF (HASH, REF_COUNT)
+			SELECT
+				HASH, count(*)
+			FROM (
+				SELECT DISTINCT
+					FILE_METADATA.ID,
+					CASE WHEN position(':' IN CHUNK.HASH) > 0 THEN lower(CHUNK.HASH) ELSE $1 || ':' || lower(CHUNK.HASH) END
+				FROM
+					FILE_METADATA
+					CROSS JOIN LATERAL unnest(FILE_METADATA.HASH_IDS) AS CHUNK(HASH)
+				UNION ALL
+				SELECT DISTINCT
+					FILE_VERSION.ID,
+					CASE WHEN position(':' IN CHUNK.HASH) > 0 THEN lower(CHUNK.HASH) ELSE $1 || ':' || lower(CHUNK.HASH) END
+				FROM
+					FILE_VERSION
+					CROSS JOIN LATERAL unnest(FILE_VERSION.HASH_IDS) AS CHUNK(HASH)
+			) AS REFS (ROW_ID, HASH)
+			GROUP BY
+				HASH
+		ON CONFLICT (HASH) DO UPDATE
+			SET REF_COUNT = EXCLUDED.REF_COUNT
+	`, util.DefaultHashAlgorithm)
+	if err != nil {
+		slog.Error("error backfilling chunk references", "error", err.Error())
+		return errors.New("error backfilling chunk references")
+	}
+	return nil
+}
+
+// ChunkRefsReady tells whether CHUNK_REF counts the files saved before it
+// existed, chunks can't be swept until then
+func ChunkRefsReady() (bool, error) {
+	return MigrationApplied(MigrationChunkRefs)
+}
+
+// uniqueNodeNames numbers the names shared by live nodes of a folder, like
+// a rename on conflict does, and makes the names of a folder unique from
+// then on. The oldest node keeps its name.
+func uniqueNodeNames(tx *pgx.Tx) error {
+	// no save may add a duplicate until the index exists
+	_, err := tx.Exec(`LOCK TABLE NODE IN SHARE ROW EXCLUSIVE MODE`)
+	if err != nil {
+		slog.Error("error locking NODE", "error", err.Error())
+		return errors.New("error making node names unique")
+	}
+	rows, err := tx.Query(`
+		SELECT
+			ID, OWNER, PARENT_FOLDER, NAME, FOLDER
+		FROM (
+			SELECT
+				ID, OWNER, PARENT_FOLDER, NAME, FOLDER,
+				row_number() OVER (PARTITION BY OWNER, PARENT_FOLDER, NAME ORDER BY ID) AS RANK
+			FROM
+				NODE
+			WHERE
+				TRASHED_AT IS NULL AND PARENT_FOLDER IS NOT NULL
+		) AS NAMED
+		WHERE
+			RANK > 1
+	`)
+	if err != nil {
+		slog.Error("error fetching duplicate names", "error", err.Error())
+		return errors.New("error making node names unique")
+	}
+	type duplicate struct {
+		id       int64
+		owner    string
+		folderID int64
+		name     string
+		isFolder bool
+	}
+	var duplicates []duplicate
+	for rows.Next() {
+		var d duplicate
+		if err := rows.Scan(&d.id, &d.owner, &d.folderID, &d.name, &d.isFolder); err != nil {
+			rows.Close()
+			slog.Error("error scanning duplicate names", "error", err.Error())
+			return errors.New("error making node names unique")
+		}
+		duplicates = append(duplicates, d)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("error fetching duplicate names", "error", err.Error())
+		return errors.New("error making node names unique")
+	}
+
+	for _, d := range duplicates {
+		name, err := freeName(tx, d.owner, d.folderID, d.name, d.isFolder, d.id, d.id, util.ConflictRename)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE NODE SET NAME = $1 WHERE ID = $2`, name, d.id)
+		if err != nil {
+			slog.Error("error renaming duplicate", "error", err.Error(), "id", d.id)
+			return errors.New("error making node names unique")
+		}
+		slog.Warn("renamed node sharing its name", "id", d.id, "owner", d.owner, "from", d.name, "to", name)
+	}
+
+	_, err = tx.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS NODE_LIVE_NAME ON NODE (OWNER, PARENT_FOLDER, NAME) WHERE TRASHED_AT IS NULL
+	`)
+	if err != nil {
+		slog.Error("error creating NODE_LIVE_NAME index", "error", err.Error())
+		return errors.New("error making node names unique")
+	}
+	return nil
+}
+
+// migrateLegacyNodes gives the tree saved before users had their own, the
+// nodes without an owner, to the user of LEGACY_OWNER. Without it they stay
+// out of reach, which is logged on every start.
+func migrateLegacyNodes() error {
+	var legacy int64
+	err := DBConnPool.QueryRow(`SELECT count(*) FROM NODE WHERE OWNER = ''`).Scan(&legacy)
+	if err != nil {
+		slog.Error("error counting nodes without owner", "error", err.Error())
+		return errors.New("error migrating database")
+	}
+	if legacy == 0 {
+		return nil
+	}
+	owner := os.Getenv("LEGACY_OWNER")
+	if owner == "" {
+		slog.Warn("nodes saved before users had their own tree are unreachable, set LEGACY_OWNER to give them to a user", "nodes", legacy)
+		return nil
+	}
+	return runMigration(MigrationLegacyOwner, func(tx *pgx.Tx) error {
+		return assignLegacyOwner(tx, owner)
+	})
+}
+
+// assignLegacyOwner moves the nodes without an owner to owner's tree. The
+// old root becomes owner's root, or a "legacy" folder in it when owner has
+// a root already.
+func assignLegacyOwner(tx *pgx.Tx, owner string) error {
+	if err := lockTree(tx, owner); err != nil {
+		return err
+	}
+	var rootID int64
+	err := tx.QueryRow(`SELECT ID FROM NODE WHERE OWNER = $1 AND PARENT_FOLDER IS NULL`, owner).Scan(&rootID)
+	if err != nil && err != pgx.ErrNoRows {
+		slog.Error("error fetching root node", "error", err.Error(), "owner", owner)
+		return errors.New("error assigning legacy nodes")
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+			UPDATE
+				NODE
+			SET
+				PARENT_FOLDER = $1,
+				NAME = CASE
+					WHEN EXISTS (SELECT 1 FROM NODE AS TAKEN WHERE TAKEN.PARENT_FOLDER = $1 AND TAKEN.NAME = 'legacy' AND TAKEN.TRASHED_AT IS NULL) THEN 'legacy-' || NODE.ID
+					ELSE 'legacy'
+				END
+			WHERE
+				OWNER = '' AND PARENT_FOLDER IS NULL
+		`, rootID)
+		if err != nil {
+			slog.Error("error moving legacy root", "error", err.Error(), "owner", owner)
+			return errors.New("error assigning legacy nodes")
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE
+			FILE_METADATA
+		SET
+			AUTHOR = $1
+		WHERE
+			AUTHOR = '' AND NODE_ID IN (SELECT ID FROM NODE WHERE OWNER = '')
+	`, owner)
+	if err != nil {
+		slog.Error("error assigning legacy authors", "error", err.Error(), "owner", owner)
+		return errors.New("error assigning legacy nodes")
+	}
+	_, err = tx.Exec(`UPDATE NODE SET OWNER = $1 WHERE OWNER = ''`, owner)
+	if err != nil {
+		slog.Error("error assigning legacy nodes", "error", err.Error(), "owner", owner)
+		return errors.New("error assigning legacy nodes")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBackfillChunkRefs(t *testing.T) {
+	testDB(t)
+
+	// files saved before CHUNK_REF: nothing counted their chunks
+	rootID := mustID(t, `
+		INSERT INTO NODE (FOLDER, NAME, CREATED_AT, LAST_ACCESS, LAST_MODIFIED)
+		VALUES (true, 'root', current_timestamp, current_timestamp, current_timestamp) RETURNING ID
+	`)
+	fileID := func(name string) int64 {
+		return mustID(t, `
+			INSERT INTO NODE (FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED)
+			VALUES (false, $1, $2, current_timestamp, current_timestamp, current_timestamp) RETURNING ID
+		`, name, rootID)
+	}
+	a, b := fileID("a.txt"), fileID("b.txt")
+	mustExec(t, `INSERT INTO FILE_METADATA (FILE_TYPE, FILE_SIZE, HASH_IDS, NODE_ID) VALUES ('.txt', 1, $1, $2)`,
+		[]string{"AA", "sha256:bb", "aa"}, a)
+	mustExec(t, `INSERT INTO FILE_METADATA (FILE_TYPE, FILE_SIZE, HASH_IDS, NODE_ID) VALUES ('.txt', 1, $1, $2)`,
+		[]string{"sha256:aa"}, b)
+	mustExec(t, `
+		INSERT INTO FILE_VERSION (NODE_ID, VERSION, FILE_TYPE, FILE_SIZE, HASH_IDS, AUTHOR, CREATED_AT)
+		VALUES ($1, 1, '.txt', 1, $2, '', current_timestamp)
+	`, a, []string{"cc"})
+	// a count kept by addChunkRefs since, the recount must not add to it
+	mustExec(t, `INSERT INTO CHUNK_REF (HASH, REF_COUNT) VALUES ('sha256:bb', 1)`)
+	mustExec(t, `DELETE FROM METADATA_MIGRATION`)
+
+	ready, err := ChunkRefsReady()
+	if err != nil || ready {
+		t.Fatalf("ChunkRefsReady before the backfill = %v, %v, want false", ready, err)
+	}
+	if err := runMigration(MigrationChunkRefs, backfillChunkRefs); err != nil {
+		t.Fatalf("backfill: %v", err)
+	}
+	// running it again is a no-op
+	if err := runMigration(MigrationChunkRefs, backfillChunkRefs); err != nil {
+		t.Fatalf("second backfill: %v", err)
+	}
+
+	tests := []struct {
+		hash string
+		want int64
+	}{
+		{"sha256:aa", 2}, // once per file whatever the spelling
+		{"sha256:bb", 1},
+		{"sha256:cc", 1}, // held by an older version
+	}
+	for _, test := range tests {
+		var count int64
+		err := DBConnPool.QueryRow(`SELECT REF_COUNT FROM CHUNK_REF WHERE HASH = $1`, test.hash).Scan(&count)
+		if err != nil || count != test.want {
+			t.Errorf("REF_COUNT of %s = %d, %v, want %d", test.hash, count, err, test.want)
+		}
+	}
+	ready, err = ChunkRefsReady()
+	if err != nil || !ready {
+		t.Errorf("ChunkRefsReady after the backfill = %v, %v, want true", ready, err)
+	}
+}
+
+func TestMigrateLegacyNodes(t *testing.T) {
+	testDB(t)
+	const alice = "alice@example.com"
+
+	// the tree of a single user install, from before NODE had an OWNER
+	legacyRoot := mustID(t, `
+		INSERT INTO NODE (FOLDER, NAME, CREATED_AT, LAST_ACCESS, LAST_MODIFIED)
+		VALUES (true, 'root', current_timestamp, current_timestamp, current_timestamp) RETURNING ID
+	`)
+	legacyFile := mustID(t, `
+		INSERT INTO NODE (FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED)
+		VALUES (false, 'old.txt', $1, current_timestamp, current_timestamp, current_timestamp) RETURNING ID
+	`, legacyRoot)
+	mustExec(t, `INSERT INTO FILE_METADATA (FILE_TYPE, FILE_SIZE, HASH_IDS, NODE_ID) VALUES ('.txt', 1, $1, $2)`,
+		[]string{"sha256:aa"}, legacyFile)
+	// alice used the service since, she has a root of her own
+	aliceRoot, err := RootFolder(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("LEGACY_OWNER", "")
+	if err := migrateLegacyNodes(); err != nil {
+		t.Fatalf("migration without LEGACY_OWNER: %v", err)
+	}
+	if applied, _ := MigrationApplied(MigrationLegacyOwner); applied {
+		t.Fatal("the migration was recorded without an owner to give the nodes to")
+	}
+
+	t.Setenv("LEGACY_OWNER", alice)
+	if err := migrateLegacyNodes(); err != nil {
+		t.Fatalf("migration: %v", err)
+	}
+	folderID, folder, err := ResolvePath(alice, "/legacy")
+	if err != nil || !folder || folderID != legacyRoot {
+		t.Fatalf("ResolvePath /legacy = %d, %v, %v, want the old root %d", folderID, folder, err, legacyRoot)
+	}
+	data, err := FetchMetadata(alice, fmt.Sprint(legacyFile))
+	if err != nil {
+		t.Fatalf("the legacy file isn't alice's: %v", err)
+	}
+	if data.Author != alice {
+		t.Errorf("Author = %q, want %q", data.Author, alice)
+	}
+	if root, err := RootFolder(alice); err != nil || root != aliceRoot {
+		t.Errorf("RootFolder = %d, %v, want %d", root, err, aliceRoot)
+	}
+}
+
+func TestUniqueNodeNames(t *testing.T) {
+	testDB(t)
+	const alice = "alice@example.com"
+	rootID, err := RootFolder(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// saved by racing uploads before names were unique
+	mustExec(t, `DROP INDEX NODE_LIVE_NAME`)
+	mustExec(t, `DELETE FROM METADATA_MIGRATION WHERE NAME = $1`, MigrationUniqueNames)
+	node := func(name string, folder bool) int64 {
+		return mustID(t, `
+			INSERT INTO NODE (OWNER, FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED)
+			VALUES ($1, $2, $3, $4, current_timestamp, current_timestamp, current_timestamp) RETURNING ID
+		`, alice, folder, name, rootID)
+	}
+	first, second := node("a.txt", false), node("a.txt", false)
+	folder, otherFolder := node("docs", true), node("docs", true)
+
+	if err := runMigration(MigrationUniqueNames, uniqueNodeNames); err != nil {
+		t.Fatalf("migration: %v", err)
+	}
+	names := map[int64]string{first: "a.txt", second: "a (1).txt", folder: "docs", otherFolder: "docs (1)"}
+	for id, want := range names {
+		var name string
+		if err := DBConnPool.QueryRow(`SELECT NAME FROM NODE WHERE ID = $1`, id).Scan(&name); err != nil || name != want {
+			t.Errorf("name of %d = %q, %v, want %q", id, name, err, want)
+		}
+	}
+	_, err = DBConnPool.Exec(`
+		INSERT INTO NODE (OWNER, FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED)
+		VALUES ($1, false, 'a.txt', $2, current_timestamp, current_timestamp, current_timestamp)
+	`, alice, rootID)
+	if err == nil {
+		t.Error("a second live a.txt was accepted")
+	}
+}
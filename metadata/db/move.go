@@ -0,0 +1,289 @@
+package db
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/melsonic/skyvault/metadata/types"
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+// maxNumberedNames bounds the names tried by the rename policy
+const maxNumberedNames = 1000
+
+var (
+	ErrNameTaken = errors.New("a node with this name already exists")
+	ErrCycle     = errors.New("a folder can't be moved or copied into itself")
+)
+
+// lockTree serializes the changes to the shape of owner's tree, two moves
+// checking for cycles at the same time could otherwise both pass
+func lockTree(tx *pgx.Tx, owner string) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, owner)
+	if err != nil {
+		slog.Error("error locking tree", "error", err.Error(), "owner", owner)
+		return errors.New("error locking tree")
+	}
+	return nil
+}
+
+// resolveFolder returns the id of the folder nodeID of owner's tree
+func resolveFolder(q rowQuerier, owner string, nodeID string) (int64, error) {
+	if nodeID == ROOT_NAME {
+		rootID, err := RootFolder(owner)
+		return int64(rootID), err
+	}
+	var folderID int64
+	err := q.QueryRow(`
+		SELECT
+			ID
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND OWNER = $2 AND FOLDER AND TRASHED_AT IS NULL
+	`, nodeID, owner).Scan(&folderID)
+	if err == pgx.ErrNoRows {
+		return -1, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching folder", "error", err.Error(), "id", nodeID)
+		return -1, errors.New("error fetching folder")
+	}
+	return folderID, nil
+}
+
+// isDescendant tells whether folderID is nodeID or lies below it
+func isDescendant(tx *pgx.Tx, folderID int64, nodeID int64) (bool, error) {
+	var found bool
+	err := tx.QueryRow(`
+		WITH RECURSIVE ANCESTORS (ID, PARENT_FOLDER) AS (
+			SELECT ID, PARENT_FOLDER FROM NODE WHERE ID = $1
+			UNION
+			SELECT NODE.ID, NODE.PARENT_FOLDER FROM NODE JOIN ANCESTORS ON NODE.ID = ANCESTORS.PARENT_FOLDER
+		)
+		SELECT EXISTS (SELECT 1 FROM ANCESTORS WHERE ID = $2)
+	`, folderID, nodeID).Scan(&found)
+	if err != nil {
+		slog.Error("error walking ancestors", "error", err.Error(), "id", folderID)
+		return false, errors.New("error walking ancestors")
+	}
+	return found, nil
+}
+
+// freeName finds where a node called name can go in folderID according to
+// policy, moving the node in the way to the trash when overwriting. exceptID doesn't
+// count as being in the way, and keepID, the node moved or copied, is
+// never deleted.
+func freeName(tx *pgx.Tx, owner string, folderID int64, name string, isFolder bool, exceptID int64, keepID int64, policy string) (string, error) {
+	candidate := name
+	for n := 1; n <= maxNumberedNames; n++ {
+		var takenID int64
+		var takenFolder bool
+		err := tx.QueryRow(`
+			SELECT
+				ID, FOLDER
+			FROM
+				NODE
+			WHERE
+				PARENT_FOLDER = $1 AND OWNER = $2 AND NAME = $3 AND ID <> $4 AND TRASHED_AT IS NULL
+		`, folderID, owner, candidate, exceptID).Scan(&takenID, &takenFolder)
+		if err == pgx.ErrNoRows {
+			return candidate, nil
+		}
+		if err != nil {
+			slog.Error("error looking up node name", "error", err.Error(), "name", candidate)
+			return "", errors.New("error looking up node name")
+		}
+
+		switch policy {
+		case util.ConflictRename:
+			candidate = util.NumberedName(name, isFolder, n)
+		case util.ConflictOverwrite:
+			// a file replacing a folder would take its whole content with it
+			if takenFolder != isFolder {
+				return "", ErrNameTaken
+			}
+			// nor can the node replace a folder it is inside of
+			inside, err := isDescendant(tx, keepID, takenID)
+			if err != nil {
+				return "", err
+			}
+			if inside {
+				return "", ErrNameTaken
+			}
+			if err := trashSubtree(tx, owner, takenID, folderID); err != nil {
+				return "", err
+			}
+			return candidate, nil
+		default:
+			return "", ErrNameTaken
+		}
+	}
+	return "", ErrNameTaken
+}
+
+// touchFolders sets LAST_MODIFIED of the folders whose content changed
+func touchFolders(tx *pgx.Tx, folderIDs ...int64) error {
+	for _, id := range folderIDs {
+		_, err := tx.Exec(`UPDATE NODE SET LAST_MODIFIED = current_timestamp WHERE ID = $1`, id)
+		if err != nil {
+			slog.Error("error updating folder", "error", err.Error(), "id", id)
+			return errors.New("error updating folder")
+		}
+	}
+	return nil
+}
+
+// fetchNode returns nodeID of owner's tree the way folder listings show it
+func fetchNode(q rowQuerier, owner string, nodeID int64) (*types.Node, error) {
+	var node types.Node
+	err := q.QueryRow(`
+		SELECT
+			NODE.FOLDER, NODE.NAME, COALESCE(FILE_METADATA.FILE_TYPE, ''), COALESCE(FILE_METADATA.FILE_SIZE, 0),
+			NODE.CREATED_AT, NODE.LAST_ACCESS, NODE.LAST_MODIFIED
+		FROM
+			NODE
+			LEFT JOIN FILE_METADATA ON FILE_METADATA.NODE_ID = NODE.ID
+		WHERE
+			NODE.ID = $1 AND NODE.OWNER = $2 AND NODE.TRASHED_AT IS NULL
+	`, nodeID, owner).Scan(&node.IsFolder, &node.Name, &node.FileType, &node.FileSize, &node.CreatedAt, &node.LastAccess, &node.LastModified)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching node", "error", err.Error(), "id", nodeID)
+		return nil, errors.New("error fetching node")
+	}
+	node.NodeID = strconv.FormatInt(nodeID, 10)
+	return &node, nil
+}
+
+// FetchNode returns a file or folder of owner's tree
+func FetchNode(owner string, nodeID int64) (*types.Node, error) {
+	return fetchNode(DBConnPool, owner, nodeID)
+}
+
+// MoveNode renames nodeID of owner's tree and/or moves it to another
+// folder in one transaction. Folders can't go below themselves, and a node
+// of the same name in the destination is handled by request.OnConflict.
+func MoveNode(owner string, nodeID string, request types.MoveRequest) (*types.Node, error) {
+	id, err := strconv.ParseInt(nodeID, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid node id")
+	}
+	if !util.IsConflictPolicy(request.OnConflict) {
+		return nil, errors.New("unknown conflict policy")
+	}
+	if request.Name != "" && !util.IsValidNodeName(request.Name) {
+		return nil, errors.New("invalid node name")
+	}
+
+	tx, err := DBConnPool.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err.Error())
+		return nil, errors.New("error moving node")
+	}
+	defer tx.Rollback()
+	if err := lockTree(tx, owner); err != nil {
+		return nil, err
+	}
+
+	var isFolder bool
+	var name string
+	var parent pgtype.Int8
+	err = tx.QueryRow(`
+		SELECT
+			FOLDER, NAME, PARENT_FOLDER
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND OWNER = $2 AND TRASHED_AT IS NULL
+	`, id, owner).Scan(&isFolder, &name, &parent)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching node", "error", err.Error(), "id", id)
+		return nil, errors.New("error moving node")
+	}
+	if parent.Status == pgtype.Null {
+		return nil, errors.New("root folder can't be moved")
+	}
+	parentID := parent.Int
+
+	newName := name
+	if request.Name != "" {
+		newName = request.Name
+	}
+	newParentID := parentID
+	if request.Parent != "" {
+		newParentID, err = resolveFolder(tx, owner, request.Parent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if isFolder && newParentID != parentID {
+		inside, err := isDescendant(tx, newParentID, id)
+		if err != nil {
+			return nil, err
+		}
+		if inside {
+			return nil, ErrCycle
+		}
+	}
+	var fileType string
+	if !isFolder {
+		extension, err := util.GetFileExtension(newName)
+		if err != nil {
+			return nil, err
+		}
+		fileType = string(extension)
+	}
+
+	if newName != name || newParentID != parentID {
+		newName, err = freeName(tx, owner, newParentID, newName, isFolder, id, id, request.OnConflict)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			UPDATE
+				NODE
+			SET
+				NAME = $1, PARENT_FOLDER = $2
+			WHERE
+				ID = $3
+		`, newName, newParentID, id)
+		if err != nil {
+			slog.Error("error moving node", "error", err.Error(), "id", id)
+			return nil, errors.New("error moving node")
+		}
+		if !isFolder {
+			_, err = tx.Exec(`UPDATE FILE_METADATA SET FILE_TYPE = $1 WHERE NODE_ID = $2`, fileType, id)
+			if err != nil {
+				slog.Error("error updating file type", "error", err.Error(), "id", id)
+				return nil, errors.New("error moving node")
+			}
+		}
+		folders := []int64{parentID}
+		if newParentID != parentID {
+			folders = append(folders, newParentID)
+		}
+		if err := touchFolders(tx, folders...); err != nil {
+			return nil, err
+		}
+	}
+
+	node, err := fetchNode(tx, owner, id)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("error committing move", "error", err.Error(), "id", id)
+		return nil, errors.New("error moving node")
+	}
+	return node, nil
+}
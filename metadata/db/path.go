@@ -0,0 +1,136 @@
+package db
+
+import (
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+// SplitPath returns the names of a slash separated path, ignoring empty ones
+func SplitPath(path string) []string {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// childByName looks a live node up by its name inside folderID
+func childByName(q rowQuerier, owner string, folderID int64, name string) (int64, bool, error) {
+	var childID int64
+	var isFolder bool
+	err := q.QueryRow(`
+		SELECT
+			ID, FOLDER
+		FROM
+			NODE
+		WHERE
+			NAME = $1 AND PARENT_FOLDER = $2 AND OWNER = $3 AND TRASHED_AT IS NULL
+	`, name, folderID, owner).Scan(&childID, &isFolder)
+	if err == pgx.ErrNoRows {
+		return -1, false, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error looking up node", "error", err.Error(), "nodename", name)
+		return -1, false, errors.New("error resolving path")
+	}
+	return childID, isFolder, nil
+}
+
+// ResolvePath walks path through owner's tree one name at a time from the
+// root, every name looked up in the folder before it. An empty path is the
+// root folder.
+func ResolvePath(owner string, path string) (int64, bool, error) {
+	rootID, err := RootFolder(owner)
+	if err != nil {
+		return -1, false, err
+	}
+	nodeID, isFolder := int64(rootID), true
+	for _, name := range SplitPath(path) {
+		if !isFolder {
+			// a file has nothing below it
+			return -1, false, ErrNotFound
+		}
+		nodeID, isFolder, err = childByName(DBConnPool, owner, nodeID, name)
+		if err != nil {
+			return -1, false, err
+		}
+	}
+	return nodeID, isFolder, nil
+}
+
+// ensurePath returns the folder at path below rootID, creating the folders
+// missing on the way like mkdir -p. A file in the way is ErrNameTaken.
+func ensurePath(tx *pgx.Tx, owner string, rootID int64, path string) (int64, error) {
+	folderID := rootID
+	for _, name := range SplitPath(path) {
+		if !util.IsValidNodeName(name) {
+			return -1, errors.New("invalid node name")
+		}
+		childID, isFolder, err := childByName(tx, owner, folderID, name)
+		if err == nil && !isFolder {
+			return -1, ErrNameTaken
+		}
+		if errors.Is(err, ErrNotFound) {
+			err = tx.QueryRow(`
+				INSERT INTO NODE (FOLDER, NAME, PARENT_FOLDER, CREATED_AT, LAST_ACCESS, LAST_MODIFIED, OWNER)
+				VALUES
+					($1, $2, $3, current_timestamp, current_timestamp, current_timestamp, $4)
+				RETURNING ID
+			`, true, name, folderID, owner).Scan(&childID)
+			if err != nil {
+				slog.Error("error inserting node", "error", err.Error(), "nodename", name)
+				return -1, errors.New("error saving node")
+			}
+		}
+		if err != nil {
+			return -1, err
+		}
+		folderID = childID
+	}
+	return folderID, nil
+}
+
+// MakeFolders returns the folder at path in owner's tree, creating the
+// folders missing on the way like mkdir -p
+func MakeFolders(owner string, path string) (int64, error) {
+	return MakeFoldersIn(owner, ROOT_NAME, path)
+}
+
+// MakeFoldersIn is MakeFolders with path starting at the folder parentID
+func MakeFoldersIn(owner string, parentID string, path string) (int64, error) {
+	tx, err := DBConnPool.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err.Error())
+		return -1, errors.New("error saving node")
+	}
+	defer tx.Rollback()
+	folderID, err := makeFolders(tx, owner, parentID, path)
+	if err != nil {
+		return -1, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("error committing folders", "error", err.Error(), "path", path)
+		return -1, errors.New("error saving node")
+	}
+	return folderID, nil
+}
+
+// makeFolders is MakeFoldersIn within tx, which it locks owner's tree in
+func makeFolders(tx *pgx.Tx, owner string, parentID string, path string) (int64, error) {
+	// two uploads to a new folder would create it twice otherwise
+	if err := lockTree(tx, owner); err != nil {
+		return -1, err
+	}
+	startID, err := resolveFolder(tx, owner, parentID)
+	if err != nil {
+		return -1, err
+	}
+	return ensurePath(tx, owner, startID, path)
+}
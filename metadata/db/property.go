@@ -0,0 +1,222 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"unicode"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// maxPropertyKey bounds the length of tags and property keys
+const maxPropertyKey = 128
+
+var (
+	ErrInvalidPropertyKey   = errors.New("invalid tag or property key")
+	ErrInvalidPropertyValue = errors.New("property values are a string, a number or a boolean")
+)
+
+// PropertyFilter keeps the nodes having every tag of Tags and, for every
+// key of Properties, a property of that key whose value reads as the
+// given text ("42" matches the number 42, "true" the boolean)
+type PropertyFilter struct {
+	Tags       []string
+	Properties map[string]string
+}
+
+// conditions returns the SQL conditions of f on NODE, appending their arguments to args
+func (f PropertyFilter) conditions(args *[]any) []string {
+	var conditions []string
+	for _, tag := range f.Tags {
+		*args = append(*args, tag)
+		conditions = append(conditions, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM NODE_PROPERTY WHERE NODE_PROPERTY.NODE_ID = NODE.ID AND NODE_PROPERTY.KEY = $%d AND NODE_PROPERTY.VALUE IS NULL)",
+			len(*args),
+		))
+	}
+	for key, value := range f.Properties {
+		*args = append(*args, key, value)
+		conditions = append(conditions, fmt.Sprintf(
+			"EXISTS (SELECT 1 FROM NODE_PROPERTY WHERE NODE_PROPERTY.NODE_ID = NODE.ID AND NODE_PROPERTY.KEY = $%d AND NODE_PROPERTY.VALUE #>> '{}' = $%d)",
+			len(*args)-1, len(*args),
+		))
+	}
+	return conditions
+}
+
+// IsValidPropertyKey tells whether key can name a tag or a property
+func IsValidPropertyKey(key string) bool {
+	if key == "" || len(key) > maxPropertyKey {
+		return false
+	}
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ownedNode checks that nodeID is a live file or folder of owner's tree,
+// "root" stands for the root folder
+func ownedNode(q rowQuerier, owner string, nodeID string) (int64, error) {
+	if nodeID == ROOT_NAME {
+		rootID, err := RootFolder(owner)
+		return int64(rootID), err
+	}
+	var id int64
+	err := q.QueryRow(`
+		SELECT
+			ID
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND OWNER = $2 AND TRASHED_AT IS NULL
+	`, nodeID, owner).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return -1, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching node", "error", err.Error(), "id", nodeID)
+		return -1, errors.New("error fetching node")
+	}
+	return id, nil
+}
+
+// nodeProperties returns the tags and the properties of nodeID
+func nodeProperties(nodeID int64) (*types.NodeProperties, error) {
+	rows, err := DBConnPool.Query(`
+		SELECT
+			KEY, VALUE::text
+		FROM
+			NODE_PROPERTY
+		WHERE
+			NODE_ID = $1
+		ORDER BY
+			KEY
+	`, nodeID)
+	if err != nil {
+		slog.Error("error fetching properties", "error", err.Error(), "id", nodeID)
+		return nil, errors.New("error fetching properties")
+	}
+	defer rows.Close()
+
+	properties := &types.NodeProperties{Tags: []string{}, Properties: map[string]json.RawMessage{}}
+	for rows.Next() {
+		var key string
+		var value pgtype.Text
+		if err := rows.Scan(&key, &value); err != nil {
+			slog.Error("error scanning properties", "error", err.Error(), "id", nodeID)
+			return nil, errors.New("error fetching properties")
+		}
+		if value.Status == pgtype.Null {
+			properties.Tags = append(properties.Tags, key)
+			continue
+		}
+		properties.Properties[key] = json.RawMessage(value.String)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error fetching properties", "error", err.Error(), "id", nodeID)
+		return nil, errors.New("error fetching properties")
+	}
+	return properties, nil
+}
+
+// FetchProperties returns the tags and the properties of a node of owner's tree
+func FetchProperties(owner string, nodeID string) (*types.NodeProperties, error) {
+	id, err := ownedNode(DBConnPool, owner, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	return nodeProperties(id)
+}
+
+// setProperty stores key on nodeID, a NULL value makes it a tag. A tag and
+// a property can't share a key, setting one replaces the other.
+func setProperty(owner string, nodeID string, key string, value pgtype.Text) error {
+	if !IsValidPropertyKey(key) {
+		return ErrInvalidPropertyKey
+	}
+	id, err := ownedNode(DBConnPool, owner, nodeID)
+	if err != nil {
+		return err
+	}
+	_, err = DBConnPool.Exec(`
+		INSERT INTO NODE_PROPERTY (NODE_ID, KEY, VALUE)
+			VALUES ($1, $2, $3::text::jsonb)
+		ON CONFLICT (NODE_ID, KEY) DO UPDATE SET VALUE = EXCLUDED.VALUE
+	`, id, key, &value)
+	if err != nil {
+		slog.Error("error setting property", "error", err.Error(), "id", id, "key", key)
+		return errors.New("error setting property")
+	}
+	return nil
+}
+
+// SetTag tags a node of owner's tree with tag
+func SetTag(owner string, nodeID string, tag string) error {
+	return setProperty(owner, nodeID, tag, pgtype.Text{Status: pgtype.Null})
+}
+
+// SetProperty sets the property key of a node of owner's tree to value, a
+// JSON string, number or boolean
+func SetProperty(owner string, nodeID string, key string, value json.RawMessage) error {
+	var decoded any
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		return ErrInvalidPropertyValue
+	}
+	switch decoded.(type) {
+	case string, float64, bool:
+	default:
+		return ErrInvalidPropertyValue
+	}
+	return setProperty(owner, nodeID, key, pgtype.Text{String: string(value), Status: pgtype.Present})
+}
+
+// removeProperty deletes key from nodeID, a tag when tag is set
+func removeProperty(owner string, nodeID string, key string, tag bool) error {
+	id, err := ownedNode(DBConnPool, owner, nodeID)
+	if err != nil {
+		return err
+	}
+	_, err = DBConnPool.Exec(`
+		DELETE FROM NODE_PROPERTY WHERE NODE_ID = $1 AND KEY = $2 AND (VALUE IS NULL) = $3
+	`, id, key, tag)
+	if err != nil {
+		slog.Error("error removing property", "error", err.Error(), "id", id, "key", key)
+		return errors.New("error removing property")
+	}
+	return nil
+}
+
+// RemoveTag takes tag off a node of owner's tree
+func RemoveTag(owner string, nodeID string, tag string) error {
+	return removeProperty(owner, nodeID, tag, true)
+}
+
+// RemoveProperty deletes the property key of a node of owner's tree
+func RemoveProperty(owner string, nodeID string, key string) error {
+	return removeProperty(owner, nodeID, key, false)
+}
+
+// copyProperties gives copyID the tags and the properties of nodeID
+func copyProperties(tx *pgx.Tx, nodeID int64, copyID int64) error {
+	_, err := tx.Exec(`
+		INSERT INTO NODE_PROPERTY (NODE_ID, KEY, VALUE)
+			SELECT
+				$1, KEY, VALUE
+			FROM
+				NODE_PROPERTY
+			WHERE
+				NODE_ID = $2
+	`, copyID, nodeID)
+	if err != nil {
+		slog.Error("error copying properties", "error", err.Error(), "id", nodeID)
+		return errors.New("error copying node")
+	}
+	return nil
+}
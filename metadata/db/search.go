@@ -0,0 +1,160 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// ways a search matches names
+const (
+	MatchSubstring = "substring"
+	MatchPrefix    = "prefix"
+	MatchFuzzy     = "fuzzy"
+)
+
+// SearchQuery selects nodes of a subtree, zero fields don't filter
+type SearchQuery struct {
+	// Folder is the subtree searched, "root" or empty for the whole tree
+	Folder string
+	// Name is compared case insensitively according to Match
+	Name  string
+	Match string
+	// FileType, sizes and the ranges of CREATED_AT or LAST_MODIFIED keep only files
+	FileType       string
+	MinSize        int64
+	MaxSize        int64
+	CreatedAfter   time.Time
+	CreatedBefore  time.Time
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	Filter         PropertyFilter
+	Limit          int
+	Offset         int
+}
+
+// likePattern escapes the wildcards of LIKE in value
+func likePattern(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// SearchNodes returns a page of the nodes of owner's tree matching query.
+// Fuzzy matches come by decreasing trigram similarity, the others by name.
+func SearchNodes(owner string, query SearchQuery) (*types.SearchResponse, error) {
+	conditions := []string{"NODE.OWNER = $1", "NODE.TRASHED_AT IS NULL", "NODE.PARENT_FOLDER IS NOT NULL"}
+	args := []any{owner}
+	arg := func(value any) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	subtree := ""
+	if query.Folder != "" && query.Folder != ROOT_NAME {
+		folderID, err := resolveFolder(DBConnPool, owner, query.Folder)
+		if err != nil {
+			return nil, err
+		}
+		// the folders below Folder, the nodes in them are the results
+		subtree = fmt.Sprintf(`
+			WITH RECURSIVE SUBTREE (ID) AS (
+				SELECT %s::bigint
+				UNION
+				SELECT NODE.ID FROM NODE JOIN SUBTREE ON NODE.PARENT_FOLDER = SUBTREE.ID
+				WHERE NODE.FOLDER AND NODE.TRASHED_AT IS NULL
+			)
+		`, arg(folderID))
+		conditions = append(conditions, "NODE.PARENT_FOLDER IN (SELECT ID FROM SUBTREE)")
+	}
+
+	orderBy := "NODE.NAME, NODE.ID"
+	if query.Name != "" {
+		name := strings.ToLower(query.Name)
+		switch query.Match {
+		case "", MatchSubstring:
+			conditions = append(conditions, fmt.Sprintf(`lower(NODE.NAME) LIKE '%%' || %s || '%%'`, arg(likePattern(name))))
+		case MatchPrefix:
+			conditions = append(conditions, fmt.Sprintf(`lower(NODE.NAME) LIKE %s || '%%'`, arg(likePattern(name))))
+		case MatchFuzzy:
+			// word similarity finds the name in longer ones, both go through NODE_NAME_TRGM
+			n := arg(name)
+			conditions = append(conditions, fmt.Sprintf("%s <%% lower(NODE.NAME)", n))
+			orderBy = fmt.Sprintf("word_similarity(%s, lower(NODE.NAME)) DESC, NODE.NAME, NODE.ID", n)
+		default:
+			return nil, errors.New("unknown match")
+		}
+	}
+	if query.FileType != "" {
+		conditions = append(conditions, "lower(FILE_METADATA.FILE_TYPE) = "+arg(strings.ToLower(query.FileType)))
+	}
+	if query.MinSize > 0 {
+		conditions = append(conditions, "FILE_METADATA.FILE_SIZE >= "+arg(query.MinSize))
+	}
+	if query.MaxSize > 0 {
+		conditions = append(conditions, "FILE_METADATA.FILE_SIZE <= "+arg(query.MaxSize))
+	}
+	if !query.CreatedAfter.IsZero() {
+		conditions = append(conditions, "NODE.CREATED_AT >= "+arg(query.CreatedAfter))
+	}
+	if !query.CreatedBefore.IsZero() {
+		conditions = append(conditions, "NODE.CREATED_AT < "+arg(query.CreatedBefore))
+	}
+	if !query.ModifiedAfter.IsZero() {
+		conditions = append(conditions, "NODE.LAST_MODIFIED >= "+arg(query.ModifiedAfter))
+	}
+	if !query.ModifiedBefore.IsZero() {
+		conditions = append(conditions, "NODE.LAST_MODIFIED < "+arg(query.ModifiedBefore))
+	}
+	conditions = append(conditions, query.Filter.conditions(&args)...)
+	// one more row tells whether there is a next page
+	limit := arg(query.Limit + 1)
+	offset := arg(query.Offset)
+
+	rows, err := DBConnPool.Query(fmt.Sprintf(`
+		%s
+		SELECT
+			NODE.ID, NODE.PARENT_FOLDER, NODE.FOLDER, NODE.NAME, COALESCE(FILE_METADATA.FILE_TYPE, ''), COALESCE(FILE_METADATA.FILE_SIZE, 0),
+			NODE.CREATED_AT, NODE.LAST_ACCESS, NODE.LAST_MODIFIED
+		FROM
+			NODE
+			LEFT JOIN FILE_METADATA ON FILE_METADATA.NODE_ID = NODE.ID
+		WHERE
+			%s
+		ORDER BY
+			%s
+		LIMIT %s OFFSET %s
+	`, subtree, strings.Join(conditions, " AND "), orderBy, limit, offset), args...)
+	if err != nil {
+		slog.Error("error searching nodes", "error", err.Error(), "owner", owner)
+		return nil, errors.New("error searching nodes")
+	}
+	defer rows.Close()
+
+	response := &types.SearchResponse{Results: []types.SearchResult{}}
+	for rows.Next() {
+		var result types.SearchResult
+		var id, parentID int64
+		err := rows.Scan(&id, &parentID, &result.IsFolder, &result.Name, &result.FileType, &result.FileSize, &result.CreatedAt, &result.LastAccess, &result.LastModified)
+		if err != nil {
+			slog.Error("error scanning search results", "error", err.Error())
+			return nil, errors.New("error searching nodes")
+		}
+		result.NodeID = strconv.FormatInt(id, 10)
+		result.ParentID = strconv.FormatInt(parentID, 10)
+		response.Results = append(response.Results, result)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error searching nodes", "error", err.Error(), "owner", owner)
+		return nil, errors.New("error searching nodes")
+	}
+
+	if len(response.Results) > query.Limit {
+		response.Results = response.Results[:query.Limit]
+		response.NextOffset = query.Offset + query.Limit
+	}
+	return response, nil
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+var ErrUnknownTier = errors.New("unknown storage tier")
+
+// SetStorageTier pins the chunks of a file of owner's tree to a tier, or unpins them
+func SetStorageTier(owner string, nodeID string, tier string) error {
+	if !util.IsStorageTier(tier) {
+		return ErrUnknownTier
+	}
+	tag, err := DBConnPool.Exec(`
+		UPDATE
+			FILE_METADATA
+		SET
+			STORAGE_TIER = $1
+		FROM
+			NODE
+		WHERE
+			FILE_METADATA.NODE_ID = $2 AND NODE.ID = FILE_METADATA.NODE_ID AND NODE.OWNER = $3 AND NODE.TRASHED_AT IS NULL
+	`, tier, nodeID, owner)
+	if err != nil {
+		slog.Error("error updating storage tier", "error", err.Error(), "node_id", nodeID)
+		return errors.New("error updating storage tier")
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ChunkTierOverrides returns the tier of every chunk belonging to a pinned
+// file, a chunk shared by a hot and a cold file stays hot
+func ChunkTierOverrides() (map[string]string, error) {
+	rows, err := DBConnPool.Query(`
+		SELECT
+			CHUNK.HASH, bool_or(FILE_METADATA.STORAGE_TIER = $1)
+		FROM
+			FILE_METADATA
+			CROSS JOIN LATERAL unnest(FILE_METADATA.HASH_IDS) AS CHUNK(HASH)
+		WHERE
+			FILE_METADATA.STORAGE_TIER <> ''
+		GROUP BY
+			CHUNK.HASH
+	`, util.StorageTierHot)
+	if err != nil {
+		slog.Error("error fetching storage tiers", "error", err.Error())
+		return nil, errors.New("error fetching storage tiers")
+	}
+	defer rows.Close()
+
+	tiers := make(map[string]string)
+	for rows.Next() {
+		var hash string
+		var hot bool
+		if err := rows.Scan(&hash, &hot); err != nil {
+			slog.Error("error scanning storage tier", "error", err.Error())
+			return nil, errors.New("error fetching storage tiers")
+		}
+		// old files may hold bare digests, blobserver knows canonical ones
+		hash = util.CanonicalHash(hash)
+		if hot || tiers[hash] == util.StorageTierHot {
+			tiers[hash] = util.StorageTierHot
+		} else {
+			tiers[hash] = util.StorageTierCold
+		}
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error fetching storage tiers", "error", err.Error())
+		return nil, errors.New("error fetching storage tiers")
+	}
+	return tiers, nil
+}
@@ -0,0 +1,363 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/melsonic/skyvault/metadata/types"
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+const defaultTrashRetention = 30 * 24 * time.Hour
+
+// trashRetention is how long deleted nodes stay in the trash, TRASH_RETENTION
+func trashRetention() time.Duration {
+	value, err := time.ParseDuration(os.Getenv("TRASH_RETENTION"))
+	if err != nil || value <= 0 {
+		return defaultTrashRetention
+	}
+	return value
+}
+
+// folderPath returns the path of folderID below the root of its tree,
+// the way SaveMetadata takes it
+func folderPath(tx *pgx.Tx, folderID int64) (string, error) {
+	var path string
+	err := tx.QueryRow(`
+		WITH RECURSIVE ANCESTORS (ID, NAME, PARENT_FOLDER, DEPTH) AS (
+			SELECT ID, NAME, PARENT_FOLDER, 0 FROM NODE WHERE ID = $1
+			UNION ALL
+			SELECT NODE.ID, NODE.NAME, NODE.PARENT_FOLDER, ANCESTORS.DEPTH + 1 FROM NODE JOIN ANCESTORS ON NODE.ID = ANCESTORS.PARENT_FOLDER
+		)
+		SELECT
+			COALESCE(string_agg(NAME, '/' ORDER BY DEPTH DESC) FILTER (WHERE PARENT_FOLDER IS NOT NULL), '')
+		FROM
+			ANCESTORS
+	`, folderID).Scan(&path)
+	if err != nil {
+		slog.Error("error building folder path", "error", err.Error(), "id", folderID)
+		return "", errors.New("error building folder path")
+	}
+	return path, nil
+}
+
+// trashSubtree moves nodeID, a child of parentID, to the trash with the
+// nodes below it that aren't there already
+func trashSubtree(tx *pgx.Tx, owner string, nodeID int64, parentID int64) error {
+	path, err := folderPath(tx, parentID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		WITH RECURSIVE SUBTREE (ID) AS (
+			SELECT ID FROM NODE WHERE ID = $1 AND OWNER = $2
+			UNION
+			SELECT NODE.ID FROM NODE JOIN SUBTREE ON NODE.PARENT_FOLDER = SUBTREE.ID WHERE NODE.TRASHED_AT IS NULL
+		)
+		UPDATE
+			NODE
+		SET
+			TRASHED_AT = current_timestamp, TRASH_ROOT = $1
+		WHERE
+			ID IN (SELECT ID FROM SUBTREE)
+	`, nodeID, owner)
+	if err != nil {
+		slog.Error("error moving nodes to trash", "error", err.Error(), "id", nodeID)
+		return errors.New("error deleting node")
+	}
+	_, err = tx.Exec(`UPDATE NODE SET TRASH_PATH = $1 WHERE ID = $2`, path, nodeID)
+	if err != nil {
+		slog.Error("error saving trash path", "error", err.Error(), "id", nodeID)
+		return errors.New("error deleting node")
+	}
+	return touchFolders(tx, parentID)
+}
+
+// ListTrash returns what owner deleted, most recent first
+func ListTrash(owner string) ([]types.TrashEntry, error) {
+	rows, err := DBConnPool.Query(`
+		SELECT
+			NODE.ID, NODE.NAME, NODE.FOLDER, COALESCE(FILE_METADATA.FILE_SIZE, 0), COALESCE(NODE.TRASH_PATH, ''), NODE.TRASHED_AT
+		FROM
+			NODE
+			LEFT JOIN FILE_METADATA ON FILE_METADATA.NODE_ID = NODE.ID
+		WHERE
+			NODE.OWNER = $1 AND NODE.TRASH_ROOT = NODE.ID
+		ORDER BY
+			NODE.TRASHED_AT DESC, NODE.ID DESC
+	`, owner)
+	if err != nil {
+		slog.Error("error listing trash", "error", err.Error())
+		return nil, errors.New("error listing trash")
+	}
+	defer rows.Close()
+
+	retention := trashRetention()
+	entries := []types.TrashEntry{}
+	for rows.Next() {
+		var entry types.TrashEntry
+		var id int64
+		err := rows.Scan(&id, &entry.Name, &entry.IsFolder, &entry.FileSize, &entry.OriginalPath, &entry.TrashedAt)
+		if err != nil {
+			slog.Error("error scanning trash", "error", err.Error())
+			return nil, errors.New("error listing trash")
+		}
+		entry.NodeID = strconv.FormatInt(id, 10)
+		entry.PurgeAt = entry.TrashedAt.Add(retention)
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error listing trash", "error", err.Error())
+		return nil, errors.New("error listing trash")
+	}
+	return entries, nil
+}
+
+// RestoreTrash puts a deleted node back where it was, recreating the folders
+// that are gone since. It gets a numbered name when its own is taken.
+func RestoreTrash(owner string, nodeID string) (*types.Node, error) {
+	id, err := strconv.ParseInt(nodeID, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid node id")
+	}
+	tx, err := DBConnPool.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err.Error())
+		return nil, errors.New("error restoring node")
+	}
+	defer tx.Rollback()
+	if err := lockTree(tx, owner); err != nil {
+		return nil, err
+	}
+
+	var name string
+	var isFolder bool
+	var parentID int64
+	var path pgtype.Text
+	err = tx.QueryRow(`
+		SELECT
+			NAME, FOLDER, PARENT_FOLDER, TRASH_PATH
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND OWNER = $2 AND TRASH_ROOT = ID
+	`, id, owner).Scan(&name, &isFolder, &parentID, &path)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching trashed node", "error", err.Error(), "id", id)
+		return nil, errors.New("error restoring node")
+	}
+
+	// the folder may have been deleted too, or purged already
+	var folderID int64
+	err = tx.QueryRow(`
+		SELECT
+			ID
+		FROM
+			NODE
+		WHERE
+			ID = $1 AND OWNER = $2 AND FOLDER AND TRASHED_AT IS NULL
+	`, parentID, owner).Scan(&folderID)
+	if err == pgx.ErrNoRows {
+		rootID, err := RootFolder(owner)
+		if err != nil {
+			return nil, err
+		}
+		folderID, err = ensurePath(tx, owner, int64(rootID), path.String)
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		slog.Error("error fetching folder", "error", err.Error(), "id", parentID)
+		return nil, errors.New("error restoring node")
+	}
+
+	name, err = freeName(tx, owner, folderID, name, isFolder, id, id, util.ConflictRename)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`UPDATE NODE SET TRASHED_AT = NULL, TRASH_ROOT = NULL WHERE TRASH_ROOT = $1`, id)
+	if err != nil {
+		slog.Error("error restoring nodes", "error", err.Error(), "id", id)
+		return nil, errors.New("error restoring node")
+	}
+	_, err = tx.Exec(`UPDATE NODE SET NAME = $1, PARENT_FOLDER = $2, TRASH_PATH = NULL WHERE ID = $3`, name, folderID, id)
+	if err != nil {
+		slog.Error("error restoring node", "error", err.Error(), "id", id)
+		return nil, errors.New("error restoring node")
+	}
+	if err := touchFolders(tx, folderID); err != nil {
+		return nil, err
+	}
+
+	node, err := fetchNode(tx, owner, id)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("error committing restore", "error", err.Error(), "id", id)
+		return nil, errors.New("error restoring node")
+	}
+	return node, nil
+}
+
+// purgeEntry deletes for good the nodes trashed along with trashRoot,
+// releasing the chunk references of their files and versions. The tree of
+// the owner is locked first, so the entry can't be restored or purged by
+// someone else at the same time. An entry that is gone by then is skipped.
+func purgeEntry(tx *pgx.Tx, trashRoot int64) error {
+	var owner string
+	err := tx.QueryRow(`SELECT OWNER FROM NODE WHERE ID = $1 AND TRASH_ROOT = ID`, trashRoot).Scan(&owner)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		slog.Error("error fetching trash entry", "error", err.Error(), "id", trashRoot)
+		return errors.New("error purging trash")
+	}
+	if err := lockTree(tx, owner); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT ID FROM NODE WHERE TRASH_ROOT = $1 FOR UPDATE`, trashRoot)
+	if err != nil {
+		slog.Error("error fetching trashed nodes", "error", err.Error(), "id", trashRoot)
+		return errors.New("error purging trash")
+	}
+	var nodeIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			slog.Error("error fetching id from rows", "error", err.Error())
+			return errors.New("error purging trash")
+		}
+		nodeIDs = append(nodeIDs, id)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error fetching id from rows end", "error", err.Error())
+		return errors.New("error purging trash")
+	}
+
+	for _, id := range nodeIDs {
+		if err := deleteVersions(tx, id); err != nil {
+			return err
+		}
+		if err := deleteFileContent(tx, id); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM NODE WHERE ID = $1`, id)
+		if err != nil {
+			slog.Error("error deleting row node", "error", err.Error(), "id", id)
+			return errors.New("error purging trash")
+		}
+	}
+	return nil
+}
+
+// purgeEntries purges the given trash entries, each in its own transaction
+func purgeEntries(trashRoots []int64) error {
+	for _, id := range trashRoots {
+		tx, err := DBConnPool.Begin()
+		if err != nil {
+			slog.Error("error starting transaction", "error", err.Error())
+			return errors.New("error purging trash")
+		}
+		err = purgeEntry(tx, id)
+		if err == nil {
+			err = tx.Commit()
+		}
+		tx.Rollback()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashEntries returns the trash entries a query selects
+func trashEntries(query string, args ...any) ([]int64, error) {
+	rows, err := DBConnPool.Query(query, args...)
+	if err != nil {
+		slog.Error("error fetching trash entries", "error", err.Error())
+		return nil, errors.New("error purging trash")
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			slog.Error("error scanning trash entry", "error", err.Error())
+			return nil, errors.New("error purging trash")
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error fetching trash entries", "error", err.Error())
+		return nil, errors.New("error purging trash")
+	}
+	return ids, nil
+}
+
+// PurgeTrash deletes one of owner's trash entries for good
+func PurgeTrash(owner string, nodeID string) error {
+	ids, err := trashEntries(`SELECT ID FROM NODE WHERE ID = $1 AND OWNER = $2 AND TRASH_ROOT = ID`, nodeID, owner)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return ErrNotFound
+	}
+	return purgeEntries(ids)
+}
+
+// EmptyTrash deletes everything in owner's trash for good
+func EmptyTrash(owner string) (int, error) {
+	ids, err := trashEntries(`SELECT ID FROM NODE WHERE OWNER = $1 AND TRASH_ROOT = ID`, owner)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), purgeEntries(ids)
+}
+
+// PurgeExpiredTrash deletes for good the trash entries older than TRASH_RETENTION
+func PurgeExpiredTrash() (int, error) {
+	cutoff := time.Now().Add(-trashRetention())
+	ids, err := trashEntries(`SELECT ID FROM NODE WHERE TRASH_ROOT = ID AND TRASHED_AT < $1`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), purgeEntries(ids)
+}
+
+// StartTrashPurger runs PurgeExpiredTrash every hour
+func StartTrashPurger(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Hour)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				purged, err := PurgeExpiredTrash()
+				if err != nil {
+					slog.Error("error purging expired trash", "error", err.Error())
+					continue
+				}
+				slog.Info("expired trash purged", "entries", purged)
+
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
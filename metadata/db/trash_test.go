@@ -0,0 +1,87 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// refCount returns the REF_COUNT of a chunk, 0 when it has no row
+func refCount(t *testing.T, hash string) int64 {
+	t.Helper()
+	var count int64
+	err := DBConnPool.QueryRow(`SELECT COALESCE(max(REF_COUNT), 0) FROM CHUNK_REF WHERE HASH = $1`, hash).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestConcurrentPurgeAndRestore(t *testing.T) {
+	testDB(t)
+	const alice = "alice@example.com"
+	shared := strings.Repeat("a", 64)
+	testFile(t, alice, "/keep", "kept.txt", shared)
+
+	for round := range 10 {
+		deleted := testFile(t, alice, "/gone", "deleted.txt", shared)
+		if err := DeleteMetadata(alice, deleted); err != nil {
+			t.Fatal(err)
+		}
+
+		// purges from several places and a restore, all at once
+		var wg sync.WaitGroup
+		errs := make(chan error, 5)
+		for range 3 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := PurgeTrash(alice, deleted); err != nil && !errors.Is(err, ErrNotFound) {
+					errs <- err
+				}
+			}()
+		}
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := EmptyTrash(alice); err != nil {
+				errs <- err
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := RestoreTrash(alice, deleted); err != nil && !errors.Is(err, ErrNotFound) {
+				errs <- err
+			}
+		}()
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("round %d: %v", round, err)
+		}
+
+		var files int64
+		err := DBConnPool.QueryRow(`
+			SELECT count(*) FROM NODE JOIN FILE_METADATA ON FILE_METADATA.NODE_ID = NODE.ID WHERE NODE.TRASHED_AT IS NULL
+		`).Scan(&files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := refCount(t, "sha256:"+shared); count != files {
+			t.Fatalf("round %d: REF_COUNT = %d with %d files using the chunk", round, count, files)
+		}
+		// whatever was restored is deleted again for the next round
+		if files == 2 {
+			if err := DeleteMetadata(alice, deleted); err != nil {
+				t.Fatal(err)
+			}
+			if err := PurgeTrash(alice, deleted); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if count := refCount(t, "sha256:"+shared); count != 1 {
+			t.Fatalf("round %d: REF_COUNT = %d once purged, want 1", round, count)
+		}
+	}
+}
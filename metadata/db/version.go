@@ -0,0 +1,450 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/pgtype"
+	"github.com/melsonic/skyvault/metadata/types"
+	"github.com/melsonic/skyvault/metadata/util"
+)
+
+var ErrVersionNotFound = errors.New("version not found")
+
+// versionRetention reads how many older versions of a file are kept,
+// VERSION_KEEP_LAST of them and the ones younger than VERSION_KEEP_DAYS.
+// A version goes once it is outside both, with neither set all are kept.
+func versionRetention() (keepLast int, keepDays int) {
+	keepLast, _ = strconv.Atoi(os.Getenv("VERSION_KEEP_LAST"))
+	keepDays, _ = strconv.Atoi(os.Getenv("VERSION_KEEP_DAYS"))
+	return max(keepLast, 0), max(keepDays, 0)
+}
+
+// saveVersion makes data the current content of the file nodeID, the
+// content it replaces becomes its latest older version
+func saveVersion(tx *pgx.Tx, nodeID int64, data *types.Metadata, fileType string) error {
+	if err := archiveVersion(tx, nodeID); err != nil {
+		return err
+	}
+	err := replaceContent(tx, nodeID, fileType, data.FileSize, data.Hashes, data.Author)
+	if err != nil {
+		return err
+	}
+	if data.StorageTier != "" {
+		_, err = tx.Exec(`UPDATE FILE_METADATA SET STORAGE_TIER = $1 WHERE NODE_ID = $2`, data.StorageTier, nodeID)
+		if err != nil {
+			slog.Error("error updating storage tier", "error", err.Error(), "node_id", nodeID)
+			return errors.New("error saving version")
+		}
+	}
+	if err := pruneVersions(tx, nodeID); err != nil {
+		return err
+	}
+	err = tx.QueryRow(`
+		SELECT
+			NODE.CREATED_AT, NODE.LAST_ACCESS, NODE.LAST_MODIFIED, FILE_METADATA.VERSION
+		FROM
+			NODE, FILE_METADATA
+		WHERE
+			NODE.ID = FILE_METADATA.NODE_ID AND NODE.ID = $1
+	`, nodeID).Scan(&data.CreatedAt, &data.LastAccess, &data.LastModified, &data.Version)
+	if err != nil {
+		slog.Error("error fetching saved version", "error", err.Error(), "node_id", nodeID)
+		return errors.New("error saving version")
+	}
+	return nil
+}
+
+// archiveVersion copies the current content of the file nodeID to
+// FILE_VERSION, locking it until tx ends. The chunk references it holds
+// go along with it.
+func archiveVersion(tx *pgx.Tx, nodeID int64) error {
+	var version int
+	err := tx.QueryRow(`SELECT VERSION FROM FILE_METADATA WHERE NODE_ID = $1 FOR UPDATE`, nodeID).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error locking file", "error", err.Error(), "node_id", nodeID)
+		return errors.New("error saving version")
+	}
+	_, err = tx.Exec(`
+		INSERT INTO FILE_VERSION (NODE_ID, VERSION, FILE_TYPE, FILE_SIZE, HASH_IDS, AUTHOR, CREATED_AT)
+			SELECT
+				FILE_METADATA.NODE_ID, FILE_METADATA.VERSION, FILE_METADATA.FILE_TYPE, FILE_METADATA.FILE_SIZE,
+				FILE_METADATA.HASH_IDS, FILE_METADATA.AUTHOR, NODE.LAST_MODIFIED
+			FROM
+				FILE_METADATA
+				JOIN NODE ON NODE.ID = FILE_METADATA.NODE_ID
+			WHERE
+				FILE_METADATA.NODE_ID = $1
+	`, nodeID)
+	if err != nil {
+		slog.Error("error archiving version", "error", err.Error(), "node_id", nodeID)
+		return errors.New("error saving version")
+	}
+	return nil
+}
+
+// replaceContent makes hashes the next version of the file nodeID
+func replaceContent(tx *pgx.Tx, nodeID int64, fileType string, fileSize int, hashes []string, author string) error {
+	_, err := tx.Exec(`
+		UPDATE
+			FILE_METADATA
+		SET
+			FILE_TYPE = $1, FILE_SIZE = $2, HASH_IDS = $3, VERSION = VERSION + 1, AUTHOR = $4
+		WHERE
+			NODE_ID = $5
+	`, fileType, fileSize, util.FormatHashedChunks(hashes), author, nodeID)
+	if err != nil {
+		slog.Error("error replacing file content", "error", err.Error(), "node_id", nodeID)
+		return errors.New("error saving version")
+	}
+	_, err = tx.Exec(`UPDATE NODE SET LAST_MODIFIED = current_timestamp WHERE ID = $1`, nodeID)
+	if err != nil {
+		slog.Error("error updating node", "error", err.Error(), "node_id", nodeID)
+		return errors.New("error saving version")
+	}
+	return addChunkRefs(tx, hashes)
+}
+
+// removeVersions deletes the FILE_VERSION rows a query selects the ids of
+// and the chunk references they hold. References are only released for the
+// rows this transaction deleted, a concurrent prune of the same file can't
+// release them twice.
+func removeVersions(tx *pgx.Tx, query string, args ...any) (int, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		slog.Error("error fetching versions", "error", err.Error())
+		return 0, errors.New("error deleting versions")
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			slog.Error("error scanning version", "error", err.Error())
+			return 0, errors.New("error deleting versions")
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error fetching versions", "error", err.Error())
+		return 0, errors.New("error deleting versions")
+	}
+
+	removed := 0
+	for _, id := range ids {
+		var hashIDs pgtype.TextArray
+		err := tx.QueryRow(`DELETE FROM FILE_VERSION WHERE ID = $1 RETURNING HASH_IDS`, id).Scan(&hashIDs)
+		if err == pgx.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			slog.Error("error deleting version", "error", err.Error(), "id", id)
+			return 0, errors.New("error deleting versions")
+		}
+		hashes := make([]string, len(hashIDs.Elements))
+		for i := range hashIDs.Elements {
+			hashes[i] = hashIDs.Elements[i].String
+		}
+		if err := releaseHashRefs(tx, hashes); err != nil {
+			return 0, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// deleteVersions drops every older version of the file nodeID,
+// it must run before the NODE row is deleted
+func deleteVersions(tx *pgx.Tx, nodeID int64) error {
+	_, err := removeVersions(tx, `SELECT ID FROM FILE_VERSION WHERE NODE_ID = $1`, nodeID)
+	return err
+}
+
+// pruneVersions drops the older versions of the file nodeID the retention
+// policy doesn't keep anymore
+func pruneVersions(tx *pgx.Tx, nodeID int64) error {
+	keepLast, keepDays := versionRetention()
+	if keepLast == 0 && keepDays == 0 {
+		return nil
+	}
+	_, err := removeVersions(tx, `
+		WITH RANKED AS (
+			SELECT
+				ID, CREATED_AT, row_number() OVER (ORDER BY VERSION DESC) AS RECENCY
+			FROM
+				FILE_VERSION
+			WHERE
+				NODE_ID = $1
+		)
+		SELECT
+			ID
+		FROM
+			RANKED
+		WHERE
+			($2 = 0 OR RECENCY > $2) AND ($3 = 0 OR CREATED_AT < current_timestamp - make_interval(days => $3))
+	`, nodeID, keepLast, keepDays)
+	return err
+}
+
+// rowQuerier is a connection pool or a transaction
+type rowQuerier interface {
+	QueryRow(sql string, args ...any) *pgx.Row
+}
+
+// ownedFile checks that nodeID is a file of owner's tree
+func ownedFile(q rowQuerier, owner string, nodeID string) (int64, error) {
+	var id int64
+	err := q.QueryRow(`
+		SELECT
+			NODE.ID
+		FROM
+			NODE, FILE_METADATA
+		WHERE
+			NODE.ID = FILE_METADATA.NODE_ID AND NODE.ID = $1 AND NODE.OWNER = $2 AND NODE.TRASHED_AT IS NULL
+	`, nodeID, owner).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return -1, ErrNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching file", "error", err.Error(), "id", nodeID)
+		return -1, errors.New("error fetching file")
+	}
+	return id, nil
+}
+
+// ListVersions returns the current and the older versions of a file of
+// owner's tree, newest first
+func ListVersions(owner string, nodeID string) ([]types.FileVersion, error) {
+	id, err := ownedFile(DBConnPool, owner, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DBConnPool.Query(`
+		SELECT
+			FILE_METADATA.VERSION, FILE_METADATA.FILE_TYPE, FILE_METADATA.FILE_SIZE, FILE_METADATA.AUTHOR, NODE.LAST_MODIFIED, true
+		FROM
+			FILE_METADATA
+			JOIN NODE ON NODE.ID = FILE_METADATA.NODE_ID
+		WHERE
+			FILE_METADATA.NODE_ID = $1
+		UNION ALL
+		SELECT
+			VERSION, FILE_TYPE, FILE_SIZE, AUTHOR, CREATED_AT, false
+		FROM
+			FILE_VERSION
+		WHERE
+			NODE_ID = $1
+		ORDER BY
+			1 DESC
+	`, id)
+	if err != nil {
+		slog.Error("error listing versions", "error", err.Error(), "node_id", id)
+		return nil, errors.New("error listing versions")
+	}
+	defer rows.Close()
+
+	versions := []types.FileVersion{}
+	for rows.Next() {
+		var version types.FileVersion
+		err := rows.Scan(&version.Version, &version.FileType, &version.FileSize, &version.Author, &version.CreatedAt, &version.Current)
+		if err != nil {
+			slog.Error("error scanning version", "error", err.Error())
+			return nil, errors.New("error listing versions")
+		}
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error listing versions", "error", err.Error(), "node_id", id)
+		return nil, errors.New("error listing versions")
+	}
+	return versions, nil
+}
+
+// FetchVersion returns a version of a file of owner's tree with the
+// chunks to download it from
+func FetchVersion(owner string, nodeID string, version int) (*types.Metadata, error) {
+	current, err := FetchMetadata(owner, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	if current.Version == version {
+		return current, nil
+	}
+
+	var hashIDs pgtype.TextArray
+	data := types.Metadata{FileNodeId: nodeID, FileName: current.FileName, Version: version}
+	err = DBConnPool.QueryRow(`
+		SELECT
+			FILE_SIZE, HASH_IDS, AUTHOR, CREATED_AT
+		FROM
+			FILE_VERSION
+		WHERE
+			NODE_ID = $1 AND VERSION = $2
+	`, nodeID, version).Scan(&data.FileSize, &hashIDs, &data.Author, &data.LastModified)
+	if err == pgx.ErrNoRows {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching version", "error", err.Error(), "node_id", nodeID)
+		return nil, errors.New("error fetching version")
+	}
+	data.CreatedAt = current.CreatedAt
+	data.LastAccess = current.LastAccess
+	for i := range hashIDs.Elements {
+		data.Hashes = append(data.Hashes, hashIDs.Elements[i].String)
+	}
+	return &data, nil
+}
+
+// RestoreVersion makes an older version of a file of owner's tree its
+// current content again. The restored content becomes a new version, so
+// the one it replaces isn't lost.
+func RestoreVersion(owner string, author string, nodeID string, version int) (*types.Metadata, error) {
+	tx, err := DBConnPool.Begin()
+	if err != nil {
+		slog.Error("error starting transaction", "error", err.Error())
+		return nil, errors.New("error restoring version")
+	}
+	defer tx.Rollback()
+
+	id, err := ownedFile(tx, owner, nodeID)
+	if err != nil {
+		return nil, err
+	}
+	var fileType string
+	var fileSize int
+	var hashIDs pgtype.TextArray
+	err = tx.QueryRow(`
+		SELECT
+			FILE_TYPE, FILE_SIZE, HASH_IDS
+		FROM
+			FILE_VERSION
+		WHERE
+			NODE_ID = $1 AND VERSION = $2
+	`, id, version).Scan(&fileType, &fileSize, &hashIDs)
+	if err == pgx.ErrNoRows {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		slog.Error("error fetching version", "error", err.Error(), "node_id", id)
+		return nil, errors.New("error restoring version")
+	}
+	hashes := make([]string, len(hashIDs.Elements))
+	for i := range hashIDs.Elements {
+		hashes[i] = hashIDs.Elements[i].String
+	}
+
+	if err := archiveVersion(tx, id); err != nil {
+		return nil, err
+	}
+	if err := replaceContent(tx, id, fileType, fileSize, hashes, author); err != nil {
+		return nil, err
+	}
+	if err := pruneVersions(tx, id); err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		slog.Error("error committing restore", "error", err.Error(), "node_id", id)
+		return nil, errors.New("error restoring version")
+	}
+	return FetchMetadata(owner, nodeID)
+}
+
+// PruneExpiredVersions applies the VERSION_KEEP_DAYS retention to every file,
+// versions only age out between saves of the file otherwise
+func PruneExpiredVersions() (int, error) {
+	_, keepDays := versionRetention()
+	if keepDays == 0 {
+		return 0, nil
+	}
+	rows, err := DBConnPool.Query(`
+		SELECT DISTINCT
+			NODE_ID
+		FROM
+			FILE_VERSION
+		WHERE
+			CREATED_AT < current_timestamp - make_interval(days => $1)
+	`, keepDays)
+	if err != nil {
+		slog.Error("error fetching expired versions", "error", err.Error())
+		return 0, errors.New("error pruning versions")
+	}
+	var nodeIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			slog.Error("error scanning expired version", "error", err.Error())
+			return 0, errors.New("error pruning versions")
+		}
+		nodeIDs = append(nodeIDs, id)
+	}
+	if err = rows.Err(); err != nil {
+		slog.Error("error fetching expired versions", "error", err.Error())
+		return 0, errors.New("error pruning versions")
+	}
+
+	for _, id := range nodeIDs {
+		tx, err := DBConnPool.Begin()
+		if err != nil {
+			slog.Error("error starting transaction", "error", err.Error())
+			return 0, errors.New("error pruning versions")
+		}
+		err = pruneFile(tx, id)
+		if err == nil {
+			err = tx.Commit()
+		}
+		tx.Rollback()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(nodeIDs), nil
+}
+
+// pruneFile locks the file nodeID the way a save does and prunes its
+// versions, a file deleted since is skipped
+func pruneFile(tx *pgx.Tx, nodeID int64) error {
+	var version int
+	err := tx.QueryRow(`SELECT VERSION FROM FILE_METADATA WHERE NODE_ID = $1 FOR UPDATE`, nodeID).Scan(&version)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		slog.Error("error locking file", "error", err.Error(), "node_id", nodeID)
+		return errors.New("error pruning versions")
+	}
+	return pruneVersions(tx, nodeID)
+}
+
+// StartVersionPruner runs PruneExpiredVersions every hour
+func StartVersionPruner(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Hour)
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				files, err := PruneExpiredVersions()
+				if err != nil {
+					slog.Error("error pruning expired versions", "error", err.Error())
+					continue
+				}
+				slog.Info("expired versions pruned", "files", files)
+
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// usedBy counts the files and older versions listing a chunk
+func usedBy(t *testing.T, hash string) int64 {
+	t.Helper()
+	var count int64
+	err := DBConnPool.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM FILE_METADATA WHERE $1 = ANY(HASH_IDS)) + (SELECT count(*) FROM FILE_VERSION WHERE $1 = ANY(HASH_IDS))
+	`, hash).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestVersionRetentionReleasesRefs(t *testing.T) {
+	testDB(t)
+	t.Setenv("VERSION_KEEP_LAST", "2")
+	t.Setenv("VERSION_KEEP_DAYS", "")
+	const alice = "alice@example.com"
+	shared := "sha256:" + strings.Repeat("a", 64)
+	unique := func(i int) string {
+		return "sha256:" + strings.Repeat(strconv.Itoa(i), 64)
+	}
+	save := func(i int) error {
+		data := types.Metadata{FileName: "report.txt", FilePath: "/docs", Hashes: []string{shared, unique(i)}, FileSize: 2}
+		_, err := SaveMetadata(alice, &data)
+		return err
+	}
+	checkRefs := func(hashes ...string) {
+		t.Helper()
+		for _, hash := range hashes {
+			if count, used := refCount(t, hash), usedBy(t, hash); count != used {
+				t.Errorf("REF_COUNT of %s = %d, used %d times", hash, count, used)
+			}
+		}
+	}
+
+	for i := 1; i <= 4; i++ {
+		if err := save(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var versions int64
+	if err := DBConnPool.QueryRow(`SELECT count(*) FROM FILE_VERSION`).Scan(&versions); err != nil || versions != 2 {
+		t.Fatalf("older versions kept = %d, %v, want 2", versions, err)
+	}
+	if count := refCount(t, unique(1)); count != 0 {
+		t.Errorf("REF_COUNT of a pruned version's chunk = %d, want 0", count)
+	}
+	checkRefs(shared, unique(1), unique(2), unique(3), unique(4))
+
+	// every older version ages out, pruners and a save race for them
+	t.Setenv("VERSION_KEEP_LAST", "")
+	t.Setenv("VERSION_KEEP_DAYS", "1")
+	mustExec(t, `UPDATE FILE_VERSION SET CREATED_AT = current_timestamp - interval '2 days'`)
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = PruneExpiredVersions()
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs[4] = save(5)
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRefs(shared, unique(2), unique(3), unique(4), unique(5))
+	for _, i := range []int{2, 3} {
+		if count := refCount(t, unique(i)); count != 0 {
+			t.Errorf("REF_COUNT of expired version %d = %d, want 0", i, count)
+		}
+	}
+}
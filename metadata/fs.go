@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/melsonic/skyvault/metadata/db"
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// writePathError answers the errors the /fs handlers share
+func writePathError(w http.ResponseWriter, filePath string, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no such file or folder: /" + filePath))
+	case errors.Is(err, db.ErrNameTaken):
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+	default:
+		slog.Error("error handling path", "path", filePath, "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// fsGetHandler returns the file at a path, or lists the folder at it the
+// way childrenHandler does. /fs/ is the root folder.
+func fsGetHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	filePath := r.PathValue("path")
+	nodeID, isFolder, err := db.ResolvePath(owner, filePath)
+	if err != nil {
+		writePathError(w, filePath, err)
+		return
+	}
+	if isFolder {
+		query, ok := childrenQuery(w, r)
+		if !ok {
+			return
+		}
+		writeChildren(w, owner, strconv.FormatInt(nodeID, 10), query)
+		return
+	}
+
+	data, err := db.FetchMetadata(owner, strconv.FormatInt(nodeID, 10))
+	if err != nil {
+		writePathError(w, filePath, err)
+		return
+	}
+	data.FileNodeId = strconv.FormatInt(nodeID, 10)
+	data.FilePath = path.Dir("/" + filePath)
+	writeJSON(w, data)
+}
+
+// fsPutBody reads the body of PUT /fs: none makes a folder, any other one
+// is a file unless it says is_folder. The path alone places the node and
+// owner authors it, whatever the body says.
+func fsPutBody(owner string, body []byte) (types.Metadata, error) {
+	if len(body) == 0 {
+		return types.Metadata{IsFolder: true}, nil
+	}
+	var data types.Metadata
+	if err := json.Unmarshal(body, &data); err != nil {
+		return data, err
+	}
+	data.Parent = ""
+	data.Author = owner
+	return data, nil
+}
+
+// fsPutHandler creates the folder at a path with the ones missing above it
+// like mkdir -p. A body describing a file saves that file there instead,
+// as a new version when one exists already.
+func fsPutHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	filePath := r.PathValue("path")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	data, err := fsPutBody(owner, body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+
+	if data.IsFolder {
+		folderID, err := db.MakeFolders(owner, filePath)
+		if err != nil {
+			writePathError(w, filePath, err)
+			return
+		}
+		node, err := db.FetchNode(owner, folderID)
+		if err != nil {
+			writePathError(w, filePath, err)
+			return
+		}
+		writeJSON(w, node)
+		return
+	}
+
+	if len(db.SplitPath(filePath)) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("a file needs a name"))
+		return
+	}
+	if !readableHashes(w, owner, data.Hashes) {
+		return
+	}
+	data.FilePath = path.Dir("/" + filePath)
+	data.FileName = path.Base("/" + filePath)
+	nodeID, err := db.SaveMetadata(owner, &data)
+	if err != nil {
+		writePathError(w, filePath, err)
+		return
+	}
+	data.FileNodeId = strconv.Itoa(nodeID)
+	writeJSON(w, data)
+}
+
+// fsDeleteHandler moves the file or folder at a path to the trash
+func fsDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	filePath := r.PathValue("path")
+	nodeID, _, err := db.ResolvePath(owner, filePath)
+	if err != nil {
+		writePathError(w, filePath, err)
+		return
+	}
+	err = db.DeleteMetadata(owner, strconv.FormatInt(nodeID, 10))
+	if err != nil {
+		writePathError(w, filePath, err)
+		return
+	}
+	w.Write([]byte("node moved to trash!"))
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestFsPutBody(t *testing.T) {
+	const owner = "alice@example.com"
+	tests := []struct {
+		name   string
+		body   string
+		folder bool
+	}{
+		{"no body", "", true},
+		{"file", `{"hashes": ["sha256:aa"], "filesize": 2}`, false},
+		{"empty file", `{"filesize": 0}`, false},
+		{"folder", `{"is_folder": true}`, true},
+	}
+	for _, test := range tests {
+		data, err := fsPutBody(owner, []byte(test.body))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if data.IsFolder != test.folder {
+			t.Errorf("%s: IsFolder = %v, want %v", test.name, data.IsFolder, test.folder)
+		}
+	}
+
+	// the path places the node and the caller authors it
+	data, err := fsPutBody(owner, []byte(`{"hashes": ["sha256:aa"], "parent": "42", "author": "mallory@example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Parent != "" || data.Author != owner {
+		t.Errorf("Parent, Author = %q, %q, want \"\", %q", data.Parent, data.Author, owner)
+	}
+
+	if _, err := fsPutBody(owner, []byte("{")); err == nil {
+		t.Error("a malformed body was accepted")
+	}
+}
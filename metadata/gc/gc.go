@@ -0,0 +1,173 @@
+package gc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/melsonic/skyvault/metadata/db"
+)
+
+const (
+	defaultInterval    = 24 * time.Hour
+	defaultGracePeriod = 24 * time.Hour
+)
+
+// Report summarises one garbage collection run
+type Report struct {
+	StartedAt      time.Time `json:"started_at"`
+	DurationMs     int64     `json:"duration_ms"`
+	ChunksScanned  int       `json:"chunks_scanned"`
+	ChunksDeleted  int       `json:"chunks_deleted"`
+	BytesReclaimed int64     `json:"bytes_reclaimed"`
+	Errors         int       `json:"errors"`
+}
+
+// storedChunk is one line of the blobserver GET /chunks listing
+type storedChunk struct {
+	Hash         string    `json:"hash"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+func blobserverURL() string {
+	return os.Getenv("BLOBSERVER_URL")
+}
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// Run does one mark and sweep pass: the mark phase loads every chunk
+// referenced by a file, the sweep phase walks the chunks stored in
+// blobserver and deletes the unreferenced ones. Chunks younger than the
+// grace period are skipped because their file may still be uploading
+// and its metadata not saved yet.
+func Run(ctx context.Context) (*Report, error) {
+	report := &Report{StartedAt: time.Now()}
+	gracePeriod := durationFromEnv("GC_GRACE_PERIOD", defaultGracePeriod)
+	cutoff := report.StartedAt.Add(-gracePeriod)
+
+	// until then every chunk of the files saved before CHUNK_REF looks unreferenced
+	ready, err := db.ChunkRefsReady()
+	if err != nil {
+		return nil, err
+	}
+	if !ready {
+		return nil, errors.New("chunk references aren't backfilled yet, not sweeping")
+	}
+
+	referenced, err := db.ReferencedChunks()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, blobserverURL()+"/chunks", nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		slog.Error("error listing chunks", "error", err.Error())
+		return nil, errors.New("error listing chunks")
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing chunks: %s", response.Status)
+	}
+
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var chunk storedChunk
+		if err := json.Unmarshal(scanner.Bytes(), &chunk); err != nil {
+			slog.Error("error decoding chunk listing", "error", err.Error())
+			return report, errors.New("error decoding chunk listing")
+		}
+		report.ChunksScanned++
+		if _, ok := referenced[chunk.Hash]; ok || chunk.LastModified.After(cutoff) {
+			continue
+		}
+		deleted, err := sweep(ctx, chunk.Hash)
+		if err != nil {
+			slog.Error("error sweeping chunk", "hash", chunk.Hash, "error", err.Error())
+			report.Errors++
+			continue
+		}
+		if !deleted {
+			continue
+		}
+		report.ChunksDeleted++
+		report.BytesReclaimed += chunk.Size
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("error reading chunk listing", "error", err.Error())
+		return report, errors.New("error reading chunk listing")
+	}
+	report.DurationMs = time.Since(report.StartedAt).Milliseconds()
+	return report, nil
+}
+
+// sweep deletes a single chunk from blobserver after checking once more
+// that no file picked it up since the mark phase
+func sweep(ctx context.Context, hash string) (bool, error) {
+	referenced, err := db.IsChunkReferenced(hash)
+	if err != nil || referenced {
+		return false, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodDelete, blobserverURL()+"/chunk/"+url.PathEscape(hash), nil)
+	if err != nil {
+		return false, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusConflict {
+		// a client was told the chunk exists and is about to reference it
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("blobserver answered %s", response.Status)
+	}
+	return true, db.ForgetChunk(hash)
+}
+
+// StartCollector runs the garbage collector every GC_INTERVAL
+func StartCollector(ctx context.Context) {
+	ticker := time.NewTicker(durationFromEnv("GC_INTERVAL", defaultInterval))
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				report, err := Run(ctx)
+				if err != nil {
+					slog.Error("error collecting unreferenced chunks", "error", err.Error())
+					continue
+				}
+				slog.Info("chunk garbage collection done",
+					"scanned", report.ChunksScanned,
+					"deleted", report.ChunksDeleted,
+					"bytes_reclaimed", report.BytesReclaimed,
+					"errors", report.Errors,
+				)
+
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,210 @@
+package gc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/melsonic/skyvault/metadata/db"
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// testTables are dropped before every test, the database of TEST_DB_*
+// must be a throwaway one
+var testTables = []string{
+	"NODE_ACL", "NODE_PROPERTY", "FILE_VERSION", "FILE_METADATA", "CHUNK_REF", "CHUNK_UPLOAD", "METADATA_MIGRATION", "NODE",
+}
+
+// testDB points db at the Postgres of TEST_DB_HOST, TEST_DB_PORT,
+// TEST_DB_USER, TEST_DB_PASSWORD and TEST_DB_DATABASE with a fresh schema,
+// the test is skipped when TEST_DB_HOST isn't set
+func testDB(t *testing.T) {
+	t.Helper()
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST not set")
+	}
+	port, err := strconv.ParseUint(os.Getenv("TEST_DB_PORT"), 10, 16)
+	if err != nil {
+		port = 5432
+	}
+	config := pgx.ConnConfig{
+		Host:     host,
+		Port:     uint16(port),
+		User:     os.Getenv("TEST_DB_USER"),
+		Password: os.Getenv("TEST_DB_PASSWORD"),
+		Database: os.Getenv("TEST_DB_DATABASE"),
+	}
+	t.Setenv("DB_HOST", config.Host)
+	t.Setenv("DB_PORT", strconv.FormatUint(port, 10))
+	t.Setenv("DB_USER", config.User)
+	t.Setenv("DB_PASSWORD", config.Password)
+	t.Setenv("DB_DATABASE", config.Database)
+
+	conn, err := pgx.Connect(config)
+	if err != nil {
+		t.Fatalf("connecting to the test database: %v", err)
+	}
+	for _, table := range testTables {
+		if _, err := conn.Exec(`DROP TABLE IF EXISTS ` + table + ` CASCADE`); err != nil {
+			t.Fatalf("dropping %s: %v", table, err)
+		}
+	}
+	conn.Close()
+
+	// InitDB wants a .env file, the variables are set already
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/.env", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := db.InitDB(); err != nil {
+		t.Fatalf("setting the schema up: %v", err)
+	}
+	t.Cleanup(db.DBConnPool.Close)
+}
+
+// memoryBlobserver serves GET /chunks and DELETE /chunk/{hash} over a map,
+// the reserved chunks are refused the way blobserver does
+type memoryBlobserver struct {
+	mu       sync.Mutex
+	chunks   map[string]storedChunk
+	reserved map[string]bool
+}
+
+func newMemoryBlobserver(t *testing.T) *memoryBlobserver {
+	t.Helper()
+	b := &memoryBlobserver{chunks: map[string]storedChunk{}, reserved: map[string]bool{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /chunks", func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		encoder := json.NewEncoder(w)
+		for _, chunk := range b.chunks {
+			encoder.Encode(chunk)
+		}
+	})
+	mux.HandleFunc("DELETE /chunk/{hash}", func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		hash := r.PathValue("hash")
+		if b.reserved[hash] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		delete(b.chunks, hash)
+		w.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	t.Setenv("BLOBSERVER_URL", server.URL)
+	return b
+}
+
+// put stores a chunk written age ago
+func (b *memoryBlobserver) put(hash string, age time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.chunks[hash] = storedChunk{Hash: hash, Size: 10, LastModified: time.Now().Add(-age)}
+}
+
+func (b *memoryBlobserver) has(hash string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.chunks[hash]
+	return ok
+}
+
+func chunkHash(c string) string {
+	return "sha256:" + strings.Repeat(c, 64)
+}
+
+func TestRunSweepsUnreferencedChunks(t *testing.T) {
+	testDB(t)
+	t.Setenv("GC_GRACE_PERIOD", "1h")
+	blobs := newMemoryBlobserver(t)
+	const alice = "alice@example.com"
+	live, trashed, purged := chunkHash("a"), chunkHash("b"), chunkHash("c")
+	orphan, young, reserved := chunkHash("d"), chunkHash("e"), chunkHash("f")
+
+	save := func(name string, hash string) string {
+		t.Helper()
+		data := types.Metadata{FileName: name, FilePath: "/docs", Hashes: []string{hash}, FileSize: 10}
+		id, err := db.SaveMetadata(alice, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strconv.Itoa(id)
+	}
+	save("live.txt", live)
+	if err := db.DeleteMetadata(alice, save("trashed.txt", trashed)); err != nil {
+		t.Fatal(err)
+	}
+	gone := save("purged.txt", purged)
+	if err := db.DeleteMetadata(alice, gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PurgeTrash(alice, gone); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{live, trashed, purged, orphan, reserved} {
+		blobs.put(hash, 2*time.Hour)
+	}
+	blobs.put(young, time.Minute)
+	blobs.reserved[reserved] = true
+
+	report, err := Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.ChunksScanned != 6 || report.ChunksDeleted != 2 || report.BytesReclaimed != 20 || report.Errors != 0 {
+		t.Errorf("report = %+v, want 6 scanned and 2 deleted", report)
+	}
+	for hash, kept := range map[string]bool{
+		live: true, trashed: true, young: true, reserved: true,
+		purged: false, orphan: false,
+	} {
+		if blobs.has(hash) != kept {
+			t.Errorf("chunk %s kept = %v, want %v", hash, !kept, kept)
+		}
+	}
+
+	// the next run sweeps it once the reservation is over
+	blobs.mu.Lock()
+	delete(blobs.reserved, reserved)
+	blobs.mu.Unlock()
+	report, err = Run(context.Background())
+	if err != nil || report.ChunksDeleted != 1 || blobs.has(reserved) {
+		t.Errorf("second run = %+v, %v, want the formerly reserved chunk deleted", report, err)
+	}
+}
+
+func TestRunWaitsForTheBackfill(t *testing.T) {
+	testDB(t)
+	blobs := newMemoryBlobserver(t)
+	blobs.put(chunkHash("a"), 48*time.Hour)
+	if _, err := db.DBConnPool.Exec(`DELETE FROM METADATA_MIGRATION`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Run(context.Background()); err == nil {
+		t.Error("Run swept before the chunk references were backfilled")
+	}
+	if !blobs.has(chunkHash("a")) {
+		t.Error("a chunk was deleted before the backfill")
+	}
+}
@@ -4,14 +4,19 @@ go 1.23.9
 
 require github.com/jackc/pgx v3.6.2+incompatible
 
+require github.com/golang-jwt/jwt/v5 v5.2.3 // indirect
+
 require (
 	github.com/cockroachdb/apd v1.1.0 // indirect
 	github.com/gofrs/uuid v4.4.0+incompatible // indirect
 	github.com/jackc/fake v0.0.0-20150926172116-812a484cc733 // indirect
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9 // indirect
+	github.com/melsonic/skyvault/auth v0.0.0
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/shopspring/decimal v1.4.0 // indirect
-	golang.org/x/crypto v0.38.0 // indirect
-	golang.org/x/text v0.25.0 // indirect
+	golang.org/x/crypto v0.40.0 // indirect
+	golang.org/x/text v0.27.0 // indirect
 )
+
+replace github.com/melsonic/skyvault/auth => ../authcomp
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,11 +14,17 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/melsonic/skyvault/auth/verify"
 	"github.com/melsonic/skyvault/metadata/db"
+	"github.com/melsonic/skyvault/metadata/gc"
 	"github.com/melsonic/skyvault/metadata/types"
 )
 
 func metadataSaveHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -31,8 +38,30 @@ func metadataSaveHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Invalid request body"))
 		return
 	}
+	data.Author = caller
+	// a file saved in a folder shared with the caller goes to its owner's tree
+	owner := caller
+	if data.Parent != "" {
+		owner, ok = authorize(w, caller, data.Parent, db.RoleEditor)
+		if !ok {
+			return
+		}
+	}
+	if !readableHashes(w, caller, data.Hashes) {
+		return
+	}
 	// Perform Operation to save Metadata
-	nodeID, err := db.SaveMetadata(&data)
+	nodeID, err := db.SaveMetadata(owner, &data)
+	if errors.Is(err, db.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if errors.Is(err, db.ErrNameTaken) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
 		slog.Error(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -53,9 +82,18 @@ func metadataSaveHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func metadataFetchHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleViewer)
+	if !ok {
+		return
+	}
 	nodeid := r.PathValue("nodeid")
 	// Perform operation to fetch hashes from Database
-	nodeMetaData, err := db.FetchMetadata(nodeid)
+	nodeMetaData, err := db.FetchMetadata(owner, nodeid)
+	if errors.Is(err, db.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
 		slog.Error(err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -73,15 +111,200 @@ func metadataFetchHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func metadataDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleEditor)
+	if !ok {
+		return
+	}
 	nodeID := r.PathValue("nodeid")
-	err := db.DeleteMetadata(nodeID)
+	err := db.DeleteMetadata(owner, nodeID)
+	if errors.Is(err, db.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
 		slog.Error("error deleting metadata", "id", nodeID, "error", err.Error())
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	w.Write([]byte("node deleted!"))
+	w.Write([]byte("node moved to trash!"))
+}
+
+// metadataMoveHandler renames a node and/or moves it to another folder
+func metadataMoveHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	var request types.MoveRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	owner, ok := authorize(w, caller, nodeID, db.RoleEditor)
+	if !ok {
+		return
+	}
+	if request.Parent != "" {
+		destinationOwner, ok := authorize(w, caller, request.Parent, db.RoleEditor)
+		if !ok || !sameTree(w, owner, destinationOwner) {
+			return
+		}
+	}
+	node, err := db.MoveNode(owner, nodeID, request)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	case errors.Is(err, db.ErrNameTaken), errors.Is(err, db.ErrCycle):
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	case err != nil:
+		slog.Error("error moving node", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	response, err := json.Marshal(node)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// metadataCopyHandler copies a file or a whole folder without copying its
+// data and returns the copy
+func metadataCopyHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	var request types.CopyRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	owner, ok := authorize(w, caller, nodeID, db.RoleViewer)
+	if !ok {
+		return
+	}
+	// the copy goes next to the node when no folder is given
+	destination := request.Parent
+	if destination == "" {
+		destination, err = db.NodeParent(owner, nodeID)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	destinationOwner, ok := authorize(w, caller, destination, db.RoleEditor)
+	if !ok || !sameTree(w, owner, destinationOwner) {
+		return
+	}
+	node, err := db.CopyNode(owner, nodeID, request)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	case errors.Is(err, db.ErrNameTaken), errors.Is(err, db.ErrCycle):
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
+		return
+	case err != nil:
+		slog.Error("error copying node", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	response, err := json.Marshal(node)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// gcHandler runs a chunk garbage collection pass on demand and returns its report
+func gcHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := gc.Run(r.Context())
+	if err != nil {
+		slog.Error("error collecting unreferenced chunks", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	response, err := json.Marshal(report)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// chunkFilesHandler tells which files are built from the requested chunks,
+// blobserver uses it to report the files hit by corrupted chunks
+func chunkFilesHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	var request types.ChunkFilesRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil || len(request.Hashes) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+	files, err := db.FilesUsingChunks(request.Hashes)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	response, err := json.Marshal(types.ChunkFilesResponse{Files: files})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
 }
 
 func main() {
@@ -100,14 +323,47 @@ func main() {
 		syscall.SIGINT,  // ctrl+c
 	)
 	db.CleanOrphanNodes(ctx)
+	gc.StartCollector(ctx)
+	db.StartVersionPruner(ctx)
+	db.StartTrashPurger(ctx)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /metadata/{nodeid}", metadataFetchHandler)
 	mux.HandleFunc("POST /metadatas", metadataSaveHandler)
 	mux.HandleFunc("DELETE /metadata/{nodeid}", metadataDeleteHandler)
+	mux.HandleFunc("PATCH /metadata/{nodeid}", metadataMoveHandler)
+	mux.HandleFunc("GET /metadata/search", searchHandler)
+	mux.HandleFunc("GET /metadata/{nodeid}/acl", accessListHandler)
+	mux.HandleFunc("PUT /metadata/{nodeid}/acl/{email}", accessGrantHandler)
+	mux.HandleFunc("DELETE /metadata/{nodeid}/acl/{email}", accessRevokeHandler)
+	mux.HandleFunc("GET /shared", sharedHandler)
+	mux.HandleFunc("GET /metadata/{nodeid}/properties", propertiesHandler)
+	mux.HandleFunc("PUT /metadata/{nodeid}/properties/{key}", setPropertyHandler)
+	mux.HandleFunc("DELETE /metadata/{nodeid}/properties/{key}", removePropertyHandler)
+	mux.HandleFunc("PUT /metadata/{nodeid}/tags/{tag}", setTagHandler)
+	mux.HandleFunc("DELETE /metadata/{nodeid}/tags/{tag}", removeTagHandler)
+	mux.HandleFunc("GET /metadata/{nodeid}/children", childrenHandler)
+	mux.HandleFunc("POST /metadata/{nodeid}/copy", metadataCopyHandler)
+	mux.HandleFunc("GET /metadata/{nodeid}/versions", versionsHandler)
+	mux.HandleFunc("GET /metadata/{nodeid}/versions/{version}", versionFetchHandler)
+	mux.HandleFunc("POST /metadata/{nodeid}/versions/{version}/restore", versionRestoreHandler)
+	mux.HandleFunc("GET /fs/{path...}", fsGetHandler)
+	mux.HandleFunc("PUT /fs/{path...}", fsPutHandler)
+	mux.HandleFunc("DELETE /fs/{path...}", fsDeleteHandler)
+	mux.HandleFunc("GET /trash", trashListHandler)
+	mux.HandleFunc("DELETE /trash", trashEmptyHandler)
+	mux.HandleFunc("POST /trash/{nodeid}/restore", trashRestoreHandler)
+	mux.HandleFunc("DELETE /trash/{nodeid}", trashPurgeHandler)
+	mux.HandleFunc("POST /gc", verify.InternalOnly(gcHandler))
+	mux.HandleFunc("POST /chunks/files", verify.InternalOnly(chunkFilesHandler))
+	mux.HandleFunc("PUT /metadata/{nodeid}/tier", storageTierHandler)
+	mux.HandleFunc("GET /chunks/tiers", verify.InternalOnly(chunkTiersHandler))
+	mux.HandleFunc("GET /chunks/{hash}/access", chunkAccessHandler)
+	mux.HandleFunc("POST /chunks/uploads", verify.InternalOnly(chunkUploadsHandler))
+	mux.HandleFunc("POST /chunks/readable", readableChunksHandler)
 	server := &http.Server{
 		Addr:           ":8001",
-		Handler:        mux,
+		Handler:        verify.Middleware(mux),
 		ReadTimeout:    10 * time.Second,
 		WriteTimeout:   10 * time.Second,
 		MaxHeaderBytes: 1 << 20,
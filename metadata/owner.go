@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/melsonic/skyvault/auth/verify"
+	"github.com/melsonic/skyvault/metadata/db"
+)
+
+// requestOwner returns the user whose tree a request works on, internal calls
+// without a token don't have one and answer 401
+func requestOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user := verify.UserFromContext(r.Context())
+	if user == nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("route needs a user access token"))
+		return "", false
+	}
+	return user.Email, true
+}
+
+// authorize returns the owner of the tree nodeID is in, answering 404 or
+// 403 itself when caller doesn't hold role on it, 400 for a malformed id
+func authorize(w http.ResponseWriter, caller string, nodeID string, role string) (string, bool) {
+	owner, err := db.Authorize(caller, nodeID, role)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, db.ErrForbidden):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, db.ErrInvalidID):
+		w.WriteHeader(http.StatusBadRequest)
+	case err != nil:
+		slog.Error("error checking access", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		return owner, true
+	}
+	w.Write([]byte(err.Error()))
+	return "", false
+}
+
+// nodeOwner is authorize for the node of the {nodeid} path value
+func nodeOwner(w http.ResponseWriter, r *http.Request, role string) (string, bool) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return "", false
+	}
+	return authorize(w, caller, r.PathValue("nodeid"), role)
+}
+
+// sameTree answers 400 when a node would leave the tree it is in
+func sameTree(w http.ResponseWriter, owner string, destinationOwner string) bool {
+	if owner != destinationOwner {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("nodes can't move or be copied to another user's tree"))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/melsonic/skyvault/metadata/db"
+)
+
+// propertyFilter reads the repeatable tag=<tag> and prop=<key>=<value>
+// parameters of the query string. It answers 400 itself when one is invalid.
+func propertyFilter(w http.ResponseWriter, r *http.Request) (db.PropertyFilter, bool) {
+	params := r.URL.Query()
+	filter := db.PropertyFilter{Tags: params["tag"]}
+	for _, property := range params["prop"] {
+		key, value, ok := strings.Cut(property, "=")
+		if !ok || key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("prop must be key=value"))
+			return filter, false
+		}
+		if filter.Properties == nil {
+			filter.Properties = map[string]string{}
+		}
+		filter.Properties[key] = value
+	}
+	return filter, true
+}
+
+// writePropertyError answers the errors of the property handlers
+func writePropertyError(w http.ResponseWriter, nodeID string, err error) {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, db.ErrInvalidPropertyKey), errors.Is(err, db.ErrInvalidPropertyValue):
+		w.WriteHeader(http.StatusBadRequest)
+	default:
+		slog.Error("error handling properties", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// propertiesHandler returns the tags and the properties of a file or folder
+func propertiesHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleViewer)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	properties, err := db.FetchProperties(owner, nodeID)
+	if err != nil {
+		writePropertyError(w, nodeID, err)
+		return
+	}
+	writeJSON(w, properties)
+}
+
+// setTagHandler tags a file or folder
+func setTagHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleEditor)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	if err := db.SetTag(owner, nodeID, r.PathValue("tag")); err != nil {
+		writePropertyError(w, nodeID, err)
+		return
+	}
+	w.Write([]byte("tag set!"))
+}
+
+// removeTagHandler takes a tag off a file or folder
+func removeTagHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleEditor)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	if err := db.RemoveTag(owner, nodeID, r.PathValue("tag")); err != nil {
+		writePropertyError(w, nodeID, err)
+		return
+	}
+	w.Write([]byte("tag removed!"))
+}
+
+// setPropertyHandler sets a property of a file or folder to the JSON
+// string, number or boolean of the body
+func setPropertyHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleEditor)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	err = db.SetProperty(owner, nodeID, r.PathValue("key"), json.RawMessage(body))
+	if err != nil {
+		writePropertyError(w, nodeID, err)
+		return
+	}
+	w.Write([]byte("property set!"))
+}
+
+// removePropertyHandler deletes a property of a file or folder
+func removePropertyHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleEditor)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	if err := db.RemoveProperty(owner, nodeID, r.PathValue("key")); err != nil {
+		writePropertyError(w, nodeID, err)
+		return
+	}
+	w.Write([]byte("property removed!"))
+}
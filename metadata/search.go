@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/melsonic/skyvault/metadata/db"
+)
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// searchHandler searches the caller's tree. The query string takes q and
+// match (substring, prefix or fuzzy) for the name, folder for the subtree,
+// type, min_size and max_size, created_after, created_before,
+// modified_after and modified_before as RFC 3339 times, the tag and prop
+// filters of propertyFilter, limit and offset.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	params := r.URL.Query()
+	query := db.SearchQuery{
+		Folder: params.Get("folder"),
+		Name:   params.Get("q"),
+		Match:  params.Get("match"),
+		Limit:  defaultSearchLimit,
+	}
+	if fileType := params.Get("type"); fileType != "" {
+		if !strings.HasPrefix(fileType, ".") {
+			fileType = "." + fileType
+		}
+		query.FileType = fileType
+	}
+
+	invalid := func(name string) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid " + name))
+	}
+	numbers := map[string]*int64{"min_size": &query.MinSize, "max_size": &query.MaxSize}
+	for name, field := range numbers {
+		if value := params.Get(name); value != "" {
+			number, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || number < 0 {
+				invalid(name)
+				return
+			}
+			*field = number
+		}
+	}
+	times := map[string]*time.Time{
+		"created_after":   &query.CreatedAfter,
+		"created_before":  &query.CreatedBefore,
+		"modified_after":  &query.ModifiedAfter,
+		"modified_before": &query.ModifiedBefore,
+	}
+	for name, field := range times {
+		if value := params.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				invalid(name)
+				return
+			}
+			*field = parsed
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxSearchLimit {
+			invalid("limit")
+			return
+		}
+		query.Limit = value
+	}
+	if offset := params.Get("offset"); offset != "" {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			invalid("offset")
+			return
+		}
+		query.Offset = value
+	}
+	filter, ok := propertyFilter(w, r)
+	if !ok {
+		return
+	}
+	query.Filter = filter
+
+	results, err := db.SearchNodes(owner, query)
+	if errors.Is(err, db.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		slog.Error("error searching", "owner", owner, "error", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, results)
+}
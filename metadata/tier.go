@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/melsonic/skyvault/metadata/db"
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// storageTierHandler pins the chunks of a file to blobserver's hot or
+// cold tier, an empty tier lets blobserver decide again
+func storageTierHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleEditor)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Error reading request body"))
+		return
+	}
+	var request types.StorageTierRequest
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid request body"))
+		return
+	}
+	err = db.SetStorageTier(owner, nodeID, request.Tier)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("no file with this node id"))
+		return
+	case errors.Is(err, db.ErrUnknownTier):
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	case err != nil:
+		slog.Error("error setting storage tier", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("storage tier updated!"))
+}
+
+// chunkTiersHandler lists the chunks of pinned files for blobserver's tier migration
+func chunkTiersHandler(w http.ResponseWriter, r *http.Request) {
+	tiers, err := db.ChunkTierOverrides()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	response, err := json.Marshal(types.ChunkTiersResponse{Tiers: tiers})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/melsonic/skyvault/metadata/db"
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// trashListHandler lists what the caller deleted and when it gets purged
+func trashListHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	entries, err := db.ListTrash(owner)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, types.TrashResponse{Entries: entries})
+}
+
+// trashRestoreHandler puts a deleted node back where it was
+func trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	node, err := db.RestoreTrash(owner, nodeID)
+	if errors.Is(err, db.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		slog.Error("error restoring node", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, node)
+}
+
+// trashPurgeHandler deletes a node of the trash for good
+func trashPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	err := db.PurgeTrash(owner, nodeID)
+	if errors.Is(err, db.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		slog.Error("error purging node", "id", nodeID, "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte("node purged!"))
+}
+
+// trashEmptyHandler deletes everything in the caller's trash for good
+func trashEmptyHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	purged, err := db.EmptyTrash(owner)
+	if err != nil {
+		slog.Error("error emptying trash", "error", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("%d nodes purged!", purged)))
+}
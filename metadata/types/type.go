@@ -1,6 +1,9 @@
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // FilePath will not contain the filename
 // If IsFolder is true, FileName & Hashes will be empty
@@ -14,4 +17,169 @@ type Metadata struct {
 	CreatedAt    time.Time `json:"created_at"`
 	LastAccess   time.Time `json:"last_access"`
 	LastModified time.Time `json:"last_modified"`
+	// StorageTier pins the chunks of a file to blobserver's hot or cold
+	// tier, empty leaves it to how recently they were read
+	StorageTier string `json:"storage_tier,omitempty"`
+	// Parent, a folder id, makes FilePath start there instead of at the
+	// root, to save into a folder shared with the caller
+	Parent string `json:"parent,omitempty"`
+	// Version counts the contents the file had, Author saved the current one
+	Version int    `json:"version,omitempty"`
+	Author  string `json:"author,omitempty"`
+	// Tags and Properties label the file, see NodeProperties
+	Tags       []string                   `json:"tags,omitempty"`
+	Properties map[string]json.RawMessage `json:"properties,omitempty"`
+}
+
+type ChunkFilesRequest struct {
+	Hashes []string `json:"hashes"`
+}
+
+// ChunkUploadsRequest tells metadata that Email uploaded the chunks
+type ChunkUploadsRequest struct {
+	Email  string   `json:"email"`
+	Hashes []string `json:"hashes"`
+}
+
+// ReadableChunksResponse lists the requested chunks the caller can read
+type ReadableChunksResponse struct {
+	Readable []string `json:"readable"`
+}
+
+// ChunkFile is a file built from one of the requested chunks
+type ChunkFile struct {
+	Hash     string `json:"hash"`
+	NodeID   string `json:"nodeid"`
+	FileName string `json:"filename"`
+}
+
+type ChunkFilesResponse struct {
+	Files []ChunkFile `json:"files"`
+}
+
+type StorageTierRequest struct {
+	Tier string `json:"tier"`
+}
+
+// ChunkTiersResponse maps chunks to the tier their files are pinned to
+type ChunkTiersResponse struct {
+	Tiers map[string]string `json:"tiers"`
+}
+
+// Node is a folder or file of a folder listing
+type Node struct {
+	NodeID       string    `json:"nodeid"`
+	Name         string    `json:"name"`
+	IsFolder     bool      `json:"is_folder"`
+	FileType     string    `json:"file_type,omitempty"`
+	FileSize     int       `json:"filesize"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastAccess   time.Time `json:"last_access"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// ChildrenResponse is one page of a folder listing, NextCursor
+// is empty on the last one
+type ChildrenResponse struct {
+	Children   []Node `json:"children"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// SearchResult is a node found by a search with the folder it is in
+type SearchResult struct {
+	Node
+	ParentID string `json:"parent"`
+}
+
+// SearchResponse is one page of search results, NextOffset is 0 on the
+// last one
+type SearchResponse struct {
+	Results    []SearchResult `json:"results"`
+	NextOffset int            `json:"next_offset,omitempty"`
+}
+
+// MoveRequest renames a node and/or moves it to the folder Parent, "root"
+// for the root folder. Empty fields are left as they are.
+type MoveRequest struct {
+	Name   string `json:"name"`
+	Parent string `json:"parent"`
+	// OnConflict is fail, rename or overwrite
+	OnConflict string `json:"on_conflict"`
+}
+
+// CopyRequest copies a node into the folder Parent, "root" for the root
+// folder, under Name. Empty fields keep the ones of the copied node.
+type CopyRequest struct {
+	Name   string `json:"name"`
+	Parent string `json:"parent"`
+	// OnConflict is fail, rename or overwrite
+	OnConflict string `json:"on_conflict"`
+}
+
+// FileVersion is one content a file had, Current is the one it has
+type FileVersion struct {
+	Version   int       `json:"version"`
+	FileType  string    `json:"file_type"`
+	FileSize  int       `json:"filesize"`
+	Author    string    `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+	Current   bool      `json:"current"`
+}
+
+type FileVersionsResponse struct {
+	Versions []FileVersion `json:"versions"`
+}
+
+// TrashEntry is a deleted node, OriginalPath the folder it was deleted from
+type TrashEntry struct {
+	NodeID       string    `json:"nodeid"`
+	Name         string    `json:"name"`
+	IsFolder     bool      `json:"is_folder"`
+	FileSize     int       `json:"filesize"`
+	OriginalPath string    `json:"original_path"`
+	TrashedAt    time.Time `json:"trashed_at"`
+	PurgeAt      time.Time `json:"purge_at"`
+}
+
+type TrashResponse struct {
+	Entries []TrashEntry `json:"entries"`
+}
+
+// NodeProperties are the labels of a node: tags, which are bare keys, and
+// properties mapping keys to a string, a number or a boolean
+type NodeProperties struct {
+	Tags       []string                   `json:"tags"`
+	Properties map[string]json.RawMessage `json:"properties"`
+}
+
+// AccessEntry gives Email a role on the node NodeID and everything below
+// it, Inherited when NodeID is a folder above the node listed
+type AccessEntry struct {
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	NodeID    string    `json:"nodeid"`
+	Inherited bool      `json:"inherited"`
+	GrantedBy string    `json:"granted_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AccessResponse struct {
+	Entries []AccessEntry `json:"entries"`
+}
+
+type AccessRequest struct {
+	Role string `json:"role"`
+}
+
+// SharedNode is a node of Owner's tree shared with the caller
+type SharedNode struct {
+	Node
+	Owner    string    `json:"owner"`
+	Role     string    `json:"role"`
+	SharedBy string    `json:"shared_by"`
+	SharedAt time.Time `json:"shared_at"`
+}
+
+type SharedResponse struct {
+	Shared []SharedNode `json:"shared"`
 }
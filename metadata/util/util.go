@@ -4,8 +4,23 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 )
 
+// DefaultHashAlgorithm is assumed by blobserver for hashes without an algorithm prefix
+const DefaultHashAlgorithm = "sha256"
+
+// storage tiers of blobserver a file can be pinned to
+const (
+	StorageTierHot  = "hot"
+	StorageTierCold = "cold"
+)
+
+// IsStorageTier accepts the known tiers, and no tier at all
+func IsStorageTier(tier string) bool {
+	return tier == "" || tier == StorageTierHot || tier == StorageTierCold
+}
+
 type fileExtension string
 
 func GetFileExtension(fileName string) (fileExtension, error) {
@@ -29,4 +44,39 @@ func FormatHashedChunks(hashedChunks []string) string {
 	hashes += "}"
 	
 	return hashes
-}
\ No newline at end of file
+}
+
+// CanonicalHash returns the chunk key blobserver stores a hash under,
+// bare digests get the default algorithm prefix
+func CanonicalHash(hash string) string {
+	if strings.Contains(hash, ":") {
+		return strings.ToLower(hash)
+	}
+	return DefaultHashAlgorithm + ":" + strings.ToLower(hash)
+}
+
+// what happens when a node is moved or copied next to one of the same name
+const (
+	ConflictFail      = "fail"
+	ConflictRename    = "rename"
+	ConflictOverwrite = "overwrite"
+)
+
+// IsConflictPolicy accepts the known policies, and none at all which fails
+func IsConflictPolicy(policy string) bool {
+	return policy == "" || policy == ConflictFail || policy == ConflictRename || policy == ConflictOverwrite
+}
+
+// IsValidNodeName refuses the names SaveMetadata couldn't walk a path through
+func IsValidNodeName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// NumberedName returns the n-th alternative of a taken name, "a (n).txt" for "a.txt"
+func NumberedName(name string, isFolder bool, n int) string {
+	ext := ""
+	if !isFolder {
+		ext = filepath.Ext(name)
+	}
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
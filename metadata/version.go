@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/melsonic/skyvault/metadata/db"
+	"github.com/melsonic/skyvault/metadata/types"
+)
+
+// writeVersionError answers the errors the version handlers share
+func writeVersionError(w http.ResponseWriter, nodeID string, err error) {
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrVersionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	slog.Error("error handling file version", "id", nodeID, "error", err.Error())
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(err.Error()))
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	response, err := json.Marshal(value)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+// versionsHandler lists the versions of a file, newest first
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleViewer)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	versions, err := db.ListVersions(owner, nodeID)
+	if err != nil {
+		writeVersionError(w, nodeID, err)
+		return
+	}
+	writeJSON(w, types.FileVersionsResponse{Versions: versions})
+}
+
+// versionFetchHandler returns a version of a file with the chunks to download it
+func versionFetchHandler(w http.ResponseWriter, r *http.Request) {
+	owner, ok := nodeOwner(w, r, db.RoleViewer)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid version"))
+		return
+	}
+	data, err := db.FetchVersion(owner, nodeID, version)
+	if err != nil {
+		writeVersionError(w, nodeID, err)
+		return
+	}
+	writeJSON(w, data)
+}
+
+// versionRestoreHandler makes an older version of a file its current content
+func versionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	caller, ok := requestOwner(w, r)
+	if !ok {
+		return
+	}
+	owner, ok := authorize(w, caller, r.PathValue("nodeid"), db.RoleEditor)
+	if !ok {
+		return
+	}
+	nodeID := r.PathValue("nodeid")
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("invalid version"))
+		return
+	}
+	data, err := db.RestoreVersion(owner, caller, nodeID, version)
+	if err != nil {
+		writeVersionError(w, nodeID, err)
+		return
+	}
+	writeJSON(w, data)
+}